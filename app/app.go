@@ -1,24 +1,20 @@
 package app
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"runtime"
+	"strings"
 
 	"github.com/net-byte/vtun/common"
 	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/vtun/transport/protocol/dtls"
-	"github.com/net-byte/vtun/transport/protocol/grpc"
-	"github.com/net-byte/vtun/transport/protocol/h1"
-	"github.com/net-byte/vtun/transport/protocol/h2"
-	"github.com/net-byte/vtun/transport/protocol/kcp"
-	"github.com/net-byte/vtun/transport/protocol/quic"
-	"github.com/net-byte/vtun/transport/protocol/tcp"
-	"github.com/net-byte/vtun/transport/protocol/tls"
-	"github.com/net-byte/vtun/transport/protocol/udp"
-	"github.com/net-byte/vtun/transport/protocol/utls"
-	"github.com/net-byte/vtun/transport/protocol/ws"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/transport"
 	"github.com/net-byte/vtun/transport/tun"
+	"github.com/net-byte/vtun/transport/tunnel"
 	"github.com/net-byte/water"
 )
 
@@ -36,100 +32,95 @@ func NewApp(config *config.Config) *App {
 	}
 }
 
-// InitConfig initializes the config
-func (app *App) InitConfig() {
+// InitConfig checks and initializes the config, the server creates its tun interface.
+// StopApp must be called even if it fails, to revert what was set before the failure.
+func (app *App) InitConfig() error {
+	if _, err := transport.Get(app.Config.Protocol); err != nil {
+		return fmt.Errorf("%w, available protocols: %s", err, strings.Join(transport.Names(), "/"))
+	}
+	if _, err := xproto.ParseCiphers(app.Config.Cipher); err != nil {
+		return fmt.Errorf("error cipher: %w", err)
+	}
+	if app.Config.Batch < 0 || app.Config.Batch > xproto.MaxBatchSize {
+		return fmt.Errorf("error batch: %d is not between 0 and %d", app.Config.Batch, xproto.MaxBatchSize)
+	}
+	if _, err := xproto.ParseAddrs(app.Config.DNS); err != nil {
+		return fmt.Errorf("error dns: %w", err)
+	}
+	if _, err := xproto.ParseDomains(app.Config.DNSSearch); err != nil {
+		return fmt.Errorf("error dns search: %w", err)
+	}
 	if !app.Config.ServerMode {
 		app.Config.LocalGateway = netutil.DiscoverGateway(true)
 		app.Config.LocalGatewayv6 = netutil.DiscoverGateway(false)
-	}
-	app.Config.BufferSize = 64 * 1024
-	cipher.SetKey(app.Config.Key)
-	app.Iface = tun.CreateTun(*app.Config)
-	log.Printf("initialized config: %+v", app.Config)
-	netutil.PrintStats(app.Config.Verbose, app.Config.ServerMode)
-}
-
-// StartApp starts the app
-func (app *App) StartApp() {
-	switch app.Config.Protocol {
-	case "udp":
-		if app.Config.ServerMode {
-			udp.StartServer(app.Iface, *app.Config)
-		} else {
-			udp.StartClient(app.Iface, *app.Config)
-		}
-	case "ws", "wss":
-		if app.Config.ServerMode {
-			ws.StartServer(app.Iface, *app.Config)
-		} else {
-			ws.StartClient(app.Iface, *app.Config)
-		}
-	case "tls":
-		if app.Config.ServerMode {
-			tls.StartServer(app.Iface, *app.Config)
-		} else {
-			tls.StartClient(app.Iface, *app.Config)
-		}
-	case "grpc":
-		if app.Config.ServerMode {
-			grpc.StartServer(app.Iface, *app.Config)
-		} else {
-			grpc.StartClient(app.Iface, *app.Config)
+		if _, err := tun.ParseRoutes(app.Config.IncludeRoutes); err != nil {
+			return fmt.Errorf("error include routes: %w", err)
 		}
-	case "quic":
-		if app.Config.ServerMode {
-			quic.StartServer(app.Iface, *app.Config)
-		} else {
-			quic.StartClient(app.Iface, *app.Config)
+		if _, err := tun.ParseRoutes(app.Config.ExcludeRoutes); err != nil {
+			return fmt.Errorf("error exclude routes: %w", err)
 		}
-	case "kcp":
-		if app.Config.ServerMode {
-			kcp.StartServer(app.Iface, *app.Config)
-		} else {
-			kcp.StartClient(app.Iface, *app.Config)
+		if app.Config.FwMark != 0 && runtime.GOOS != "linux" {
+			log.Printf("fwmark is only supported on linux, ignored")
+			app.Config.FwMark = 0
 		}
-	case "utls":
-		if app.Config.ServerMode {
-			utls.StartServer(app.Iface, *app.Config)
-		} else {
-			utls.StartClient(app.Iface, *app.Config)
+		if app.Config.KillSwitch && (runtime.GOOS != "linux" || !app.Config.GlobalMode) {
+			log.Printf("kill switch is only supported in global mode on linux, ignored")
+			app.Config.KillSwitch = false
 		}
-	case "dtls":
-		if app.Config.ServerMode {
-			dtls.StartServer(app.Iface, *app.Config)
-		} else {
-			dtls.StartClient(app.Iface, *app.Config)
-		}
-	case "h2":
-		if app.Config.ServerMode {
-			h2.StartServer(app.Iface, *app.Config)
-		} else {
-			h2.StartClient(app.Iface, *app.Config)
-		}
-	case "tcp":
-		if app.Config.ServerMode {
-			tcp.StartServer(app.Iface, *app.Config)
-		} else {
-			tcp.StartClient(app.Iface, *app.Config)
+	}
+	// the routes left by a previous run which did not stop cleanly are reverted before any change
+	if err := tun.OpenJournal(app.Config.StateFile); err != nil {
+		return fmt.Errorf("failed to open the state file: %w", err)
+	}
+	app.Config.BufferSize = 64 * 1024
+	cipher.SetKey(app.Config.Key)
+	// the client creates the tun interface once the server has assigned its addresses
+	if app.Config.ServerMode {
+		iFace, err := tun.CreateTun(*app.Config)
+		if err != nil {
+			return err
 		}
-	case "http", "https":
-		if app.Config.ServerMode {
-			h1.StartServer(app.Iface, *app.Config)
-		} else {
-			h1.StartClient(app.Iface, *app.Config)
+		app.Iface = iFace
+		if app.Config.NAT {
+			if err := tun.SetNAT(*app.Config); err != nil {
+				return fmt.Errorf("failed to set nat: %w", err)
+			}
 		}
-	default:
-		if app.Config.ServerMode {
-			udp.StartServer(app.Iface, *app.Config)
-		} else {
-			udp.StartClient(app.Iface, *app.Config)
+	}
+	log.Printf("initialized config: %+v", app.Config)
+	return nil
+}
+
+// StartApp runs the app until the context is done, then the sessions are closed and it returns.
+// It returns an error if the app fails before.
+func (app *App) StartApp(ctx context.Context) error {
+	t, err := transport.Get(app.Config.Protocol)
+	if err != nil {
+		return err
+	}
+	netutil.PrintStats(ctx, app.Config.Verbose, app.Config.ServerMode)
+	if app.Config.ServerMode {
+		if err := tunnel.StartServer(ctx, app.Iface, t, *app.Config); err != nil {
+			return fmt.Errorf("vtun %s server error: %w", t.Name(), err)
 		}
+		return nil
 	}
+	return tunnel.StartClient(ctx, t, *app.Config, func(iFace *water.Interface, config config.Config) {
+		app.Iface = iFace
+		*app.Config = config
+	})
 }
 
-// StopApp stops the app
+// StopApp reverts the routes and closes the tun interface once StartApp returned
 func (app *App) StopApp() {
-	tun.ResetRoute(*app.Config)
-	app.Iface.Close()
+	if err := tun.ResetRoute(*app.Config); err != nil {
+		log.Printf("failed to reset routes: %v", err)
+	}
+	if err := tun.CloseJournal(); err != nil {
+		log.Printf("failed to release the state file: %v", err)
+	}
+	if app.Iface != nil {
+		app.Iface.Close()
+	}
 	log.Println("vtun stopped")
 }
@@ -0,0 +1,16 @@
+package app
+
+// The transports are registered by their packages
+import (
+	_ "github.com/net-byte/vtun/transport/protocol/dtls"
+	_ "github.com/net-byte/vtun/transport/protocol/grpc"
+	_ "github.com/net-byte/vtun/transport/protocol/h1"
+	_ "github.com/net-byte/vtun/transport/protocol/h2"
+	_ "github.com/net-byte/vtun/transport/protocol/kcp"
+	_ "github.com/net-byte/vtun/transport/protocol/quic"
+	_ "github.com/net-byte/vtun/transport/protocol/tcp"
+	_ "github.com/net-byte/vtun/transport/protocol/tls"
+	_ "github.com/net-byte/vtun/transport/protocol/udp"
+	_ "github.com/net-byte/vtun/transport/protocol/utls"
+	_ "github.com/net-byte/vtun/transport/protocol/ws"
+)
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownUser  = errors.New("unknown user")
+	ErrDisabledUser = errors.New("user is disabled")
+)
+
+// User is an entry of the users file
+type User struct {
+	Name    string `json:"name"`
+	Secret  string `json:"secret"`
+	Enabled bool   `json:"enabled"`
+	// IP and IPv6 are the optional fixed tunnel addresses of the user
+	IP   string `json:"ip,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+	// Subnets are the subnets the client of the user may route behind it, the advertised ones inside them are accepted
+	Subnets []string `json:"subnets,omitempty"`
+}
+
+// Addrs returns the fixed tunnel addresses of the user, they are invalid if not set
+func (u *User) Addrs() (ipv4 netip.Addr, ipv6 netip.Addr) {
+	ipv4, _ = netip.ParseAddr(u.IP)
+	ipv6, _ = netip.ParseAddr(u.IPv6)
+	return ipv4, ipv6
+}
+
+// Prefixes returns the subnets the client of the user may route behind it
+func (u *User) Prefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(u.Subnets))
+	for _, subnet := range u.Subnets {
+		if p, err := netip.ParsePrefix(subnet); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	return prefixes
+}
+
+// validate checks the fields of the user, the fixed addresses must be in one of the pools if any is given.
+// The first address and the server address of a pool are not valid fixed addresses.
+func (u *User) validate(pools []netip.Prefix) error {
+	if u.Name == "" {
+		return errors.New("user without name")
+	}
+	if len(u.Name) > 255 {
+		return fmt.Errorf("user name %q is too long", u.Name)
+	}
+	if u.Secret == "" {
+		return fmt.Errorf("user %q has no secret", u.Name)
+	}
+	if u.IP != "" {
+		ip, err := netip.ParseAddr(u.IP)
+		if err != nil || !ip.Is4() {
+			return fmt.Errorf("user %q has an invalid ip %q", u.Name, u.IP)
+		}
+		if !inPools(ip, pools) {
+			return fmt.Errorf("user %q has the ip %s out of the pool %v", u.Name, ip, pools)
+		}
+	}
+	if u.IPv6 != "" {
+		ip, err := netip.ParseAddr(u.IPv6)
+		if err != nil || !ip.Is6() {
+			return fmt.Errorf("user %q has an invalid ipv6 %q", u.Name, u.IPv6)
+		}
+		if !inPools(ip, pools) {
+			return fmt.Errorf("user %q has the ipv6 %s out of the pool %v", u.Name, ip, pools)
+		}
+	}
+	for _, subnet := range u.Subnets {
+		if _, err := netip.ParsePrefix(subnet); err != nil {
+			return fmt.Errorf("user %q has an invalid subnet %q", u.Name, subnet)
+		}
+	}
+	return nil
+}
+
+// inPools reports whether the ip is a client address of one of the pools, or there is no pool
+func inPools(ip netip.Addr, pools []netip.Prefix) bool {
+	if len(pools) == 0 {
+		return true
+	}
+	for _, pool := range pools {
+		if pool.Contains(ip) && ip != pool.Addr() && ip != pool.Masked().Addr() {
+			return true
+		}
+	}
+	return false
+}
+
+// Users is the user database loaded from a json file, the file is reloaded when it changes
+// so users can be added or revoked without restarting the server.
+type Users struct {
+	path    string
+	pools   []netip.Prefix
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]*User
+	// reloaded is called after a reload with the users which were revoked or changed
+	reloaded func(revoked []string)
+}
+
+// LoadUsers loads the users file, the fixed addresses of the users must be in one of the pools if any is given
+func LoadUsers(path string, pools ...netip.Prefix) (*Users, error) {
+	u := &Users{path: path, pools: pools}
+	if err := u.load(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ParseUsers parses the json array of the users, the fixed addresses of the users must be in one of the pools if any is given
+func ParseUsers(data []byte, pools ...netip.Prefix) (map[string]*User, error) {
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	users := make(map[string]*User, len(list))
+	fixed := make(map[netip.Addr]string)
+	for _, user := range list {
+		if err := user.validate(pools); err != nil {
+			return nil, err
+		}
+		if _, dup := users[user.Name]; dup {
+			return nil, fmt.Errorf("duplicate user %q", user.Name)
+		}
+		ipv4, ipv6 := user.Addrs()
+		for _, addr := range []netip.Addr{ipv4, ipv6} {
+			if !addr.IsValid() {
+				continue
+			}
+			if other, dup := fixed[addr]; dup {
+				return nil, fmt.Errorf("users %q and %q have the same address %s", other, user.Name, addr)
+			}
+			fixed[addr] = user.Name
+		}
+		users[user.Name] = user
+	}
+	return users, nil
+}
+
+func (u *Users) load() error {
+	info, err := os.Stat(u.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+	users, err := ParseUsers(data, u.pools...)
+	if err != nil {
+		return fmt.Errorf("users file %s: %w", u.path, err)
+	}
+	u.users = users
+	u.modTime = info.ModTime()
+	return nil
+}
+
+// OnReload sets the function called after each reload with the names of the users which were removed, disabled,
+// or whose secret or fixed addresses changed, so their sessions can be closed
+func (u *Users) OnReload(fn func(revoked []string)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.reloaded = fn
+}
+
+// Reload reads the file again if it was modified, Lookup does it too
+func (u *Users) Reload() {
+	u.mu.Lock()
+	done := u.reload()
+	u.mu.Unlock()
+	done()
+}
+
+// reload reads the file again if it was modified, the loaded users are kept if it is invalid.
+// It returns the call of the reload function, to be made once the lock is released.
+func (u *Users) reload() func() {
+	info, err := os.Stat(u.path)
+	if err != nil || info.ModTime().Equal(u.modTime) {
+		return func() {}
+	}
+	old := u.users
+	if err := u.load(); err != nil {
+		log.Printf("failed to reload users: %v", err)
+		return func() {}
+	}
+	log.Printf("reloaded %d users from %s", len(u.users), u.path)
+	fn := u.reloaded
+	if fn == nil {
+		return func() {}
+	}
+	revoked := revokedUsers(old, u.users)
+	return func() { fn(revoked) }
+}
+
+// revokedUsers returns the names of the enabled users of old which are removed, disabled,
+// or whose secret or fixed addresses changed or whose subnets are no longer all allowed in users
+func revokedUsers(old, users map[string]*User) []string {
+	var revoked []string
+	for name, o := range old {
+		if !o.Enabled {
+			continue
+		}
+		n, ok := users[name]
+		if !ok || !n.Enabled || n.Secret != o.Secret || n.IP != o.IP || n.IPv6 != o.IPv6 || removedSubnet(o, n) {
+			revoked = append(revoked, name)
+		}
+	}
+	sort.Strings(revoked)
+	return revoked
+}
+
+// removedSubnet reports whether a subnet allowed to old is not allowed to user
+func removedSubnet(old, user *User) bool {
+	for _, subnet := range old.Subnets {
+		if !slices.Contains(user.Subnets, subnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// FixedAddrs returns the fixed addresses of the users with the names of their users
+func (u *Users) FixedAddrs() map[netip.Addr]string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	addrs := make(map[netip.Addr]string)
+	for name, user := range u.users {
+		ipv4, ipv6 := user.Addrs()
+		for _, addr := range []netip.Addr{ipv4, ipv6} {
+			if addr.IsValid() {
+				addrs[addr] = name
+			}
+		}
+	}
+	return addrs
+}
+
+// Lookup returns the enabled user with the given name
+func (u *Users) Lookup(name string) (*User, error) {
+	u.mu.Lock()
+	done := u.reload()
+	user, ok := u.users[name]
+	u.mu.Unlock()
+	done()
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	if !user.Enabled {
+		return nil, ErrDisabledUser
+	}
+	return user, nil
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUsers(t *testing.T) {
+	users, err := ParseUsers([]byte(`[
+		{"name": "alice", "secret": "a", "enabled": true, "ip": "172.16.0.20"},
+		{"name": "bob", "secret": "b", "enabled": false}
+	]`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(users))
+	ipv4, ipv6 := users["alice"].Addrs()
+	assert.Equal(t, "172.16.0.20", ipv4.String())
+	assert.False(t, ipv6.IsValid())
+
+	_, err = ParseUsers([]byte(`[{"name": "alice", "secret": "a"}, {"name": "alice", "secret": "b"}]`))
+	assert.NotNil(t, err)
+	_, err = ParseUsers([]byte(`[{"name": "alice"}]`))
+	assert.NotNil(t, err)
+	_, err = ParseUsers([]byte(`[{"name": "alice", "secret": "a", "ip": "fced::1"}]`))
+	assert.NotNil(t, err)
+	_, err = ParseUsers([]byte(`[{"name": "alice", "secret": "a", "subnets": ["192.168.1.0"]}]`))
+	assert.NotNil(t, err)
+
+	users, err = ParseUsers([]byte(`[{"name": "alice", "secret": "a", "subnets": ["192.168.1.1/24", "fd00:1::/64"]}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, "[192.168.1.0/24 fd00:1::/64]", fmt.Sprint(users["alice"].Prefixes()))
+}
+
+func TestParseUsers_Pools(t *testing.T) {
+	pools := []netip.Prefix{netip.MustParsePrefix("172.16.0.1/24"), netip.MustParsePrefix("fced:9999::1/64")}
+	_, err := ParseUsers([]byte(`[{"name": "alice", "secret": "a", "ip": "172.16.0.20", "ipv6": "fced:9999::20"}]`), pools...)
+	assert.Nil(t, err)
+	// the fixed addresses must be client addresses of the pools
+	for _, addrs := range []string{`"ip": "10.0.0.20"`, `"ip": "172.16.0.1"`, `"ip": "172.16.0.0"`, `"ipv6": "fd00::20"`} {
+		_, err = ParseUsers([]byte(`[{"name": "alice", "secret": "a", `+addrs+`}]`), pools...)
+		assert.NotNil(t, err, addrs)
+	}
+	_, err = ParseUsers([]byte(`[{"name": "alice", "secret": "a", "ipv6": "fced:9999::20"}]`), pools[0])
+	assert.NotNil(t, err)
+	_, err = ParseUsers([]byte(`[{"name": "alice", "secret": "a", "ip": "172.16.0.20"}, {"name": "bob", "secret": "b", "ip": "172.16.0.20"}]`))
+	assert.NotNil(t, err)
+}
+
+func TestUsers_Lookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"name": "alice", "secret": "a", "enabled": true}, {"name": "bob", "secret": "b"}]`), 0600))
+	users, err := LoadUsers(path)
+	assert.Nil(t, err)
+
+	user, err := users.Lookup("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", user.Secret)
+	_, err = users.Lookup("bob")
+	assert.Equal(t, ErrDisabledUser, err)
+	_, err = users.Lookup("carol")
+	assert.Equal(t, ErrUnknownUser, err)
+
+	// revoke alice
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"name": "alice", "secret": "a", "enabled": false}]`), 0600))
+	later := time.Now().Add(time.Second)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	_, err = users.Lookup("alice")
+	assert.Equal(t, ErrDisabledUser, err)
+
+	// an invalid file keeps the loaded users
+	assert.Nil(t, os.WriteFile(path, []byte(`[`), 0600))
+	later = later.Add(time.Second)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	_, err = users.Lookup("alice")
+	assert.Equal(t, ErrDisabledUser, err)
+}
+
+func TestUsers_OnReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	write := func(data string, at time.Time) {
+		assert.Nil(t, os.WriteFile(path, []byte(data), 0600))
+		assert.Nil(t, os.Chtimes(path, at, at))
+	}
+	now := time.Now()
+	write(`[{"name": "alice", "secret": "a", "enabled": true}, {"name": "bob", "secret": "b", "enabled": true, "ip": "172.16.0.20"},
+		{"name": "carol", "secret": "c", "enabled": true}, {"name": "dave", "secret": "d", "enabled": true}, {"name": "erin", "secret": "e"}]`, now)
+	users, err := LoadUsers(path)
+	assert.Nil(t, err)
+	var revoked []string
+	users.OnReload(func(names []string) { revoked = names })
+	assert.Equal(t, map[netip.Addr]string{netip.MustParseAddr("172.16.0.20"): "bob"}, users.FixedAddrs())
+
+	// alice is disabled, the address of bob and the secret of carol change, dave is removed, erin is enabled
+	write(`[{"name": "alice", "secret": "a"}, {"name": "bob", "secret": "b", "enabled": true, "ip": "172.16.0.21"},
+		{"name": "carol", "secret": "c2", "enabled": true}, {"name": "erin", "secret": "e", "enabled": true}]`, now.Add(time.Second))
+	users.Reload()
+	assert.Equal(t, []string{"alice", "bob", "carol", "dave"}, revoked)
+	assert.Equal(t, map[netip.Addr]string{netip.MustParseAddr("172.16.0.21"): "bob"}, users.FixedAddrs())
+
+	// the lookups reload the file too
+	write(`[{"name": "erin", "secret": "e", "enabled": true}]`, now.Add(2*time.Second))
+	_, err = users.Lookup("bob")
+	assert.Equal(t, ErrUnknownUser, err)
+	assert.Equal(t, []string{"bob", "carol"}, revoked)
+}
+
+func TestUsers_ReloadSubnets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	write := func(data string, at time.Time) {
+		assert.Nil(t, os.WriteFile(path, []byte(data), 0600))
+		assert.Nil(t, os.Chtimes(path, at, at))
+	}
+	now := time.Now()
+	write(`[{"name": "alice", "secret": "a", "enabled": true, "subnets": ["192.168.1.0/24", "192.168.2.0/24"]},
+		{"name": "bob", "secret": "b", "enabled": true, "subnets": ["192.168.3.0/24"]}]`, now)
+	users, err := LoadUsers(path)
+	assert.Nil(t, err)
+	var revoked []string
+	users.OnReload(func(names []string) { revoked = names })
+
+	// a subnet of alice is removed, so her session stops routing it, bob is only allowed another subnet
+	write(`[{"name": "alice", "secret": "a", "enabled": true, "subnets": ["192.168.1.0/24"]},
+		{"name": "bob", "secret": "b", "enabled": true, "subnets": ["192.168.3.0/24", "192.168.4.0/24"]}]`, now.Add(time.Second))
+	users.Reload()
+	assert.Equal(t, []string{"alice"}, revoked)
+}
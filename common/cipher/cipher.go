@@ -1,11 +1,18 @@
 package cipher
 
+import "github.com/net-byte/vtun/common/x/xcrypto"
+
 // The default key
-var _key = []byte("vtun@2022")
+var _key = obfsKey("vtun@2022")
 
-// SetKey sets the key
+// SetKey sets the key, the frames are obfuscated with a key derived from it
+// so the obfuscation of known bytes does not reveal the key
 func SetKey(key string) {
-	_key = []byte(key)
+	_key = obfsKey(key)
+}
+
+func obfsKey(key string) []byte {
+	return xcrypto.DeriveKey(key, xcrypto.LabelObfs, 32)
 }
 
 // XOR encrypts the data
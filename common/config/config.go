@@ -3,6 +3,8 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
+	"runtime"
 )
 
 // Config The config struct
@@ -33,6 +35,30 @@ type Config struct {
 	Verbose                   bool   `json:"verbose"`
 	PSKMode                   bool   `json:"psk_mode"`
 	Host                      string `json:"host"`
+	User                      string `json:"user"`
+	Secret                    string `json:"secret"`
+	UsersFile                 string `json:"users_file"`
+	IPv6Mode                  string `json:"ipv6_mode"`
+	LeaseFile                 string `json:"lease_file"`
+	Subnets                   string `json:"subnets"`
+	SubnetRoutes              bool   `json:"subnet_routes"`
+	IncludeRoutes             string `json:"include_routes"`
+	ExcludeRoutes             string `json:"exclude_routes"`
+	StateFile                 string `json:"state_file"`
+	FwMark                    int    `json:"fwmark"`
+	NAT                       bool   `json:"nat"`
+	DNS                       string `json:"dns"`
+	DNSSearch                 string `json:"dns_search"`
+	DNSUpstreams              string `json:"dns_upstreams"`
+	DNSDomain                 string `json:"dns_domain"`
+	KillSwitch                bool   `json:"kill_switch"`
+	PushRoutes                string `json:"push_routes"`
+	Cipher                    string `json:"cipher"`
+	KeepAlive                 int    `json:"keepalive"`
+	DeadTimeout               int    `json:"dead_timeout"`
+	Batch                     int    `json:"batch"`
+	BatchDelay                int    `json:"batch_delay"`
+	AdminKey                  string `json:"admin_key"`
 }
 
 type nativeConfig Config
@@ -61,6 +87,38 @@ var DefaultConfig = nativeConfig{
 	Verbose:                   false,
 	PSKMode:                   false,
 	Host:                      "",
+	User:                      "",
+	Secret:                    "",
+	UsersFile:                 "",
+	IPv6Mode:                  "ipv4",
+	LeaseFile:                 "",
+	Subnets:                   "",
+	SubnetRoutes:              false,
+	IncludeRoutes:             "",
+	ExcludeRoutes:             "",
+	StateFile:                 defaultStateFile(),
+	FwMark:                    0,
+	NAT:                       false,
+	DNS:                       "",
+	DNSSearch:                 "",
+	DNSUpstreams:              "",
+	DNSDomain:                 "vpn",
+	KillSwitch:                false,
+	PushRoutes:                "",
+	Cipher:                    "",
+	KeepAlive:                 10,
+	DeadTimeout:               40,
+	Batch:                     0,
+	BatchDelay:                1000,
+	AdminKey:                  "",
+}
+
+// defaultStateFile returns the state file in a directory which is cleared on boot, as the routes are
+func defaultStateFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.TempDir(), "vtun.state.json")
+	}
+	return "/var/run/vtun.state.json"
 }
 
 func (c *Config) UnmarshalJSON(data []byte) error {
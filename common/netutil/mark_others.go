@@ -0,0 +1,12 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"syscall"
+)
+
+// markControl returns nil, the sockets are only marked on linux
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os/exec"
 	"strings"
@@ -20,8 +21,8 @@ import (
 	"github.com/net-byte/vtun/common/counter"
 )
 
-// ConnectServer connects to the server with the given address.
-func ConnectServer(config config.Config) net.Conn {
+// ConnectServer connects to the server with the given address, the dial is aborted when the context is done.
+func ConnectServer(ctx context.Context, config config.Config) net.Conn {
 	scheme := "ws"
 	host := config.ServerAddr
 	if config.Host != "" {
@@ -36,9 +37,6 @@ func ConnectServer(config config.Config) net.Conn {
 	u := url.URL{Scheme: scheme, Host: host, Path: config.Path}
 	header := make(http.Header)
 	header.Set("user-agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/88.0.4324.182 Safari/537.36")
-	if config.Key != "" {
-		header.Set("key", config.Key)
-	}
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 	}
@@ -50,10 +48,10 @@ func ConnectServer(config config.Config) net.Conn {
 		Timeout:   time.Duration(config.Timeout) * time.Second,
 		TLSConfig: tlsConfig,
 		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return net.Dial(network, config.ServerAddr)
+			return Dialer(config).DialContext(ctx, network, config.ServerAddr)
 		},
 	}
-	c, _, _, err := dialer.Dial(context.Background(), u.String())
+	c, _, _, err := dialer.Dial(ctx, u.String())
 	if err != nil {
 		log.Printf("[client] failed to dial websocket %s %v", u.String(), err)
 		return nil
@@ -61,6 +59,32 @@ func ConnectServer(config config.Config) net.Conn {
 	return c
 }
 
+// Dialer returns the dialer of the connections to the server,
+// their sockets are marked with the fwmark to bypass the tunnel in the policy routing global mode
+func Dialer(config config.Config) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout: time.Duration(config.Timeout) * time.Second,
+		Control: markControl(config.FwMark),
+	}
+	if config.FwMark != 0 {
+		dialer.Resolver = Resolver(config)
+	}
+	return dialer
+}
+
+// Resolver returns a resolver whose queries are sent with the sockets marked as the connections of Dialer,
+// so the server address is resolved while the kill switch is set
+func Resolver(config config.Config) *net.Resolver {
+	dialer := &net.Dialer{Control: markControl(config.FwMark)}
+	return &net.Resolver{PreferGo: true, Dial: dialer.DialContext}
+}
+
+// ListenPacket returns an udp socket to send packets to the server, marked as the connections of Dialer
+func ListenPacket(ctx context.Context, config config.Config) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: markControl(config.FwMark)}
+	return lc.ListenPacket(ctx, "udp", "")
+}
+
 // GetInterface returns the name of interface
 func GetInterface() (name string) {
 	ifaces := getAllInterfaces()
@@ -151,32 +175,30 @@ func GetIPv6Dst(packet []byte) net.IP {
 	return net.IP(packet[24:40])
 }
 
-// GetSrcKey returns the source key of the packet
-func GetSrcKey(packet []byte) string {
+// GetSrcAddr returns the source address of the packet, it is invalid if the packet is not an ip packet
+func GetSrcAddr(packet []byte) netip.Addr {
 	if len(packet) == 0 {
-		return ""
+		return netip.Addr{}
 	}
-	key := ""
 	if IsIPv4(packet) && len(packet) >= 20 {
-		key = GetIPv4Src(packet).To4().String()
+		return netip.AddrFrom4([4]byte(packet[12:16]))
 	} else if IsIPv6(packet) && len(packet) >= 40 {
-		key = GetIPv6Src(packet).To16().String()
+		return netip.AddrFrom16([16]byte(packet[8:24]))
 	}
-	return key
+	return netip.Addr{}
 }
 
-// GetDstKey returns the destination key of the packets
-func GetDstKey(packet []byte) string {
+// GetDstAddr returns the destination address of the packet, it is invalid if the packet is not an ip packet
+func GetDstAddr(packet []byte) netip.Addr {
 	if len(packet) == 0 {
-		return ""
+		return netip.Addr{}
 	}
-	key := ""
 	if IsIPv4(packet) && len(packet) >= 20 {
-		key = GetIPv4Dst(packet).To4().String()
+		return netip.AddrFrom4([4]byte(packet[16:20]))
 	} else if IsIPv6(packet) && len(packet) >= 40 {
-		key = GetIPv6Dst(packet).To16().String()
+		return netip.AddrFrom16([16]byte(packet[24:40]))
 	}
-	return key
+	return netip.Addr{}
 }
 
 type ExecCmdRecorder struct {
@@ -190,6 +212,11 @@ func (ec *ExecCmdRecorder) ExecCmd(c string, args ...string) string {
 	return ExecCmd(c, args...)
 }
 
+// Record records an operation which is not a command, such as a netlink request
+func (ec *ExecCmdRecorder) Record(op string) {
+	ec.cmds = append(ec.cmds, op)
+}
+
 func (ec *ExecCmdRecorder) String() string {
 	return strings.Join(ec.cmds, "\n")
 }
@@ -270,15 +297,21 @@ func PrintErrF(enableVerbose bool, formatString string, args ...any) {
 	log.Printf("error: "+formatString, args...)
 }
 
-// PrintStats returns the stats info
-func PrintStats(enableVerbose bool, serverMode bool) {
+// PrintStats prints the stats info every 30 seconds until the context is done
+func PrintStats(_ctx context.Context, enableVerbose bool, serverMode bool) {
 	if !enableVerbose {
 		return
 	}
 	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
 		for {
-			time.Sleep(30 * time.Second)
-			log.Printf("stats:%v", counter.PrintBytes(serverMode))
+			select {
+			case <-_ctx.Done():
+				return
+			case <-ticker.C:
+				log.Printf("stats:%v", counter.PrintBytes(serverMode))
+			}
 		}
 	}()
 }
@@ -1,8 +1,12 @@
 package netutil
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/net-byte/vtun/common/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,3 +39,25 @@ func TestExecCmdRecoder(t *testing.T) {
 	// echo
 	// echo
 }
+
+func TestConnectServer_Cancel(t *testing.T) {
+	// the server accepts the connection but never answers the upgrade
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	conn := ConnectServer(ctx, config.Config{ServerAddr: ln.Addr().String(), Protocol: "ws", Path: "/freedom"})
+	assert.Nil(t, conn)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
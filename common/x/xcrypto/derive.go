@@ -0,0 +1,24 @@
+package xcrypto
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The labels of the keys derived from the shared key, every use of the shared key outside the handshake
+// has its own, so none of them reveals the pre-shared key of the handshake
+const (
+	LabelObfs = "vtun obfs"
+	LabelDTLS = "vtun dtls psk"
+)
+
+// DeriveKey returns a key of n bytes derived from the secret for the use of the label
+func DeriveKey(secret, label string, n int) []byte {
+	key := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(label)), key); err != nil {
+		panic(err)
+	}
+	return key
+}
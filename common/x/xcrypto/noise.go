@@ -0,0 +1,97 @@
+package xcrypto
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"github.com/flynn/noise"
+)
+
+// The handshake is Noise NNpsk0: both sides contribute an ephemeral X25519 key,
+// the shared key is mixed in as the pre-shared key, so only peers knowing it complete the handshake
+// and the session keys can not be recovered from the shared key later.
+var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+
+var ErrHandshakeIncomplete = errors.New("xcrypto: handshake is not complete")
+
+// Handshake runs the Noise handshake of a connection
+type Handshake struct {
+	state     *noise.HandshakeState
+	initiator bool
+	send      *noise.CipherState
+	recv      *noise.CipherState
+}
+
+// NewHandshake returns the handshake of the client if initiator is true, or of the server otherwise.
+// The prologue is authenticated by the handshake, it must be the same on both sides.
+func NewHandshake(key string, prologue []byte, initiator bool) (*Handshake, error) {
+	psk := sha256.Sum256([]byte(key))
+	state, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:           cipherSuite,
+		Pattern:               noise.HandshakeNN,
+		Initiator:             initiator,
+		Prologue:              prologue,
+		PresharedKey:          psk[:],
+		PresharedKeyPlacement: 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Handshake{state: state, initiator: initiator}, nil
+}
+
+// WriteMessage returns the next handshake message carrying payload
+func (h *Handshake) WriteMessage(payload []byte) ([]byte, error) {
+	msg, cs1, cs2, err := h.state.WriteMessage(nil, payload)
+	if err != nil {
+		return nil, err
+	}
+	h.split(cs1, cs2)
+	return msg, nil
+}
+
+// ReadMessage processes the next handshake message of the peer and returns its payload
+func (h *Handshake) ReadMessage(msg []byte) ([]byte, error) {
+	payload, cs1, cs2, err := h.state.ReadMessage(nil, msg)
+	if err != nil {
+		return nil, err
+	}
+	h.split(cs1, cs2)
+	return payload, nil
+}
+
+func (h *Handshake) split(cs1, cs2 *noise.CipherState) {
+	if cs1 == nil || cs2 == nil {
+		return
+	}
+	// the first cipher state encrypts the messages of the initiator
+	if h.initiator {
+		h.send, h.recv = cs1, cs2
+	} else {
+		h.send, h.recv = cs2, cs1
+	}
+}
+
+// Complete reports whether the session keys are established
+func (h *Handshake) Complete() bool {
+	return h.send != nil
+}
+
+// XCrypto returns the AES-GCM frame cipher keyed with the session keys of the handshake
+func (h *Handshake) XCrypto() (*XCrypto, error) {
+	return h.XCryptoWith(NewAESGCM)
+}
+
+// XCryptoWith returns the frame cipher of the AEAD of newAEAD keyed with the session keys of the handshake
+func (h *Handshake) XCryptoWith(newAEAD AEADFunc) (*XCrypto, error) {
+	if !h.Complete() {
+		return nil, ErrHandshakeIncomplete
+	}
+	send := h.send.UnsafeKey()
+	recv := h.recv.UnsafeKey()
+	x := &XCrypto{}
+	if err := x.InitKeysWith(newAEAD, send[:], recv[:]); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
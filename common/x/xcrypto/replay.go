@@ -0,0 +1,45 @@
+package xcrypto
+
+import "sync"
+
+const (
+	replayBlockBits  = 64
+	replayRingBlocks = 32
+	// ReplayWindowSize is the number of counters behind the newest one which are still accepted
+	ReplayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+)
+
+// ReplayFilter is a sliding window of the received packet counters (RFC 6479),
+// it accepts every counter once as long as it is not too far behind the newest one.
+type ReplayFilter struct {
+	mu   sync.Mutex
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+// Accept records the counter and reports whether it was seen for the first time
+func (f *ReplayFilter) Accept(counter uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	index := counter / replayBlockBits
+	if counter > f.last {
+		current := f.last / replayBlockBits
+		diff := index - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			f.ring[(current+i)%replayRingBlocks] = 0
+		}
+		f.last = counter
+	} else if f.last-counter > ReplayWindowSize {
+		return false
+	}
+	bit := uint64(1) << (counter % replayBlockBits)
+	block := &f.ring[index%replayRingBlocks]
+	if *block&bit != 0 {
+		return false
+	}
+	*block |= bit
+	return true
+}
@@ -3,73 +3,101 @@ package xcrypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha1"
-	"crypto/sha256"
-	"hash/fnv"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-type XCrypto struct {
-	Key    []byte
-	Nonce  []byte
-	aesGcm cipher.AEAD
-}
+// CounterLength is the length of the packet counter which prefixes every sealed frame
+const CounterLength = 8
+
+var (
+	ErrShortFrame = errors.New("xcrypto: frame too short")
+	ErrReplay     = errors.New("xcrypto: replayed or too old frame")
+	ErrExhausted  = errors.New("xcrypto: packet counter exhausted")
+)
+
+// AEADFunc returns the AEAD of a 32 byte session key
+type AEADFunc func(key []byte) (cipher.AEAD, error)
 
-func (x *XCrypto) Load(key string) {
-	x.LoadKey(key)
-	x.LoadNonce(key)
+// XCrypto seals the frames of a connection with an AEAD, AES-GCM by default.
+// Every direction has its own session key established by the handshake,
+// the nonce of each frame is its packet counter, which the receiver checks against a replay window.
+type XCrypto struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter atomic.Uint64
+	replay  ReplayFilter
 }
 
-func (x *XCrypto) LoadKey(key string) {
-	h := sha256.New()
-	h.Write([]byte(key))
-	x.Key = h.Sum(nil)
+// InitKeys sets the AES-GCM session keys of the two directions
+func (x *XCrypto) InitKeys(send, recv []byte) error {
+	return x.InitKeysWith(NewAESGCM, send, recv)
 }
 
-func (x *XCrypto) LoadNonce(key string) {
-	n := 2 * 2 * 3
-	h := sha1.New()
-	h.Write([]byte(key))
-	b := h.Sum(nil)
-	ia := int(String2Int64(key) % int64(len(b)-n))
-	x.Nonce = b[ia : ia+n]
+// InitKeysWith sets the session keys of the two directions for the AEAD of newAEAD
+func (x *XCrypto) InitKeysWith(newAEAD AEADFunc, send, recv []byte) error {
+	var err error
+	if x.send, err = newAEAD(send); err != nil {
+		return err
+	}
+	if x.recv, err = newAEAD(recv); err != nil {
+		return err
+	}
+	// the nonce is the packet counter in 12 bytes
+	if x.send.NonceSize() != 12 || x.recv.NonceSize() != 12 {
+		return errors.New("xcrypto: unsupported nonce size")
+	}
+	return nil
 }
 
-func String2Int64(s string) int64 {
-	h := fnv.New32a()
-	_, err := h.Write([]byte(s))
+// NewAESGCM returns the AES-GCM AEAD of the key
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return 0
+		return nil, err
 	}
-	return int64(h.Sum32())
+	return cipher.NewGCM(block)
 }
 
-func (x *XCrypto) Init(key string) error {
-	x.Load(key)
-	return x.init()
+// NewChaCha20Poly1305 returns the ChaCha20-Poly1305 AEAD of the key, it is faster than AES-GCM without AES instructions
+func NewChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
 }
 
-func (x *XCrypto) init() error {
-	block, err := aes.NewCipher(x.Key)
-	if err != nil {
-		return err
-	}
-	aesGcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return err
-	}
-	x.aesGcm = aesGcm
-	return nil
+// nonce returns the gcm nonce of the packet counter
+func nonce(counter uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
 }
 
+// Encode seals pl into a frame of the packet counter followed by the ciphertext
 func (x *XCrypto) Encode(pl []byte) ([]byte, error) {
-	ci := x.aesGcm.Seal(nil, x.Nonce, pl, nil)
-	return ci, nil
+	counter := x.counter.Add(1) - 1
+	if counter == math.MaxUint64 {
+		return nil, ErrExhausted
+	}
+	ci := make([]byte, CounterLength, CounterLength+len(pl)+x.send.Overhead())
+	binary.BigEndian.PutUint64(ci, counter)
+	return x.send.Seal(ci, nonce(counter), pl, nil), nil
 }
 
+// Decode opens a frame sealed by the peer, frames which were already received are rejected
 func (x *XCrypto) Decode(ci []byte) ([]byte, error) {
-	pl, err := x.aesGcm.Open(nil, x.Nonce, ci, nil)
+	if len(ci) < CounterLength+x.recv.Overhead() {
+		return nil, ErrShortFrame
+	}
+	counter := binary.BigEndian.Uint64(ci)
+	pl, err := x.recv.Open(nil, nonce(counter), ci[CounterLength:], nil)
 	if err != nil {
 		return nil, err
 	}
+	if !x.replay.Accept(counter) {
+		return nil, ErrReplay
+	}
 	return pl, nil
 }
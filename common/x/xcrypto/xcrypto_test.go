@@ -6,50 +6,155 @@ import (
 	"testing"
 )
 
-func TestXCrypto_Load(t *testing.T) {
-	testKey := "aaa"
-	x := &XCrypto{}
-	err := x.Init(testKey)
+func newPair(t *testing.T) (*XCrypto, *XCrypto) {
+	initiator, err := NewHandshake("aaa", []byte("test"), true)
 	if err != nil {
-		t.Error("err: ", err)
-		return
+		t.Fatal("err: ", err)
+	}
+	responder, err := NewHandshake("aaa", []byte("test"), false)
+	if err != nil {
+		t.Fatal("err: ", err)
+	}
+	msg, err := initiator.WriteMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal("err: ", err)
+	}
+	payload, err := responder.ReadMessage(msg)
+	if err != nil {
+		t.Fatal("err: ", err)
+	}
+	assert.Equal(t, []byte("hello"), payload)
+	msg, err = responder.WriteMessage(nil)
+	if err != nil {
+		t.Fatal("err: ", err)
+	}
+	if _, err = initiator.ReadMessage(msg); err != nil {
+		t.Fatal("err: ", err)
+	}
+	client, err := initiator.XCrypto()
+	if err != nil {
+		t.Fatal("err: ", err)
+	}
+	server, err := responder.XCrypto()
+	if err != nil {
+		t.Fatal("err: ", err)
+	}
+	return client, server
+}
+
+func TestHandshake_WrongKey(t *testing.T) {
+	initiator, _ := NewHandshake("aaa", []byte("test"), true)
+	responder, _ := NewHandshake("bbb", []byte("test"), false)
+	msg, err := initiator.WriteMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal("err: ", err)
 	}
-	log.Printf("key: %v\n", x.Key)
-	assert.Equal(t, x.Key, []byte{152, 52, 135, 109, 207, 176, 92, 177, 103, 165, 194, 73, 83, 235, 165, 140, 74, 200, 155, 26, 223, 87, 242, 143, 47, 157, 9, 175, 16, 126, 232, 240})
-	log.Printf("nonce: %v\n", x.Nonce)
-	assert.Equal(t, x.Nonce, []byte{13, 231, 79, 177, 237, 8, 250, 8, 211, 128, 99, 246})
+	_, err = responder.ReadMessage(msg)
+	assert.NotNil(t, err)
+	assert.False(t, responder.Complete())
+	_, err = responder.XCrypto()
+	assert.Equal(t, ErrHandshakeIncomplete, err)
+}
+
+func TestHandshake_FreshKeys(t *testing.T) {
+	a, _ := newPair(t)
+	b, _ := newPair(t)
+	fa, _ := a.Encode([]byte{97, 97, 97})
+	fb, _ := b.Encode([]byte{97, 97, 97})
+	// the same packet of two sessions is sealed with different keys
+	assert.NotEqual(t, fa, fb)
 }
 
 func TestXCrypto_Encode(t *testing.T) {
-	testKey := "aaa"
-	x := &XCrypto{}
-	err := x.Init(testKey)
+	client, _ := newPair(t)
+	a, err := client.Encode([]byte{97, 97, 97})
 	if err != nil {
 		t.Error("err: ", err)
 		return
 	}
-	encode, err := x.Encode([]byte{97, 97, 97})
+	b, err := client.Encode([]byte{97, 97, 97})
 	if err != nil {
 		t.Error("err: ", err)
 		return
 	}
-	log.Printf("encode: %v\n", encode)
-	assert.Equal(t, encode, []byte{18, 6, 238, 145, 241, 153, 166, 123, 28, 246, 132, 118, 19, 1, 18, 100, 122, 172, 103})
+	log.Printf("encode: %v %v\n", a, b)
+	assert.Equal(t, CounterLength+3+16, len(a))
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0}, a[:CounterLength])
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1}, b[:CounterLength])
+	// every frame uses a fresh nonce
+	assert.NotEqual(t, a[CounterLength:], b[CounterLength:])
 }
 
 func TestXCrypto_Decode(t *testing.T) {
-	testKey := "aaa"
-	x := &XCrypto{}
-	err := x.Init(testKey)
-	if err != nil {
-		t.Error("err: ", err)
-		return
-	}
-	decode, err := x.Decode([]byte{18, 6, 238, 145, 241, 153, 166, 123, 28, 246, 132, 118, 19, 1, 18, 100, 122, 172, 103})
+	client, server := newPair(t)
+	frame, _ := client.Encode([]byte{97, 97, 97})
+	decode, err := server.Decode(frame)
 	if err != nil {
 		t.Error("err: ", err)
 		return
 	}
 	log.Printf("decode: %v\n", decode)
 	assert.Equal(t, decode, []byte{97, 97, 97})
+
+	// replayed frame
+	_, err = server.Decode(frame)
+	assert.Equal(t, ErrReplay, err)
+
+	// the keys of both directions differ
+	_, err = client.Decode(frame)
+	assert.NotNil(t, err)
+
+	// tampered frame
+	frame, _ = client.Encode([]byte{97, 97, 97})
+	frame[len(frame)-1] ^= 1
+	_, err = server.Decode(frame)
+	assert.NotNil(t, err)
+
+	_, err = server.Decode(frame[:CounterLength])
+	assert.Equal(t, ErrShortFrame, err)
+}
+
+func TestXCrypto_ChaCha20Poly1305(t *testing.T) {
+	key := make([]byte, 32)
+	client, server := &XCrypto{}, &XCrypto{}
+	assert.Nil(t, client.InitKeysWith(NewChaCha20Poly1305, key, key))
+	assert.Nil(t, server.InitKeysWith(NewChaCha20Poly1305, key, key))
+	frame, err := client.Encode([]byte{97, 97, 97})
+	assert.Nil(t, err)
+	decode, err := server.Decode(frame)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{97, 97, 97}, decode)
+
+	// the frames of another cipher do not open
+	aes := &XCrypto{}
+	assert.Nil(t, aes.InitKeys(key, key))
+	_, err = aes.Decode(frame)
+	assert.NotNil(t, err)
+}
+
+func TestReplayFilter(t *testing.T) {
+	f := &ReplayFilter{}
+	assert.True(t, f.Accept(0))
+	assert.False(t, f.Accept(0))
+	assert.True(t, f.Accept(2))
+	assert.True(t, f.Accept(1))
+	assert.False(t, f.Accept(1))
+	assert.True(t, f.Accept(5000))
+	// too old
+	assert.False(t, f.Accept(5000-ReplayWindowSize-1))
+	// reordered inside the window
+	assert.True(t, f.Accept(5000-ReplayWindowSize))
+	assert.True(t, f.Accept(4999))
+	assert.False(t, f.Accept(4999))
+	// a jump larger than the window clears it
+	assert.True(t, f.Accept(100000))
+	assert.True(t, f.Accept(100000-1))
+}
+
+func TestDeriveKey(t *testing.T) {
+	obfs := DeriveKey("freedom", LabelObfs, 32)
+	assert.Len(t, obfs, 32)
+	assert.Equal(t, obfs, DeriveKey("freedom", LabelObfs, 32))
+	assert.NotEqual(t, obfs, DeriveKey("freedom", LabelDTLS, 32))
+	assert.NotEqual(t, obfs, DeriveKey("freedom2", LabelObfs, 32))
 }
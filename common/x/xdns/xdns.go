@@ -0,0 +1,461 @@
+package xdns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// localTTL is the ttl of the answers of the client names, they change when the clients reconnect
+	localTTL = 30
+	// maxTTL bounds the time the answers of the upstreams are cached
+	maxTTL = 3600
+	// maxCacheEntries bounds the memory of the cache, the answers are not cached when it is full
+	maxCacheEntries = 10000
+	// upstreamTimeout is the timeout of an exchange with an upstream
+	upstreamTimeout = 2 * time.Second
+	// tcpIdleTimeout closes the idle tcp connections of the clients
+	tcpIdleTimeout = 10 * time.Second
+)
+
+// Server is a dns server for the clients of the tunnel. The names of the domain are answered with the addresses
+// returned by lookup, the other queries are forwarded to the upstreams and their answers are cached.
+type Server struct {
+	domain    string
+	upstreams []string
+	lookup    func(name string) []netip.Addr
+	// allowed are the networks of the clients, the queries of the other sources are refused
+	allowed []netip.Prefix
+	cache   *cache.Cache
+
+	mu        sync.Mutex
+	listeners []io.Closer
+}
+
+// cached is an answer of the upstreams with the time it was stored
+type cached struct {
+	msg    dnsmessage.Message
+	stored time.Time
+}
+
+// NewServer returns a server answering the names of domain with lookup and forwarding the other queries to the
+// upstreams, the queries of the sources out of the allowed prefixes are refused
+func NewServer(domain string, upstreams []string, lookup func(name string) []netip.Addr, allowed []netip.Prefix) *Server {
+	return &Server{
+		domain:    strings.ToLower(strings.Trim(domain, ".")),
+		upstreams: upstreams,
+		lookup:    lookup,
+		allowed:   allowed,
+		cache:     cache.New(cache.NoExpiration, 5*time.Minute),
+	}
+}
+
+// ParseUpstreams parses a comma separated list of upstream servers, the port is 53 if it is not set
+func ParseUpstreams(s string) ([]string, error) {
+	var upstreams []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(f); err == nil {
+			upstreams = append(upstreams, netip.AddrPortFrom(addr, 53).String())
+			continue
+		}
+		if _, err := netip.ParseAddrPort(f); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q", f)
+		}
+		upstreams = append(upstreams, f)
+	}
+	return upstreams, nil
+}
+
+// Start serves the queries over udp and tcp on port 53 of the addresses until Close
+func (s *Server) Start(addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		addrPort := netip.AddrPortFrom(addr, 53).String()
+		pc, err := net.ListenPacket("udp", addrPort)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.track(pc)
+		go s.serveUDP(pc)
+		ln, err := net.Listen("tcp", addrPort)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.track(ln)
+		go s.serveTCP(ln)
+		log.Printf("dns server started on %s", addrPort)
+	}
+	return nil
+}
+
+func (s *Server) track(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, c)
+}
+
+// Close stops serving the queries
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, c := range s.listeners {
+		errs = append(errs, c.Close())
+	}
+	s.listeners = nil
+	return errors.Join(errs...)
+}
+
+func (s *Server) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("dns server: %v", err)
+			}
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			if resp := s.Handle(query, sourceAddr(addr), true); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("dns server: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			src := sourceAddr(conn.RemoteAddr())
+			for {
+				conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+				query, err := readTCP(conn)
+				if err != nil {
+					return
+				}
+				resp := s.Handle(query, src, false)
+				if resp == nil || writeTCP(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func sourceAddr(addr net.Addr) netip.Addr {
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// readTCP reads a message prefixed by its 2 byte length
+func readTCP(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCP writes the message prefixed by its 2 byte length
+func writeTCP(w io.Writer, msg []byte) error {
+	_, err := w.Write(binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg))))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// Handle returns the response to the query of src, the responses over udp are truncated to the size the client
+// accepts. It returns nil if the query is not a dns message.
+func (s *Server) Handle(query []byte, src netip.Addr, udp bool) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		return nil
+	}
+	if q.Header.Response {
+		return nil
+	}
+	var resp dnsmessage.Message
+	switch {
+	case !s.isAllowed(src):
+		resp = reply(q, dnsmessage.RCodeRefused)
+	case q.Header.OpCode != 0 || len(q.Questions) != 1:
+		resp = reply(q, dnsmessage.RCodeNotImplemented)
+	case s.isLocal(q.Questions[0].Name):
+		resp = s.answerLocal(q)
+	default:
+		var err error
+		if resp, err = s.forward(q, query); err != nil {
+			log.Printf("dns forward %s: %v", q.Questions[0].Name, err)
+			resp = reply(q, dnsmessage.RCodeServerFailure)
+		}
+	}
+	data, err := resp.Pack()
+	if err != nil {
+		resp = reply(q, dnsmessage.RCodeServerFailure)
+		data, _ = resp.Pack()
+	}
+	if udp && len(data) > udpSize(q) {
+		// the client retries over tcp
+		resp = reply(q, resp.Header.RCode)
+		resp.Header.Truncated = true
+		data, _ = resp.Pack()
+	}
+	return data
+}
+
+func (s *Server) isAllowed(src netip.Addr) bool {
+	for _, p := range s.allowed {
+		if p.Contains(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// reply returns the response to q without records
+func reply(q dnsmessage.Message, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 q.Header.ID,
+			Response:           true,
+			OpCode:             q.Header.OpCode,
+			RecursionDesired:   q.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: q.Questions,
+	}
+}
+
+// udpSize returns the largest response the client accepts over udp
+func udpSize(q dnsmessage.Message) int {
+	for _, rr := range q.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT && rr.Header.Class > 512 {
+			return int(rr.Header.Class)
+		}
+	}
+	return 512
+}
+
+// isLocal reports whether the name is in the domain of the clients
+func (s *Server) isLocal(name dnsmessage.Name) bool {
+	if s.domain == "" {
+		return false
+	}
+	n := strings.ToLower(strings.TrimSuffix(name.String(), "."))
+	return n == s.domain || strings.HasSuffix(n, "."+s.domain)
+}
+
+// answerLocal answers the addresses of a client name, the name is missing without any address
+func (s *Server) answerLocal(q dnsmessage.Message) dnsmessage.Message {
+	question := q.Questions[0]
+	resp := reply(q, dnsmessage.RCodeSuccess)
+	resp.Header.Authoritative = true
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	if name == s.domain {
+		return resp
+	}
+	label := strings.TrimSuffix(name, "."+s.domain)
+	var addrs []netip.Addr
+	if !strings.Contains(label, ".") {
+		addrs = s.lookup(label)
+	}
+	if len(addrs) == 0 {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+		return resp
+	}
+	for _, addr := range addrs {
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: localTTL}
+		switch {
+		case addr.Is4() && question.Type == dnsmessage.TypeA:
+			rh.Type = dnsmessage.TypeA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case addr.Is6() && question.Type == dnsmessage.TypeAAAA:
+			rh.Type = dnsmessage.TypeAAAA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return resp
+}
+
+// forward returns the cached answer of the question or the one of the upstreams
+func (s *Server) forward(q dnsmessage.Message, query []byte) (dnsmessage.Message, error) {
+	question := q.Questions[0]
+	key := fmt.Sprintf("%s/%d/%d", strings.ToLower(question.Name.String()), question.Type, question.Class)
+	if v, ok := s.cache.Get(key); ok {
+		c := v.(cached)
+		resp := c.msg
+		resp.Header.ID = q.Header.ID
+		resp.Header.RecursionDesired = q.Header.RecursionDesired
+		elapsed := uint32(time.Since(c.stored) / time.Second)
+		resp.Answers = ageRecords(c.msg.Answers, elapsed)
+		resp.Authorities = ageRecords(c.msg.Authorities, elapsed)
+		resp.Additionals = ageRecords(c.msg.Additionals, elapsed)
+		return resp, nil
+	}
+	var errs []error
+	for _, upstream := range s.upstreams {
+		resp, err := exchange(upstream, query, question)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp.Header.ID = q.Header.ID
+		if ttl, ok := cacheTTL(resp); ok && s.cache.ItemCount() < maxCacheEntries {
+			s.cache.Set(key, cached{msg: resp, stored: time.Now()}, time.Duration(ttl)*time.Second)
+		}
+		return resp, nil
+	}
+	if len(errs) == 0 {
+		return dnsmessage.Message{}, errors.New("no upstream")
+	}
+	return dnsmessage.Message{}, errors.Join(errs...)
+}
+
+// ageRecords returns a copy of the records whose ttl are decreased by elapsed seconds
+func ageRecords(records []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(records))
+	copy(aged, records)
+	for i := range aged {
+		// the ttl of the opt record holds its flags
+		if aged[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if aged[i].Header.TTL > elapsed {
+			aged[i].Header.TTL -= elapsed
+		} else {
+			aged[i].Header.TTL = 0
+		}
+	}
+	return aged
+}
+
+// cacheTTL returns the time the answer is cached, the lowest ttl of its records.
+// The names which do not exist are cached by the minimum ttl of the soa record.
+func cacheTTL(resp dnsmessage.Message) (uint32, bool) {
+	if resp.Header.Truncated || resp.Header.RCode != dnsmessage.RCodeSuccess && resp.Header.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	ttl := uint32(maxTTL)
+	found := false
+	for _, rr := range resp.Answers {
+		ttl = min(ttl, rr.Header.TTL)
+		found = true
+	}
+	for _, rr := range resp.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			ttl = min(ttl, rr.Header.TTL, soa.MinTTL)
+			found = true
+		}
+	}
+	return ttl, found && ttl > 0
+}
+
+// exchange sends the query to the upstream over udp, then over tcp if the response is truncated.
+// The query has a random id, the response is only accepted with this id and the question of the query.
+func exchange(upstream string, query []byte, question dnsmessage.Question) (dnsmessage.Message, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	query = append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(query, id)
+	resp, err := exchangeUDP(upstream, query, id, question)
+	if err == nil && resp.Header.Truncated {
+		resp, err = exchangeTCP(upstream, query, id, question)
+	}
+	return resp, err
+}
+
+func exchangeUDP(upstream string, query []byte, id uint16, question dnsmessage.Question) (dnsmessage.Message, error) {
+	conn, err := net.DialTimeout("udp", upstream, upstreamTimeout)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if _, err = conn.Write(query); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return dnsmessage.Message{}, err
+		}
+		var resp dnsmessage.Message
+		// the responses of other queries are ignored
+		if resp.Unpack(buf[:n]) == nil && resp.Header.Response && resp.Header.ID == id && isAnswer(resp, question) {
+			return resp, nil
+		}
+	}
+}
+
+func exchangeTCP(upstream string, query []byte, id uint16, question dnsmessage.Question) (dnsmessage.Message, error) {
+	conn, err := net.DialTimeout("tcp", upstream, upstreamTimeout)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if err = writeTCP(conn, query); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	data, err := readTCP(conn)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var resp dnsmessage.Message
+	if err = resp.Unpack(data); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	if !resp.Header.Response || resp.Header.ID != id || !isAnswer(resp, question) {
+		return dnsmessage.Message{}, fmt.Errorf("unexpected response %d from %s", resp.Header.ID, upstream)
+	}
+	return resp, nil
+}
+
+// isAnswer reports whether the response is for the question, the names are compared case insensitively
+func isAnswer(resp dnsmessage.Message, question dnsmessage.Question) bool {
+	if len(resp.Questions) != 1 {
+		return false
+	}
+	q := resp.Questions[0]
+	return q.Type == question.Type && q.Class == question.Class && strings.EqualFold(q.Name.String(), question.Name.String())
+}
@@ -0,0 +1,201 @@
+package xdns
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var client = netip.MustParseAddr("172.16.0.2")
+
+func newQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	data, err := q.Pack()
+	assert.Nil(t, err)
+	return data
+}
+
+func parse(t *testing.T, data []byte) dnsmessage.Message {
+	var m dnsmessage.Message
+	assert.Nil(t, m.Unpack(data))
+	return m
+}
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := ParseUpstreams("1.1.1.1, 8.8.8.8:5353,2606:4700:4700::1111,")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.1.1.1:53", "8.8.8.8:5353", "[2606:4700:4700::1111]:53"}, upstreams)
+	_, err = ParseUpstreams("dns.example.com")
+	assert.NotNil(t, err)
+}
+
+func TestServer_Local(t *testing.T) {
+	lookup := func(name string) []netip.Addr {
+		if name == "alice" {
+			return []netip.Addr{netip.MustParseAddr("172.16.0.2"), netip.MustParseAddr("fced:9999::2")}
+		}
+		return nil
+	}
+	s := NewServer("vpn.", nil, lookup, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")})
+
+	resp := parse(t, s.Handle(newQuery(t, 1, "Alice.VPN.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, uint16(1), resp.Header.ID)
+	assert.True(t, resp.Header.Authoritative)
+	assert.Len(t, resp.Answers, 1)
+	assert.Equal(t, [4]byte{172, 16, 0, 2}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+
+	resp = parse(t, s.Handle(newQuery(t, 2, "alice.vpn.", dnsmessage.TypeAAAA), client, true))
+	assert.Len(t, resp.Answers, 1)
+	assert.Equal(t, netip.MustParseAddr("fced:9999::2").As16(), resp.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA)
+
+	// the name exists without a record of the type
+	resp = parse(t, s.Handle(newQuery(t, 3, "alice.vpn.", dnsmessage.TypeMX), client, true))
+	assert.Equal(t, dnsmessage.RCodeSuccess, resp.Header.RCode)
+	assert.Empty(t, resp.Answers)
+
+	resp = parse(t, s.Handle(newQuery(t, 4, "bob.vpn.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, dnsmessage.RCodeNameError, resp.Header.RCode)
+	resp = parse(t, s.Handle(newQuery(t, 5, "www.alice.vpn.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, dnsmessage.RCodeNameError, resp.Header.RCode)
+
+	resp = parse(t, s.Handle(newQuery(t, 6, "alice.vpn.", dnsmessage.TypeA), netip.MustParseAddr("10.0.0.1"), true))
+	assert.Equal(t, dnsmessage.RCodeRefused, resp.Header.RCode)
+	assert.Nil(t, s.Handle([]byte{1, 2, 3}, client, true))
+}
+
+// startUpstream starts a dns server answering count A records of 1.2.3.4, it returns its address and query counter
+func startUpstream(t *testing.T, count int) (string, *atomic.Int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { pc.Close() })
+	queries := &atomic.Int32{}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) != nil {
+				continue
+			}
+			resp := reply(q, dnsmessage.RCodeSuccess)
+			for i := 0; i < count; i++ {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, byte(i)}},
+				})
+			}
+			data, _ := resp.Pack()
+			pc.WriteTo(data, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), queries
+}
+
+func TestServer_Forward(t *testing.T) {
+	upstream, queries := startUpstream(t, 1)
+	s := NewServer("vpn", []string{"127.0.0.1:1", upstream}, nil, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")})
+
+	resp := parse(t, s.Handle(newQuery(t, 1, "example.com.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, dnsmessage.RCodeSuccess, resp.Header.RCode)
+	assert.Len(t, resp.Answers, 1)
+	// the second query is answered by the cache
+	resp = parse(t, s.Handle(newQuery(t, 2, "EXAMPLE.com.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, uint16(2), resp.Header.ID)
+	assert.Len(t, resp.Answers, 1)
+	assert.LessOrEqual(t, resp.Answers[0].Header.TTL, uint32(60))
+	assert.Equal(t, int32(1), queries.Load())
+
+	resp = parse(t, s.Handle(newQuery(t, 3, "example.com.", dnsmessage.TypeAAAA), client, true))
+	assert.Equal(t, int32(2), queries.Load())
+
+	s = NewServer("vpn", nil, nil, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")})
+	resp = parse(t, s.Handle(newQuery(t, 4, "example.com.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, dnsmessage.RCodeServerFailure, resp.Header.RCode)
+}
+
+func TestServer_Truncate(t *testing.T) {
+	upstream, _ := startUpstream(t, 40)
+	s := NewServer("vpn", []string{upstream}, nil, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")})
+
+	// the response does not fit the 512 bytes of a udp client without edns
+	resp := parse(t, s.Handle(newQuery(t, 1, "example.com.", dnsmessage.TypeA), client, true))
+	assert.True(t, resp.Header.Truncated)
+	assert.Empty(t, resp.Answers)
+	resp = parse(t, s.Handle(newQuery(t, 2, "example.com.", dnsmessage.TypeA), client, false))
+	assert.False(t, resp.Header.Truncated)
+	assert.Len(t, resp.Answers, 40)
+}
+
+func TestServer_ForwardSpoofed(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { pc.Close() })
+	ids := make(chan uint16, 16)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) != nil {
+				continue
+			}
+			ids <- q.Header.ID
+			name := q.Questions[0].Name.String()
+			answer := func(name string, a [4]byte) {
+				resp := reply(q, dnsmessage.RCodeSuccess)
+				resp.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: resp.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: a},
+				}}
+				data, _ := resp.Pack()
+				pc.WriteTo(data, addr)
+			}
+			// a response with the id of the query but another question comes first
+			answer("evil.com.", [4]byte{6, 6, 6, 6})
+			answer(name, [4]byte{1, 2, 3, 4})
+		}
+	}()
+	s := NewServer("vpn", []string{pc.LocalAddr().String()}, nil, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/24")})
+
+	resp := parse(t, s.Handle(newQuery(t, 7, "example.com.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, uint16(7), resp.Header.ID)
+	assert.Len(t, resp.Answers, 1)
+	assert.Equal(t, [4]byte{1, 2, 3, 4}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+	// the cached answer is the one of the question
+	resp = parse(t, s.Handle(newQuery(t, 8, "example.com.", dnsmessage.TypeA), client, true))
+	assert.Equal(t, [4]byte{1, 2, 3, 4}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+
+	// the upstream queries do not reuse the ids of the client
+	upstreamIDs := []uint16{<-ids}
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		s.Handle(newQuery(t, 7, name, dnsmessage.TypeA), client, true)
+		upstreamIDs = append(upstreamIDs, <-ids)
+	}
+	assert.NotEqual(t, []uint16{7, 7, 7, 7}, upstreamIDs)
+}
+
+func TestIsAnswer(t *testing.T) {
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("Example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	resp := dnsmessage.Message{Questions: []dnsmessage.Question{question}}
+	resp.Questions[0].Name = dnsmessage.MustNewName("example.COM.")
+	assert.True(t, isAnswer(resp, question))
+	resp.Questions[0].Type = dnsmessage.TypeAAAA
+	assert.False(t, isAnswer(resp, question))
+	resp.Questions = nil
+	assert.False(t, isAnswer(resp, question))
+}
@@ -2,36 +2,88 @@ package xproto
 
 import (
 	"bytes"
-	"crypto/md5"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/net-byte/vtun/common/config"
 	"net"
+	"net/netip"
+	"strings"
+	"time"
 )
 
-const ProtocolVersion = 1
-const ClientSendPacketHeaderLength = 19
-const ServerSendPacketHeaderLength = 3
-const ClientHandshakePacketLength = 37
+// ProtocolVersion is the version of the wire protocol, the peers of another version are rejected
+const ProtocolVersion = 2
+const PacketHeaderLength = 3
+const ClientHandshakePacketLength = 36
+const ClientIDLength = 16
+const SessionIDLength = 16
 
+// The frame types of the session layer, the type is the first byte of every sealed frame.
+// A FramePing carries the send time, the peer echoes it in a FramePong to measure the round trip time.
+// A FrameBatch carries several data packets, each prefixed with its 2-byte length.
+// A FrameClose tells the peer that the session is closed on purpose, so it does not wait for the dead peer timeout.
+// Before any key is agreed, the server sends it in the clear after the protocol version in place of its handshake reply
+// to reject a client which fails the authentication.
+const (
+	FrameData  byte = 0x01
+	FramePing  byte = 0x02
+	FramePong  byte = 0x03
+	FrameBatch byte = 0x04
+	FrameClose byte = 0x05
+)
+
+// MaxBatchSize is the largest payload of a batch frame, the sealed frame must fit the 2-byte length of the stream transports
+const MaxBatchSize = 32768
+
+// TimestampLength is the length of the send time of the ping frames
+const TimestampLength = 8
+
+// The compression codecs of the data frames
+const (
+	CodecNone   byte = 0x00
+	CodecSnappy byte = 0x01
+)
+
+// The ciphers of the data frames
+const (
+	CipherAESGCM           byte = 0x01
+	CipherChaCha20Poly1305 byte = 0x02
+)
+
+var codecNames = map[byte]string{CodecNone: "none", CodecSnappy: "snappy"}
+
+var cipherNames = map[byte]string{CipherAESGCM: "aes-gcm", CipherChaCha20Poly1305: "chacha20-poly1305"}
+
+var ErrProtocolVersion = errors.New("unsupported protocol version")
+
+// ClientHandshakePacket is the payload of the first handshake message of the client,
+// the addresses are the ones the client prefers, the server may assign others.
 type ClientHandshakePacket struct {
-	ProtocolVersion uint8    //1 byte
-	Key             *AuthKey //16 byte
-	CIDRv4          net.IP   //4 byte
-	CIDRv6          net.IP   //16 byte
+	CIDRv4   net.IP //4 byte
+	CIDRv6   net.IP //16 byte
+	ClientID []byte //16 byte, identifies the client across reconnections
+	// Subnets are the subnets routed behind the client
+	Subnets []netip.Prefix
+	// Codecs and Ciphers are the ones the client supports in order of preference
+	Codecs  []byte
+	Ciphers []byte
 }
 
+// Bytes returns the fixed fields followed by the fields of the ServerHandshakePacket types
 func (p *ClientHandshakePacket) Bytes() []byte {
 	data := make([]byte, ClientHandshakePacketLength)
-	data[0] = p.ProtocolVersion
-	copy(data[1:17], p.Key[:])
-	copy(data[17:21], p.CIDRv4.To4()[:])
-	copy(data[21:37], p.CIDRv6.To16()[:])
-	return data
+	copy(data[0:4], p.CIDRv4.To4()[:])
+	copy(data[4:20], p.CIDRv6.To16()[:])
+	copy(data[20:36], p.ClientID)
+	if len(p.Subnets) > 0 {
+		data = appendField(data, FieldSubnets, appendPrefixList(nil, p.Subnets))
+	}
+	data = appendField(data, FieldCodec, p.Codecs)
+	return appendField(data, FieldCipher, p.Ciphers)
 }
 
 func GenClientHandshakePacket(config config.Config) (*ClientHandshakePacket, error) {
-	authKey := ParseAuthKeyFromString(config.Key)
 	ipv4Addr, _, err := net.ParseCIDR(config.CIDR)
 	if err != nil {
 		return nil, err
@@ -40,74 +92,439 @@ func GenClientHandshakePacket(config config.Config) (*ClientHandshakePacket, err
 	if err != nil {
 		return nil, err
 	}
+	subnets, err := ParsePrefixes(config.Subnets)
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := ParseCiphers(config.Cipher)
+	if err != nil {
+		return nil, err
+	}
 	obj := &ClientHandshakePacket{
-		ProtocolVersion: ProtocolVersion,
-		Key:             authKey,
-		CIDRv4:          ipv4Addr,
-		CIDRv6:          ipv6Addr,
+		CIDRv4:  ipv4Addr,
+		CIDRv6:  ipv6Addr,
+		Subnets: subnets,
+		Codecs:  Codecs(config.Compress),
+		Ciphers: ciphers,
 	}
 	return obj, nil
 }
 
 func ParseClientHandshakePacket(data []byte) *ClientHandshakePacket {
 	var obj = &ClientHandshakePacket{}
-	var authKey AuthKey
-	if len(data) != ClientHandshakePacketLength {
+	if len(data) < ClientHandshakePacketLength {
+		return nil
+	}
+	obj.CIDRv4 = net.IP{data[0], data[1], data[2], data[3]}
+	obj.CIDRv6 = make(net.IP, net.IPv6len)
+	copy(obj.CIDRv6, data[4:20])
+	obj.ClientID = Copy(data[20:36])
+	ok := parseFields(data[ClientHandshakePacketLength:], func(typ byte, value []byte) bool {
+		var ok = true
+		switch typ {
+		case FieldSubnets:
+			obj.Subnets, ok = parsePrefixList(value)
+		case FieldCodec:
+			obj.Codecs = Copy(value)
+		case FieldCipher:
+			obj.Ciphers = Copy(value)
+		}
+		return ok
+	})
+	if !ok {
 		return nil
 	}
-	obj.ProtocolVersion = data[0]
-	copy(authKey[:], data[1:17])
-	obj.Key = &authKey
-	obj.CIDRv4 = net.IP{data[17], data[18], data[19], data[20]}
-	obj.CIDRv6 = net.IP{data[21], data[22], data[23], data[24], data[25], data[26], data[27], data[28], data[29], data[30], data[31], data[32], data[33], data[34], data[35], data[36]}
 	return obj
 }
 
-type ClientSendPacketHeader struct {
-	ProtocolVersion uint8    //1 byte
-	Key             *AuthKey //16 byte
-	Length          int      //2 byte, convert to [2]byte
+// Codecs returns the codecs in order of preference, snappy comes first if compress is set
+func Codecs(compress bool) []byte {
+	if compress {
+		return []byte{CodecSnappy, CodecNone}
+	}
+	return []byte{CodecNone}
 }
 
-func (p *ClientSendPacketHeader) Bytes() []byte {
-	data := make([]byte, ClientSendPacketHeaderLength)
-	data[0] = p.ProtocolVersion
-	copy(data[1:17], p.Key[:])
-	data[17] = byte(p.Length >> 8 & 0xff)
-	data[18] = byte(p.Length & 0xff)
+// ParseCiphers parses a comma separated list of cipher names in order of preference, the empty list is every cipher
+func ParseCiphers(s string) ([]byte, error) {
+	var ciphers []byte
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		found := false
+		for id, name := range cipherNames {
+			if strings.EqualFold(f, name) {
+				ciphers = append(ciphers, id)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown cipher %q", f)
+		}
+	}
+	if len(ciphers) == 0 {
+		return []byte{CipherAESGCM, CipherChaCha20Poly1305}, nil
+	}
+	return ciphers, nil
+}
+
+// CodecNames returns the names of the codecs
+func CodecNames(ids []byte) string {
+	return names(codecNames, ids)
+}
+
+// CipherNames returns the names of the ciphers
+func CipherNames(ids []byte) string {
+	return names(cipherNames, ids)
+}
+
+func names(known map[byte]string, ids []byte) string {
+	var names []string
+	for _, id := range ids {
+		name, ok := known[id]
+		if !ok {
+			name = fmt.Sprintf("%#02x", id)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "nothing"
+	}
+	return strings.Join(names, "/")
+}
+
+// Negotiate returns the first offered id which is accepted
+func Negotiate(offered, accepted []byte) (byte, bool) {
+	for _, id := range offered {
+		if bytes.IndexByte(accepted, id) >= 0 {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// ParsePrefixes parses a comma separated list of prefixes, they are masked
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// ParseAddrs parses a comma separated list of addresses
+func ParseAddrs(s string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(f)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// ParseDomains parses a comma separated list of domains, the trailing dots are trimmed
+func ParseDomains(s string) ([]string, error) {
+	var domains []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSuffix(strings.TrimSpace(f), "."); f == "" {
+			continue
+		}
+		if len(f) > 253 || strings.ContainsAny(f, " \t/") {
+			return nil, fmt.Errorf("invalid domain %q", f)
+		}
+		domains = append(domains, f)
+	}
+	return domains, nil
+}
+
+// appendPrefix appends the ip version, the prefix length and the address of the prefix
+func appendPrefix(data []byte, p netip.Prefix) []byte {
+	if p.Addr().Is4() {
+		data = append(data, 4, byte(p.Bits()))
+	} else {
+		data = append(data, 6, byte(p.Bits()))
+	}
+	return append(data, p.Addr().AsSlice()...)
+}
+
+// parsePrefix parses a prefix of appendPrefix, it is masked, and returns the data after it
+func parsePrefix(data []byte) (netip.Prefix, []byte, bool) {
+	if len(data) < 2 {
+		return netip.Prefix{}, nil, false
+	}
+	n := net.IPv4len
+	if data[0] == 6 {
+		n = net.IPv6len
+	} else if data[0] != 4 {
+		return netip.Prefix{}, nil, false
+	}
+	if len(data) < 2+n {
+		return netip.Prefix{}, nil, false
+	}
+	addr, _ := netip.AddrFromSlice(data[2 : 2+n])
+	p := netip.PrefixFrom(addr, int(data[1]))
+	if !p.IsValid() {
+		return netip.Prefix{}, nil, false
+	}
+	return p.Masked(), data[2+n:], true
+}
+
+// appendPrefixList appends the prefixes, the length of the field delimits them
+func appendPrefixList(data []byte, prefixes []netip.Prefix) []byte {
+	for _, p := range prefixes {
+		data = appendPrefix(data, p)
+	}
 	return data
 }
 
-func ParseClientSendPacketHeader(data []byte) *ClientSendPacketHeader {
-	var obj = &ClientSendPacketHeader{}
-	var authKey AuthKey
-	if len(data) != ClientSendPacketHeaderLength {
+// The field types of the ServerHandshakePacket. A field is a 1 byte type, a 2 byte length and the value,
+// the fields of unknown types are skipped so a server may add some without breaking the older clients.
+const (
+	FieldCIDRv4     byte = 0x01 // 4 byte address, 1 byte prefix length
+	FieldCIDRv6     byte = 0x02 // 16 byte address, 1 byte prefix length
+	FieldServerIP   byte = 0x03 // 4 byte
+	FieldServerIPv6 byte = 0x04 // 16 byte
+	FieldMTU        byte = 0x05 // 2 byte
+	FieldRoutes     byte = 0x06 // prefixes
+	FieldSubnets    byte = 0x07 // prefixes
+	FieldDNS        byte = 0x08 // addresses as the prefixes of their full length
+	FieldSearch     byte = 0x09 // strings of a 1 byte length
+	FieldSessionID  byte = 0x0a // 16 byte
+	FieldCodec      byte = 0x0b // 1 byte codecs, the offered ones of the client or the chosen one of the server
+	FieldCipher     byte = 0x0c // 1 byte ciphers, the offered ones of the client or the chosen one of the server
+	FieldError      byte = 0x0d // the reason the server rejects the client
+)
+
+// MaxFieldLength is the length of the longest field value
+const MaxFieldLength = 0xffff
+
+// ServerHandshakePacket is the payload of the handshake reply of the server, it carries the tun addresses assigned
+// to the client and the settings pushed to it. The unset fields are omitted, they are left to the client.
+type ServerHandshakePacket struct {
+	CIDRv4     netip.Prefix
+	CIDRv6     netip.Prefix
+	ServerIP   netip.Addr
+	ServerIPv6 netip.Addr
+	// MTU is the mtu of the server tun interface
+	MTU int
+	// Routes are the prefixes the client routes to the tunnel
+	Routes []netip.Prefix
+	// Subnets are the subnets of the client the server accepted to route
+	Subnets []netip.Prefix
+	// DNS are the dns servers and Search the search domains pushed to the client
+	DNS    []netip.Addr
+	Search []string
+	// SessionID identifies the session on the server
+	SessionID []byte
+	// Codec and Cipher are the ones the server chose among the ones of the client
+	Codec  byte
+	Cipher byte
+	// Error is the reason the server rejects the client, the other fields are unset
+	Error string
+}
+
+func (p *ServerHandshakePacket) Bytes() []byte {
+	var data []byte
+	if p.CIDRv4.Addr().Is4() {
+		data = appendField(data, FieldCIDRv4, append(p.CIDRv4.Addr().AsSlice(), byte(p.CIDRv4.Bits())))
+	}
+	if p.CIDRv6.Addr().Is6() {
+		data = appendField(data, FieldCIDRv6, append(p.CIDRv6.Addr().AsSlice(), byte(p.CIDRv6.Bits())))
+	}
+	if p.ServerIP.Is4() {
+		data = appendField(data, FieldServerIP, p.ServerIP.AsSlice())
+	}
+	if p.ServerIPv6.Is6() {
+		data = appendField(data, FieldServerIPv6, p.ServerIPv6.AsSlice())
+	}
+	if p.MTU > 0 {
+		data = appendField(data, FieldMTU, binary.BigEndian.AppendUint16(nil, uint16(p.MTU)))
+	}
+	if len(p.Routes) > 0 {
+		data = appendField(data, FieldRoutes, appendPrefixList(nil, p.Routes))
+	}
+	if len(p.Subnets) > 0 {
+		data = appendField(data, FieldSubnets, appendPrefixList(nil, p.Subnets))
+	}
+	var value []byte
+	if len(p.DNS) > 0 {
+		for _, addr := range p.DNS {
+			value = appendPrefix(value, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		data = appendField(data, FieldDNS, value)
+	}
+	if len(p.Search) > 0 {
+		value = value[:0]
+		for _, s := range p.Search {
+			value = append(append(value, byte(len(s))), s...)
+		}
+		data = appendField(data, FieldSearch, value)
+	}
+	if len(p.SessionID) > 0 {
+		data = appendField(data, FieldSessionID, p.SessionID)
+	}
+	if p.Cipher != 0 {
+		data = appendField(data, FieldCodec, []byte{p.Codec})
+		data = appendField(data, FieldCipher, []byte{p.Cipher})
+	}
+	if p.Error != "" {
+		data = appendField(data, FieldError, []byte(p.Error))
+	}
+	return data
+}
+
+// appendField appends the type, the length and the value of a field, the value is cut to MaxFieldLength
+func appendField(data []byte, typ byte, value []byte) []byte {
+	if len(value) > MaxFieldLength {
+		value = value[:MaxFieldLength]
+	}
+	data = append(data, typ)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+	return append(data, value...)
+}
+
+// ParseServerHandshakePacket parses the reply of the server, the fields it lacks are invalid or empty
+func ParseServerHandshakePacket(data []byte) *ServerHandshakePacket {
+	var obj = &ServerHandshakePacket{}
+	ok := parseFields(data, func(typ byte, value []byte) bool {
+		ok := true
+		switch typ {
+		case FieldCIDRv4:
+			obj.CIDRv4, ok = parseAddrPrefix(value, net.IPv4len)
+		case FieldCIDRv6:
+			obj.CIDRv6, ok = parseAddrPrefix(value, net.IPv6len)
+		case FieldServerIP:
+			obj.ServerIP, ok = netip.AddrFromSlice(value)
+			ok = ok && obj.ServerIP.Is4()
+		case FieldServerIPv6:
+			obj.ServerIPv6, ok = netip.AddrFromSlice(value)
+			ok = ok && obj.ServerIPv6.Is6()
+		case FieldMTU:
+			if ok = len(value) == 2; ok {
+				obj.MTU = int(binary.BigEndian.Uint16(value))
+			}
+		case FieldRoutes:
+			obj.Routes, ok = parsePrefixList(value)
+		case FieldSubnets:
+			obj.Subnets, ok = parsePrefixList(value)
+		case FieldDNS:
+			var prefixes []netip.Prefix
+			prefixes, ok = parsePrefixList(value)
+			obj.DNS = nil
+			for _, p := range prefixes {
+				ok = ok && p.IsSingleIP()
+				obj.DNS = append(obj.DNS, p.Addr())
+			}
+		case FieldSearch:
+			obj.Search, ok = parseStringList(value)
+		case FieldSessionID:
+			obj.SessionID, ok = Copy(value), len(value) == SessionIDLength
+		case FieldCodec:
+			if ok = len(value) == 1; ok {
+				obj.Codec = value[0]
+			}
+		case FieldCipher:
+			if ok = len(value) == 1; ok {
+				obj.Cipher = value[0]
+			}
+		case FieldError:
+			obj.Error = string(value)
+		}
+		return ok
+	})
+	if !ok {
 		return nil
 	}
-	obj.ProtocolVersion = data[0]
-	copy(authKey[:], data[1:17])
-	obj.Key = &authKey
-	obj.Length = ((obj.Length & 0x00) | int(data[17])) << 8
-	obj.Length = obj.Length | int(data[18])
 	return obj
 }
 
-type ServerSendPacketHeader struct {
+// parseFields calls field with the type and the value of every field of data,
+// it reports whether the fields are well formed and every call succeeds
+func parseFields(data []byte, field func(typ byte, value []byte) bool) bool {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return false
+		}
+		typ, n := data[0], int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+n {
+			return false
+		}
+		if !field(typ, data[3:3+n]) {
+			return false
+		}
+		data = data[3+n:]
+	}
+	return true
+}
+
+// parseAddrPrefix parses an address of n bytes followed by a prefix length
+func parseAddrPrefix(value []byte, n int) (netip.Prefix, bool) {
+	if len(value) != n+1 {
+		return netip.Prefix{}, false
+	}
+	addr, _ := netip.AddrFromSlice(value[:n])
+	p := netip.PrefixFrom(addr, int(value[n]))
+	return p, p.IsValid()
+}
+
+// parsePrefixList parses the prefixes filling a field value
+func parsePrefixList(value []byte) ([]netip.Prefix, bool) {
+	var prefixes []netip.Prefix
+	for len(value) > 0 {
+		p, rest, ok := parsePrefix(value)
+		if !ok {
+			return nil, false
+		}
+		prefixes = append(prefixes, p)
+		value = rest
+	}
+	return prefixes, true
+}
+
+// parseStringList parses the strings of a 1 byte length filling a field value
+func parseStringList(value []byte) ([]string, bool) {
+	var strs []string
+	for len(value) > 0 {
+		if len(value) < 1+int(value[0]) {
+			return nil, false
+		}
+		strs = append(strs, string(value[1:1+value[0]]))
+		value = value[1+value[0]:]
+	}
+	return strs, true
+}
+
+// PacketHeader prefixes the handshake messages and the frames of the stream transports
+type PacketHeader struct {
 	ProtocolVersion uint8 //1 byte
 	Length          int   //2 byte, convert to [2]byte
 }
 
-func (p *ServerSendPacketHeader) Bytes() []byte {
-	data := make([]byte, ServerSendPacketHeaderLength)
+func (p *PacketHeader) Bytes() []byte {
+	data := make([]byte, PacketHeaderLength)
 	data[0] = p.ProtocolVersion
 	data[1] = byte(p.Length >> 8 & 0xff)
 	data[2] = byte(p.Length & 0xff)
 	return data
 }
 
-func ParseServerSendPacketHeader(data []byte) *ServerSendPacketHeader {
-	var obj = &ServerSendPacketHeader{}
-	if len(data) != ServerSendPacketHeaderLength {
+func ParsePacketHeader(data []byte) *PacketHeader {
+	var obj = &PacketHeader{}
+	if len(data) != PacketHeaderLength {
 		return nil
 	}
 	obj.ProtocolVersion = data[0]
@@ -116,6 +533,46 @@ func ParseServerSendPacketHeader(data []byte) *ServerSendPacketHeader {
 	return obj
 }
 
+// AppendTimestamp appends the time in unix nanoseconds
+func AppendTimestamp(data []byte, t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(data, uint64(t.UnixNano()))
+}
+
+// ParseTimestamp parses the time of AppendTimestamp
+func ParseTimestamp(data []byte) (time.Time, bool) {
+	if len(data) != TimestampLength {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), true
+}
+
+// AppendBatchPacket appends the packet to the payload of a batch frame
+func AppendBatchPacket(batch []byte, packet []byte) []byte {
+	batch = binary.BigEndian.AppendUint16(batch, uint16(len(packet)))
+	return append(batch, packet...)
+}
+
+// NextBatchPacket returns the first packet of the payload of a batch frame and the rest of the payload,
+// ok is false if the payload is truncated
+func NextBatchPacket(batch []byte) (packet []byte, rest []byte, ok bool) {
+	if len(batch) < HeaderLength {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(batch))
+	if len(batch) < HeaderLength+n {
+		return nil, nil, false
+	}
+	return batch[HeaderLength : HeaderLength+n], batch[HeaderLength+n:], true
+}
+
+// CheckVersion returns an error if the peer speaks another protocol version
+func CheckVersion(version uint8) error {
+	if version != ProtocolVersion {
+		return fmt.Errorf("%w %d, expected %d", ErrProtocolVersion, version, ProtocolVersion)
+	}
+	return nil
+}
+
 const HeaderLength = 2
 
 // ReadLength []byte length to int length
@@ -149,41 +606,3 @@ func Merge(a, b []byte) []byte {
 	copy(c[:al], a)
 	return c
 }
-
-type AuthKey [16]byte
-
-// Bytes returns the bytes representation of this AuthKey.
-func (u *AuthKey) Bytes() []byte {
-	return u[:]
-}
-
-// Equals returns true if this AuthKey equals another AuthKey by value.
-func (u *AuthKey) Equals(another *AuthKey) bool {
-	if u == nil && another == nil {
-		return true
-	}
-	if u == nil || another == nil {
-		return false
-	}
-	return bytes.Equal(u.Bytes(), another.Bytes())
-}
-
-// ParseBytes converts a AuthKey in byte form to object.
-func ParseBytes(b []byte) (AuthKey, error) {
-	var authKey AuthKey
-	if len(b) != 16 {
-		return authKey, errors.New(fmt.Sprintf("invalid AuthKey: %v", b))
-	}
-	copy(authKey[:], b)
-	return authKey, nil
-}
-
-// ParseAuthKeyFromString converts a AuthKey in string form to object.
-func ParseAuthKeyFromString(str string) *AuthKey {
-	var authKey AuthKey
-	m := md5.New()
-	m.Write([]byte(str))
-	r := m.Sum(nil)
-	copy(authKey[:], r[:16])
-	return &authKey
-}
@@ -2,13 +2,15 @@ package xproto
 
 import (
 	"encoding/hex"
+	"fmt"
 	"github.com/net-byte/vtun/common/config"
+	"net/netip"
+	"reflect"
 	"testing"
 )
 
 func TestClientHandshakePacket_Bytes(t *testing.T) {
 	ch, err := GenClientHandshakePacket(config.Config{
-		Key:    "flyflygogo",
 		CIDR:   "172.16.0.10/24",
 		CIDRv6: "fced:9999::9999/64",
 	})
@@ -17,3 +19,162 @@ func TestClientHandshakePacket_Bytes(t *testing.T) {
 	}
 	t.Logf("bytes: %v\n", hex.EncodeToString(ch.Bytes()))
 }
+
+func TestParseClientHandshakePacket(t *testing.T) {
+	ch, err := GenClientHandshakePacket(config.Config{
+		CIDR:   "172.16.0.10/24",
+		CIDRv6: "fced:9999::9999/64",
+	})
+	if err != nil {
+		t.Fatal("err", err)
+	}
+	parsed := ParseClientHandshakePacket(ch.Bytes())
+	if parsed == nil {
+		t.Fatal("parsed == nil")
+	}
+	if !parsed.CIDRv4.Equal(ch.CIDRv4) || !parsed.CIDRv6.Equal(ch.CIDRv6) || len(parsed.ClientID) != ClientIDLength {
+		t.Errorf("parsed %+v != %+v", parsed, ch)
+	}
+	if !reflect.DeepEqual(parsed.Codecs, []byte{CodecNone}) || !reflect.DeepEqual(parsed.Ciphers, []byte{CipherAESGCM, CipherChaCha20Poly1305}) {
+		t.Errorf("codecs %v ciphers %v", parsed.Codecs, parsed.Ciphers)
+	}
+	if CheckVersion(ProtocolVersion-1) == nil {
+		t.Error("old version accepted")
+	}
+}
+
+func TestParseServerHandshakePacket(t *testing.T) {
+	sh := &ServerHandshakePacket{
+		CIDRv4:   netip.MustParsePrefix("172.16.0.2/24"),
+		ServerIP: netip.MustParseAddr("172.16.0.1"),
+	}
+	parsed := ParseServerHandshakePacket(sh.Bytes())
+	if parsed == nil {
+		t.Fatal("parsed == nil")
+	}
+	if !reflect.DeepEqual(parsed, sh) {
+		t.Errorf("parsed %+v != %+v", parsed, sh)
+	}
+	sh.CIDRv6 = netip.MustParsePrefix("fced:9999::2/64")
+	sh.ServerIPv6 = netip.MustParseAddr("fced:9999::1")
+	sh.MTU = 1400
+	sh.SessionID = make([]byte, SessionIDLength)
+	parsed = ParseServerHandshakePacket(sh.Bytes())
+	if parsed == nil || !reflect.DeepEqual(parsed, sh) {
+		t.Errorf("parsed %+v != %+v", parsed, sh)
+	}
+	if ParseServerHandshakePacket(sh.Bytes()[:len(sh.Bytes())-1]) != nil {
+		t.Error("truncated packet accepted")
+	}
+	sh.Routes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	sh.Subnets = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("fd00:1::/64")}
+	parsed = ParseServerHandshakePacket(sh.Bytes())
+	if parsed == nil || !reflect.DeepEqual(parsed, sh) {
+		t.Errorf("parsed %+v != %+v", parsed, sh)
+	}
+	sh.Routes = nil
+	sh.Subnets = nil
+	sh.DNS = []netip.Addr{netip.MustParseAddr("172.16.0.1"), netip.MustParseAddr("fced:9999::1")}
+	sh.Search = []string{"vpn", "corp.example.com"}
+	parsed = ParseServerHandshakePacket(sh.Bytes())
+	if parsed == nil || !reflect.DeepEqual(parsed, sh) {
+		t.Errorf("parsed %+v != %+v", parsed, sh)
+	}
+	// the fields of a newer server are skipped
+	data := append([]byte{0xfe, 0x00, 0x02, 0x01, 0x02}, sh.Bytes()...)
+	parsed = ParseServerHandshakePacket(data)
+	if parsed == nil || !reflect.DeepEqual(parsed, sh) {
+		t.Errorf("parsed %+v != %+v", parsed, sh)
+	}
+	if ParseServerHandshakePacket([]byte{FieldMTU, 0x00, 0x01, 0x05}) != nil {
+		t.Error("invalid mtu accepted")
+	}
+	if ParseServerHandshakePacket([]byte{FieldCIDRv4, 0x00, 0x05, 172, 16, 0, 2, 33}) != nil {
+		t.Error("invalid prefix accepted")
+	}
+	if parsed = ParseServerHandshakePacket(nil); parsed == nil || parsed.CIDRv4.IsValid() {
+		t.Errorf("parsed %+v of an empty packet", parsed)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	ciphers, err := ParseCiphers("ChaCha20-Poly1305, aes-gcm")
+	if err != nil || !reflect.DeepEqual(ciphers, []byte{CipherChaCha20Poly1305, CipherAESGCM}) {
+		t.Errorf("ciphers %v %v", ciphers, err)
+	}
+	if _, err = ParseCiphers("rc4"); err == nil {
+		t.Error("unknown cipher accepted")
+	}
+	// the preference of the offer wins
+	if id, ok := Negotiate(ciphers, []byte{CipherAESGCM, CipherChaCha20Poly1305}); !ok || id != CipherChaCha20Poly1305 {
+		t.Errorf("negotiated %v %v", id, ok)
+	}
+	if id, ok := Negotiate(Codecs(true), Codecs(false)); !ok || id != CodecNone {
+		t.Errorf("negotiated %v %v", id, ok)
+	}
+	if _, ok := Negotiate([]byte{CipherAESGCM}, []byte{CipherChaCha20Poly1305}); ok {
+		t.Error("negotiated without common cipher")
+	}
+	if names := CipherNames([]byte{CipherAESGCM, 0x7f}); names != "aes-gcm/0x7f" {
+		t.Errorf("names %s", names)
+	}
+}
+
+func TestParseDNS(t *testing.T) {
+	addrs, err := ParseAddrs("172.16.0.1, fced:9999::1,")
+	if err != nil || fmt.Sprint(addrs) != "[172.16.0.1 fced:9999::1]" {
+		t.Errorf("addrs %v %v", addrs, err)
+	}
+	if _, err = ParseAddrs("172.16.0.1/24"); err == nil {
+		t.Error("invalid address accepted")
+	}
+	domains, err := ParseDomains("vpn., corp.example.com")
+	if err != nil || fmt.Sprint(domains) != "[vpn corp.example.com]" {
+		t.Errorf("domains %v %v", domains, err)
+	}
+	if _, err = ParseDomains("corp example"); err == nil {
+		t.Error("invalid domain accepted")
+	}
+}
+
+func TestParseClientHandshakePacket_Subnets(t *testing.T) {
+	ch, err := GenClientHandshakePacket(config.Config{
+		CIDR:    "172.16.0.10/24",
+		CIDRv6:  "fced:9999::9999/64",
+		Subnets: "192.168.1.1/24, fd00:1::/64",
+	})
+	if err != nil {
+		t.Fatal("err", err)
+	}
+	parsed := ParseClientHandshakePacket(ch.Bytes())
+	if parsed == nil {
+		t.Fatal("parsed == nil")
+	}
+	if fmt.Sprint(parsed.Subnets) != "[192.168.1.0/24 fd00:1::/64]" {
+		t.Errorf("subnets %v", parsed.Subnets)
+	}
+	if _, err = GenClientHandshakePacket(config.Config{CIDR: "172.16.0.10/24", CIDRv6: "fced:9999::9999/64", Subnets: "192.168.1.1"}); err == nil {
+		t.Error("invalid subnet accepted")
+	}
+}
+
+func TestNextBatchPacket(t *testing.T) {
+	batch := AppendBatchPacket(nil, []byte{1, 2, 3})
+	batch = AppendBatchPacket(batch, nil)
+	batch = AppendBatchPacket(batch, []byte{4})
+	var packets []string
+	for len(batch) > 0 {
+		packet, rest, ok := NextBatchPacket(batch)
+		if !ok {
+			t.Fatal("truncated batch")
+		}
+		packets = append(packets, fmt.Sprint(packet))
+		batch = rest
+	}
+	if fmt.Sprint(packets) != "[[1 2 3] [] [4]]" {
+		t.Errorf("packets %v", packets)
+	}
+	if _, _, ok := NextBatchPacket([]byte{0, 2, 1}); ok {
+		t.Error("truncated batch accepted")
+	}
+}
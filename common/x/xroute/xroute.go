@@ -0,0 +1,207 @@
+package xroute
+
+import (
+	"net/netip"
+)
+
+// Table is a routing table which maps the prefixes to values and finds the longest prefix matching an address.
+// It is a path-compressed binary radix tree per address family, a lookup visits at most one node per prefix length.
+// The table is not safe for concurrent use.
+type Table[T any] struct {
+	v4  *node[T]
+	v6  *node[T]
+	len int
+}
+
+type node[T any] struct {
+	prefix netip.Prefix
+	value  T
+	set    bool
+	child  [2]*node[T]
+}
+
+// root returns the root of the tree of the family of addr
+func (t *Table[T]) root(addr netip.Addr) **node[T] {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// Insert maps the prefix to the value, the prefix is masked and replaces the value of an equal one
+func (t *Table[T]) Insert(prefix netip.Prefix, value T) {
+	if !prefix.IsValid() {
+		return
+	}
+	prefix = prefix.Masked()
+	n := t.root(prefix.Addr())
+	for *n != nil {
+		cur := *n
+		common := commonBits(cur.prefix, prefix)
+		if common == cur.prefix.Bits() && common == prefix.Bits() {
+			if !cur.set {
+				t.len++
+			}
+			cur.value, cur.set = value, true
+			return
+		}
+		if common == cur.prefix.Bits() {
+			n = &cur.child[bit(prefix.Addr(), common)]
+			continue
+		}
+		// split the node at the common bits
+		split := &node[T]{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+		split.child[bit(cur.prefix.Addr(), common)] = cur
+		if common == prefix.Bits() {
+			split.value, split.set = value, true
+		} else {
+			split.child[bit(prefix.Addr(), common)] = &node[T]{prefix: prefix, value: value, set: true}
+		}
+		*n = split
+		t.len++
+		return
+	}
+	*n = &node[T]{prefix: prefix, value: value, set: true}
+	t.len++
+}
+
+// Get returns the value of the prefix
+func (t *Table[T]) Get(prefix netip.Prefix) (T, bool) {
+	var zero T
+	if !prefix.IsValid() {
+		return zero, false
+	}
+	prefix = prefix.Masked()
+	n := *t.root(prefix.Addr())
+	for n != nil && n.prefix.Bits() <= prefix.Bits() {
+		if n.prefix == prefix {
+			if n.set {
+				return n.value, true
+			}
+			return zero, false
+		}
+		if !n.prefix.Contains(prefix.Addr()) || n.prefix.Bits() == prefix.Bits() {
+			break
+		}
+		n = n.child[bit(prefix.Addr(), n.prefix.Bits())]
+	}
+	return zero, false
+}
+
+// Lookup returns the value of the longest prefix which contains addr
+func (t *Table[T]) Lookup(addr netip.Addr) (T, bool) {
+	var value T
+	found := false
+	b, offset := addr.As16(), 0
+	if addr.Is4() {
+		offset = 96
+	}
+	// the skipped bits of the compressed nodes are only checked on the nodes with a value
+	for n := *t.root(addr); n != nil; {
+		if n.set && n.prefix.Contains(addr) {
+			value, found = n.value, true
+		}
+		i := n.prefix.Bits()
+		if i == addr.BitLen() {
+			break
+		}
+		i += offset
+		n = n.child[(b[i/8]>>(7-i%8))&1]
+	}
+	return value, found
+}
+
+// Delete removes the prefix and reports whether it was in the table
+func (t *Table[T]) Delete(prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	prefix = prefix.Masked()
+	ok := remove(t.root(prefix.Addr()), prefix)
+	if ok {
+		t.len--
+	}
+	return ok
+}
+
+// remove unsets the prefix in the subtree of n and merges the nodes left with less than two children
+func remove[T any](n **node[T], prefix netip.Prefix) bool {
+	cur := *n
+	if cur == nil || cur.prefix.Bits() > prefix.Bits() || !cur.prefix.Contains(prefix.Addr()) {
+		return false
+	}
+	if cur.prefix != prefix {
+		if cur.prefix.Bits() == prefix.Bits() {
+			return false
+		}
+		if !remove(&cur.child[bit(prefix.Addr(), cur.prefix.Bits())], prefix) {
+			return false
+		}
+	} else {
+		if !cur.set {
+			return false
+		}
+		var zero T
+		cur.value, cur.set = zero, false
+	}
+	if !cur.set {
+		switch {
+		case cur.child[0] == nil:
+			*n = cur.child[1]
+		case cur.child[1] == nil:
+			*n = cur.child[0]
+		}
+	}
+	return true
+}
+
+// Walk calls fn for every prefix of the table until it returns false
+func (t *Table[T]) Walk(fn func(prefix netip.Prefix, value T) bool) {
+	for _, root := range []*node[T]{t.v4, t.v6} {
+		if !walk(root, fn) {
+			return
+		}
+	}
+}
+
+func walk[T any](n *node[T], fn func(prefix netip.Prefix, value T) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.set && !fn(n.prefix, n.value) {
+		return false
+	}
+	return walk(n.child[0], fn) && walk(n.child[1], fn)
+}
+
+// Len returns the number of prefixes in the table
+func (t *Table[T]) Len() int {
+	return t.len
+}
+
+// bit returns the bit of addr at the position i, the first bit is at 0
+func bit(addr netip.Addr, i int) int {
+	if addr.Is4() {
+		b := addr.As4()
+		return int(b[i/8]>>(7-i%8)) & 1
+	}
+	b := addr.As16()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns the number of leading bits the prefixes share, at most the shortest prefix length
+func commonBits(a, b netip.Prefix) int {
+	n := min(a.Bits(), b.Bits())
+	x, y := a.Addr().As16(), b.Addr().As16()
+	offset := 0
+	if a.Addr().Is4() {
+		offset = 96
+	}
+	for i := 0; i < n; i++ {
+		j := i + offset
+		if (x[j/8]>>(7-j%8))&1 != (y[j/8]>>(7-j%8))&1 {
+			return i
+		}
+	}
+	return n
+}
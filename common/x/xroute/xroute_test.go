@@ -0,0 +1,112 @@
+package xroute
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTable_Lookup(t *testing.T) {
+	table := &Table[string]{}
+	table.Insert(netip.MustParsePrefix("0.0.0.0/0"), "default")
+	table.Insert(netip.MustParsePrefix("172.16.0.0/24"), "tun")
+	table.Insert(netip.MustParsePrefix("172.16.0.10/32"), "a")
+	table.Insert(netip.MustParsePrefix("192.168.1.1/24"), "lan")
+	table.Insert(netip.MustParsePrefix("192.168.0.0/16"), "site")
+	table.Insert(netip.MustParsePrefix("fced:9999::/64"), "tun6")
+	table.Insert(netip.MustParsePrefix("fced:9999::10/128"), "a6")
+	assert.Equal(t, 7, table.Len())
+
+	for addr, want := range map[string]string{
+		"172.16.0.10":   "a",
+		"172.16.0.11":   "tun",
+		"192.168.1.20":  "lan",
+		"192.168.2.20":  "site",
+		"8.8.8.8":       "default",
+		"fced:9999::10": "a6",
+		"fced:9999::11": "tun6",
+	} {
+		v, ok := table.Lookup(netip.MustParseAddr(addr))
+		assert.True(t, ok, addr)
+		assert.Equal(t, want, v, addr)
+	}
+	_, ok := table.Lookup(netip.MustParseAddr("fd00::1"))
+	assert.False(t, ok)
+
+	v, ok := table.Get(netip.MustParsePrefix("192.168.1.0/24"))
+	assert.True(t, ok)
+	assert.Equal(t, "lan", v)
+	_, ok = table.Get(netip.MustParsePrefix("192.168.0.0/17"))
+	assert.False(t, ok)
+
+	// the more specific prefix is removed, the covering one remains
+	assert.True(t, table.Delete(netip.MustParsePrefix("192.168.1.0/24")))
+	assert.False(t, table.Delete(netip.MustParsePrefix("192.168.1.0/24")))
+	v, _ = table.Lookup(netip.MustParseAddr("192.168.1.20"))
+	assert.Equal(t, "site", v)
+	assert.True(t, table.Delete(netip.MustParsePrefix("0.0.0.0/0")))
+	_, ok = table.Lookup(netip.MustParseAddr("8.8.8.8"))
+	assert.False(t, ok)
+	v, _ = table.Lookup(netip.MustParseAddr("172.16.0.10"))
+	assert.Equal(t, "a", v)
+	assert.Equal(t, 5, table.Len())
+
+	var prefixes []string
+	table.Walk(func(prefix netip.Prefix, _ string) bool {
+		prefixes = append(prefixes, prefix.String())
+		return true
+	})
+	assert.ElementsMatch(t, []string{"172.16.0.0/24", "172.16.0.10/32", "192.168.0.0/16", "fced:9999::/64", "fced:9999::10/128"}, prefixes)
+}
+
+// TestTable_Random compares the table with a linear search over random prefixes
+func TestTable_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	table := &Table[int]{}
+	prefixes := map[netip.Prefix]int{}
+	randomPrefix := func() netip.Prefix {
+		addr := netip.AddrFrom4([4]byte{10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))})
+		return netip.PrefixFrom(addr, 8+r.Intn(25)).Masked()
+	}
+	for i := 0; i < 2000; i++ {
+		p := randomPrefix()
+		if r.Intn(4) == 0 {
+			table.Delete(p)
+			delete(prefixes, p)
+			continue
+		}
+		table.Insert(p, i)
+		prefixes[p] = i
+	}
+	assert.Equal(t, len(prefixes), table.Len())
+	for i := 0; i < 2000; i++ {
+		addr := randomPrefix().Addr()
+		want, found, bits := 0, false, -1
+		for p, v := range prefixes {
+			if p.Contains(addr) && p.Bits() > bits {
+				want, found, bits = v, true, p.Bits()
+			}
+		}
+		v, ok := table.Lookup(addr)
+		if ok != found || v != want {
+			t.Fatalf("lookup %v = %v %v, want %v %v", addr, v, ok, want, found)
+		}
+	}
+}
+
+func BenchmarkTable_Lookup(b *testing.B) {
+	table := &Table[int]{}
+	for i := 0; i < 1000; i++ {
+		table.Insert(netip.MustParsePrefix(fmt.Sprintf("172.16.%d.%d/32", i/256, i%256)), i)
+	}
+	table.Insert(netip.MustParsePrefix("192.168.0.0/16"), -1)
+	addr := netip.MustParseAddr("172.16.2.100")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(addr)
+	}
+}
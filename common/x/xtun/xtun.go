@@ -21,14 +21,23 @@ func ReadFromTun(iFace *water.Interface, config config.Config, out chan<- []byte
 			}
 			continue
 		}
-		out <- xproto.Copy(packet[:n])
+		select {
+		case out <- xproto.Copy(packet[:n]):
+		case <-_ctx.Done():
+			return
+		}
 	}
 }
 
 func WriteToTun(iFace *water.Interface, config config.Config, in <-chan []byte, _ctx context.Context, _cancel context.CancelFunc) {
 	defer _cancel()
-	for ContextOpened(_ctx) {
-		b := <-in
+	for {
+		var b []byte
+		select {
+		case b = <-in:
+		case <-_ctx.Done():
+			return
+		}
 		_, err := iFace.Write(b)
 		if err != nil {
 			netutil.PrintErr(err, config.Verbose)
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/net-byte/vtun/common"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/net-byte/vtun/app"
 	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/transport"
+	"github.com/net-byte/vtun/transport/tun"
 )
 
 var cfg = config.Config{}
 var configFile string
+var command string
 
 func init() {
 	flag.StringVar(&configFile, "f", "", "config file")
@@ -26,13 +32,18 @@ func init() {
 	flag.StringVar(&cfg.ServerIP, "sip", config.DefaultConfig.ServerIP, "server ip")
 	flag.StringVar(&cfg.ServerIPv6, "sip6", config.DefaultConfig.ServerIPv6, "server ipv6")
 	flag.StringVar(&cfg.Key, "k", config.DefaultConfig.Key, "key")
-	flag.StringVar(&cfg.Protocol, "p", config.DefaultConfig.Protocol, "protocol udp/tls/grpc/quic/utls/dtls/h2/http/tcp/https/ws/wss")
+	flag.StringVar(&cfg.Protocol, "p", config.DefaultConfig.Protocol, "protocol "+strings.Join(transport.Names(), "/"))
 	flag.StringVar(&cfg.Path, "path", config.DefaultConfig.Path, "path")
 	flag.BoolVar(&cfg.ServerMode, "S", config.DefaultConfig.ServerMode, "server mode")
 	flag.BoolVar(&cfg.GlobalMode, "g", config.DefaultConfig.GlobalMode, "client global mode")
-	flag.BoolVar(&cfg.Obfs, "obfs", config.DefaultConfig.Obfs, "enable data obfuscation")
-	flag.BoolVar(&cfg.Compress, "compress", config.DefaultConfig.Compress, "enable data compression")
+	flag.BoolVar(&cfg.Obfs, "obfs", config.DefaultConfig.Obfs, "enable data obfuscation, the server detects it per client")
+	flag.BoolVar(&cfg.Compress, "compress", config.DefaultConfig.Compress, "enable data compression, the server accepts the clients with and without it")
+	flag.StringVar(&cfg.Cipher, "cipher", config.DefaultConfig.Cipher, "ciphers aes-gcm/chacha20-poly1305 in order of preference separated by comma, all of them if empty")
 	flag.IntVar(&cfg.Timeout, "t", config.DefaultConfig.Timeout, "dial timeout in seconds")
+	flag.IntVar(&cfg.KeepAlive, "keepalive", config.DefaultConfig.KeepAlive, "interval of the pings to the peer in seconds")
+	flag.IntVar(&cfg.DeadTimeout, "deadtimeout", config.DefaultConfig.DeadTimeout, "seconds without frame from the peer after which the client reconnects and the server drops the client")
+	flag.IntVar(&cfg.Batch, "batch", config.DefaultConfig.Batch, "coalesce the packets into frames of up to n bytes, capped at the mtu on udp/dtls, 0 disables it")
+	flag.IntVar(&cfg.BatchDelay, "batchdelay", config.DefaultConfig.BatchDelay, "microseconds a packet waits for others to fill its batch frame")
 	flag.StringVar(&cfg.TLSCertificateFilePath, "certificate", config.DefaultConfig.TLSCertificateFilePath, "tls certificate file path")
 	flag.StringVar(&cfg.TLSCertificateKeyFilePath, "privatekey", config.DefaultConfig.TLSCertificateKeyFilePath, "tls certificate key file path")
 	flag.StringVar(&cfg.TLSSni, "sni", config.DefaultConfig.TLSSni, "tls handshake sni")
@@ -40,7 +51,35 @@ func init() {
 	flag.BoolVar(&cfg.Verbose, "v", config.DefaultConfig.Verbose, "enable verbose output")
 	flag.BoolVar(&cfg.PSKMode, "psk", config.DefaultConfig.PSKMode, "enable psk mode (dtls only)")
 	flag.StringVar(&cfg.Host, "host", config.DefaultConfig.Host, "http host")
+	flag.StringVar(&cfg.User, "u", config.DefaultConfig.User, "user name (client only)")
+	flag.StringVar(&cfg.Secret, "secret", config.DefaultConfig.Secret, "user secret (client only)")
+	flag.StringVar(&cfg.UsersFile, "users", config.DefaultConfig.UsersFile, "users file (server only)")
+	flag.StringVar(&cfg.IPv6Mode, "ip6mode", config.DefaultConfig.IPv6Mode, "client ipv6 derived from ipv4/user (server only)")
+	flag.StringVar(&cfg.LeaseFile, "leases", config.DefaultConfig.LeaseFile, "lease store file (server only)")
+	flag.StringVar(&cfg.Subnets, "subnets", config.DefaultConfig.Subnets, "subnets behind the client separated by comma (client only)")
+	flag.StringVar(&cfg.IncludeRoutes, "include", config.DefaultConfig.IncludeRoutes, "prefixes routed to the tunnel separated by comma, @file reads a file (client only)")
+	flag.StringVar(&cfg.ExcludeRoutes, "exclude", config.DefaultConfig.ExcludeRoutes, "prefixes routed to the local gateway separated by comma, @file reads a file (client only)")
+	flag.BoolVar(&cfg.SubnetRoutes, "subnetroutes", config.DefaultConfig.SubnetRoutes, "add kernel routes of the client subnets (server only)")
+	flag.StringVar(&cfg.DNS, "dns", config.DefaultConfig.DNS, "dns servers separated by comma, the server pushes them to the clients, a client uses its own over the pushed ones")
+	flag.StringVar(&cfg.DNSSearch, "dnssearch", config.DefaultConfig.DNSSearch, "dns search domains separated by comma, pushed like the dns servers")
+	flag.StringVar(&cfg.DNSUpstreams, "dnsupstream", config.DefaultConfig.DNSUpstreams, "upstream dns servers separated by comma, enables the dns server on the tun addresses (server only)")
+	flag.StringVar(&cfg.DNSDomain, "dnsdomain", config.DefaultConfig.DNSDomain, "domain of the user names answered by the dns server (server only)")
+	flag.BoolVar(&cfg.KillSwitch, "killswitch", config.DefaultConfig.KillSwitch, "reject the traffic out of the tunnel except to the server until the client stops (linux client global mode only)")
+	flag.StringVar(&cfg.PushRoutes, "pushroutes", config.DefaultConfig.PushRoutes, "prefixes pushed to the clients to route to the tunnel separated by comma, @file reads a file (server only)")
+	flag.BoolVar(&cfg.NAT, "nat", config.DefaultConfig.NAT, "enable ip forwarding and masquerade the client addresses out of the default route interface (linux server only)")
+	flag.IntVar(&cfg.FwMark, "fwmark", config.DefaultConfig.FwMark, "mark of the tunnel sockets, enables the policy routing global mode with the routing table of the same number (linux client only)")
+	flag.StringVar(&cfg.AdminKey, "adminkey", config.DefaultConfig.AdminKey, "key of the /register api of the ws server, sent as a bearer token, the api is disabled if empty (server only)")
+	flag.StringVar(&cfg.StateFile, "state", config.DefaultConfig.StateFile, "state file journaling the route changes, reverted by the next run or the cleanup command")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [cleanup]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	// the flags may follow the command
+	if flag.Arg(0) == "cleanup" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		command = "cleanup"
+	}
 }
 
 func main() {
@@ -51,11 +90,22 @@ func main() {
 			log.Fatalf("Failed to load config from file: %s", err)
 		}
 	}
+	if command == "cleanup" {
+		if err := tun.Cleanup(cfg.StateFile); err != nil {
+			log.Fatalf("failed to clean up: %v", err)
+		}
+		log.Println("vtun cleaned up")
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	app := app.NewApp(&cfg)
-	app.InitConfig()
-	go app.StartApp()
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	err := app.InitConfig()
+	if err == nil {
+		err = app.StartApp(ctx)
+	}
 	app.StopApp()
+	if err != nil {
+		log.Fatalf("vtun: %v", err)
+	}
 }
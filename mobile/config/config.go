@@ -2,11 +2,16 @@ package kc
 
 import (
 	"encoding/json"
+	"sync/atomic"
+
 	"github.com/net-byte/vtun/common/config"
 )
 
 var Config = config.Config{}
 
+// assigned is the json of the config negotiated with the server
+var assigned atomic.Pointer[[]byte]
+
 func Init(str []byte) error {
 	err := json.Unmarshal(str, &Config)
 	if err != nil {
@@ -24,3 +29,22 @@ func Init(str []byte) error {
 	//Config.ServerIPv6 = ip6Net.String()
 	return nil
 }
+
+// SetAssigned stores the config negotiated with the server, it is passed to the clients as their config callback
+func SetAssigned(config config.Config) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return
+	}
+	assigned.Store(&b)
+}
+
+// Assigned returns the json of the config negotiated with the server, it holds the assigned addresses,
+// the mtu, the routes and the dns, it is nil until the client is connected
+func Assigned() []byte {
+	b := assigned.Load()
+	if b == nil {
+		return nil
+	}
+	return *b
+}
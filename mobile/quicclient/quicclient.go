@@ -23,6 +23,7 @@ func StartClient() {
 		kc.Config, _chW.Out, _chR.In,
 		func(n int) {},
 		func(n int) {},
+		kc.SetAssigned,
 		_ctx,
 	)
 }
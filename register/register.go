@@ -1,9 +1,14 @@
 package register
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"log"
 	"net"
+	"net/netip"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -12,18 +17,41 @@ import (
 // The global cache for register
 var _register *cache.Cache
 
+// mu serializes the updates which read and write several leases
+var mu sync.Mutex
+
+// fixed are the fixed addresses of the users, they are never leased dynamically
+var fixed = map[netip.Addr]bool{}
+
+// lease is the value of a client ip in the register
+type lease struct {
+	owner string
+	// pair is the other address of a dual-stack client, the paired leases are refreshed and deleted together
+	pair string
+}
+
 func init() {
 	_register = cache.New(30*time.Minute, 3*time.Minute)
 }
 
 // AddClientIP adds a client ip to the register
 func AddClientIP(ip string) {
-	_register.Add(ip, 0, cache.DefaultExpiration)
+	if _register.Add(ip, lease{}, cache.DefaultExpiration) == nil {
+		dirty.Store(true)
+	}
 }
 
-// DeleteClientIP deletes a client ip from the register
+// DeleteClientIP deletes a client ip and its paired ip from the register
 func DeleteClientIP(ip string) {
-	_register.Delete(ip)
+	mu.Lock()
+	defer mu.Unlock()
+	if v, ok := _register.Get(ip); ok {
+		if pair := v.(lease).pair; pair != "" {
+			_register.Delete(pair)
+		}
+		_register.Delete(ip)
+		persist()
+	}
 }
 
 // ExistClientIP checks if the client ip is in the register
@@ -32,45 +60,199 @@ func ExistClientIP(ip string) bool {
 	return ok
 }
 
-// KeepAliveClientIP keeps the client ip alive
+// KeepAliveClientIP keeps the client ip and its paired ip alive
 func KeepAliveClientIP(ip string) {
-	if ExistClientIP(ip) {
-		_register.Increment(ip, 1)
-	} else {
+	mu.Lock()
+	defer mu.Unlock()
+	keepAlive(ip)
+}
+
+func keepAlive(ip string) {
+	v, ok := _register.Get(ip)
+	if !ok {
 		AddClientIP(ip)
+		return
+	}
+	_register.Set(ip, v, cache.DefaultExpiration)
+	if pair := v.(lease).pair; pair != "" {
+		if p, ok := _register.Get(pair); ok {
+			_register.Set(pair, p, cache.DefaultExpiration)
+		}
+	}
+	dirty.Store(true)
+}
+
+// SetFixedIPs replaces the fixed addresses of the users, which are never leased dynamically.
+// The client of a dynamic lease of such an address gets another address on its next handshake.
+func SetFixedIPs(ips []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	fixed = make(map[netip.Addr]bool, len(ips))
+	for _, ip := range ips {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			fixed[addr.Unmap()] = true
+		}
 	}
 }
 
+// excluded reports whether the ip is reserved or fixed, it is called with mu held
+func excluded(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	return reserved[addr] || fixed[addr]
+}
+
 // PickClientIP picks a client ip from the register
 func PickClientIP(cidr string) (clientIP string, prefixLength string) {
+	return LeaseClientIP(cidr, "", "")
+}
+
+// LeaseClientIP leases a client ip of the cidr to the owner.
+// The ip already leased to the owner is returned first, then the preferred ip if it is free,
+// then the first free ip. The first ip, the server ip, the broadcast ip, the reserved and the fixed ips are never leased.
+func LeaseClientIP(cidr string, preferred string, owner string) (clientIP string, prefixLength string) {
+	mu.Lock()
+	defer mu.Unlock()
 	ip, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		log.Panicf("error cidr %v", cidr)
 	}
+	prefixLength = strings.Split(cidr, "/")[1]
+	inPool := func(c net.IP) bool {
+		c = c.To4()
+		return c != nil && ipNet.Contains(c) && !c.Equal(ip) && !c.Equal(incr(ipNet.IP.To4())) &&
+			!c.Equal(ipNet.IP) && !c.Equal(broadcast(ipNet)) && !excluded(c)
+	}
+	if owner != "" {
+		for k, v := range _register.Items() {
+			if l, ok := v.Object.(lease); ok && l.owner == owner && inPool(net.ParseIP(k)) {
+				keepAlive(k)
+				return k, prefixLength
+			}
+		}
+	}
+	if p := net.ParseIP(preferred); p != nil && inPool(p) {
+		if _register.Add(p.To4().String(), lease{owner: owner}, cache.DefaultExpiration) == nil {
+			persist()
+			return p.To4().String(), prefixLength
+		}
+	}
 	total := addressCount(ipNet) - 3
 	index := uint64(0)
 	//skip first ip
-	ip = incr(ipNet.IP.To4())
+	c := incr(ipNet.IP.To4())
 	for {
-		ip = incr(ip)
+		c = incr(c)
 		index++
-		if index >= total {
+		if index > total {
 			break
 		}
-		if !ExistClientIP(ip.String()) {
-			AddClientIP(ip.String())
-			return ip.String(), strings.Split(cidr, "/")[1]
+		if c.Equal(ip) || excluded(c) {
+			continue
+		}
+		if _register.Add(c.String(), lease{owner: owner}, cache.DefaultExpiration) == nil {
+			persist()
+			return c.String(), prefixLength
 		}
 	}
 	return "", ""
 }
 
-// ListClientIPs returns the client ips in the register
+// LeaseClientIPv6 leases an ipv6 of the cidr to the owner and pairs it with the ipv4 leased to it.
+// The ipv6 embeds the ipv4 in its last 32 bits if the prefix leaves room for it, so it is as stable as the ipv4.
+func LeaseClientIPv6(cidr string, ipv4 string, owner string) (clientIP string, prefixLength string) {
+	return leaseIPv6(cidr, ipv4, owner, func(ipNet *net.IPNet, i int) net.IP {
+		ones, _ := ipNet.Mask.Size()
+		if v4 := net.ParseIP(ipv4).To4(); i == 0 && v4 != nil && ones <= 96 {
+			c := make(net.IP, net.IPv6len)
+			copy(c, ipNet.IP)
+			copy(c[12:], v4)
+			return c
+		}
+		return hashIP(ipNet, ipv4+"/"+owner, i)
+	})
+}
+
+// LeaseClientIPv6ByName leases an ipv6 of the cidr derived from the hash of the name, such as the user name,
+// to the owner and pairs it with the ipv4 leased to it if any.
+func LeaseClientIPv6ByName(cidr string, name string, ipv4 string, owner string) (clientIP string, prefixLength string) {
+	return leaseIPv6(cidr, ipv4, owner, func(ipNet *net.IPNet, i int) net.IP {
+		return hashIP(ipNet, name, i)
+	})
+}
+
+// leaseIPv6 leases the ipv6 already leased to the owner or the first free candidate
+func leaseIPv6(cidr string, ipv4 string, owner string, candidate func(ipNet *net.IPNet, i int) net.IP) (clientIP string, prefixLength string) {
+	mu.Lock()
+	defer mu.Unlock()
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() != nil {
+		log.Panicf("error ipv6 cidr %v", cidr)
+	}
+	prefixLength = strings.Split(cidr, "/")[1]
+	inPool := func(c net.IP) bool {
+		return c != nil && c.To4() == nil && ipNet.Contains(c) && !c.Equal(ip) && !c.Equal(incr(ipNet.IP)) && !c.Equal(ipNet.IP) &&
+			!excluded(c)
+	}
+	pair := func(ipv6 string) (string, string) {
+		if v, ok := _register.Get(ipv4); ok && ipv4 != "" {
+			l := v.(lease)
+			l.pair = ipv6
+			_register.Set(ipv4, l, cache.DefaultExpiration)
+		}
+		_register.Set(ipv6, lease{owner: owner, pair: ipv4}, cache.DefaultExpiration)
+		persist()
+		return ipv6, prefixLength
+	}
+	if owner != "" {
+		for k, v := range _register.Items() {
+			if l, ok := v.Object.(lease); ok && l.owner == owner && inPool(net.ParseIP(k)) {
+				return pair(k)
+			}
+		}
+	}
+	// a few candidates are enough, the pools are sparse
+	for i := 0; i < 16; i++ {
+		c := candidate(ipNet, i)
+		if !inPool(c) {
+			continue
+		}
+		if _register.Add(c.String(), lease{owner: owner}, cache.DefaultExpiration) == nil {
+			return pair(c.String())
+		}
+	}
+	return "", ""
+}
+
+// hashIP returns the ip of the network whose host bits are the hash of the seed and the attempt i
+func hashIP(ipNet *net.IPNet, seed string, i int) net.IP {
+	h := sha256.New()
+	h.Write([]byte(seed))
+	binary.Write(h, binary.BigEndian, uint32(i))
+	sum := h.Sum(nil)
+	c := make(net.IP, len(ipNet.IP))
+	for j := range c {
+		c[j] = ipNet.IP[j] | (sum[j] &^ ipNet.Mask[j])
+	}
+	return c
+}
+
+// ListClientIPs returns the client ips in the register, the paired ips of a client are on the same line
 func ListClientIPs() []string {
 	var result []string
-	for k := range _register.Items() {
-		result = append(result, k)
+	items := _register.Items()
+	for k, v := range items {
+		pair := v.Object.(lease).pair
+		if _, ok := items[pair]; pair == "" || !ok {
+			result = append(result, k)
+		} else if strings.Contains(k, ".") {
+			result = append(result, k+" "+pair)
+		}
 	}
+	sort.Strings(result)
 	return result
 }
 
@@ -80,6 +262,15 @@ func addressCount(network *net.IPNet) uint64 {
 	return 1 << (uint64(bits) - uint64(prefixLen))
 }
 
+// broadcast returns the last ip of the network
+func broadcast(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		ip[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip
+}
+
 // incr increments the ip by 1
 func incr(IP net.IP) net.IP {
 	//IP = checkIPv4(IP)
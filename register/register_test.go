@@ -0,0 +1,90 @@
+package register
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseClientIP(t *testing.T) {
+	ip, pl := LeaseClientIP("10.1.0.1/29", "", "a")
+	assert.Equal(t, "10.1.0.2", ip)
+	assert.Equal(t, "29", pl)
+	// the lease of the owner is kept
+	ip, _ = LeaseClientIP("10.1.0.1/29", "10.1.0.5", "a")
+	assert.Equal(t, "10.1.0.2", ip)
+	ip, _ = LeaseClientIP("10.1.0.1/29", "10.1.0.5", "b")
+	assert.Equal(t, "10.1.0.5", ip)
+	// the preferred ip is taken, the server and broadcast ips are never leased
+	ip, _ = LeaseClientIP("10.1.0.1/29", "10.1.0.5", "c")
+	assert.Equal(t, "10.1.0.3", ip)
+	ip, _ = LeaseClientIP("10.1.0.1/29", "10.1.0.7", "d")
+	assert.Equal(t, "10.1.0.4", ip)
+	ip, _ = LeaseClientIP("10.1.0.1/29", "10.1.0.1", "e")
+	assert.Equal(t, "10.1.0.6", ip)
+	ip, _ = LeaseClientIP("10.1.0.1/29", "", "f")
+	assert.Equal(t, "", ip)
+
+	DeleteClientIP("10.1.0.3")
+	ip, _ = PickClientIP("10.1.0.1/29")
+	assert.Equal(t, "10.1.0.3", ip)
+}
+
+func TestLeaseClientIP_ServerIP(t *testing.T) {
+	// the server ip is skipped wherever it is in the network
+	ip, _ := LeaseClientIP("10.2.0.2/30", "", "a")
+	assert.Equal(t, "", ip)
+	ip, _ = LeaseClientIP("10.3.0.2/29", "", "a")
+	assert.Equal(t, "10.3.0.3", ip)
+}
+
+func TestLeaseClientIP_Fixed(t *testing.T) {
+	SetFixedIPs([]string{"10.6.0.2", "10.6.0.3", "fced:6::a06:4"})
+	defer SetFixedIPs(nil)
+	ip, _ := LeaseClientIP("10.6.0.1/24", "10.6.0.3", "a")
+	assert.Equal(t, "10.6.0.4", ip)
+	ip, _ = LeaseClientIPv6("fced:6::1/64", ip, "a")
+	assert.NotEqual(t, "fced:6::a06:4", ip)
+	assert.Contains(t, ip, "fced:6::")
+	// a lease taken before the address is fixed is not returned to its owner
+	ip, _ = LeaseClientIP("10.6.0.1/24", "", "b")
+	assert.Equal(t, "10.6.0.5", ip)
+	SetFixedIPs([]string{"10.6.0.5"})
+	ip, _ = LeaseClientIP("10.6.0.1/24", "", "b")
+	assert.Equal(t, "10.6.0.2", ip)
+}
+
+func TestLeaseClientIPv6(t *testing.T) {
+	ipv4, _ := LeaseClientIP("10.4.0.1/24", "", "a")
+	ip, pl := LeaseClientIPv6("fced:4::1/64", ipv4, "a")
+	assert.Equal(t, "fced:4::a04:2", ip)
+	assert.Equal(t, "64", pl)
+	// the ipv6 is stable
+	ip, _ = LeaseClientIPv6("fced:4::1/64", ipv4, "a")
+	assert.Equal(t, "fced:4::a04:2", ip)
+	assert.Contains(t, ListClientIPs(), "10.4.0.2 fced:4::a04:2")
+
+	// the paired leases are deleted together
+	DeleteClientIP(ipv4)
+	assert.False(t, ExistClientIP(ip))
+
+	// the prefix is too long to embed the ipv4
+	ipv4, _ = LeaseClientIP("10.4.0.1/24", "", "b")
+	ip, _ = LeaseClientIPv6("fced:4::1/120", ipv4, "b")
+	assert.NotEqual(t, "", ip)
+	assert.Contains(t, ip, "fced:4::")
+}
+
+func TestLeaseClientIPv6ByName(t *testing.T) {
+	a, _ := LeaseClientIPv6ByName("fced:5::1/64", "alice", "", "alice/1")
+	b, _ := LeaseClientIPv6ByName("fced:5::1/64", "alice", "", "alice/1")
+	assert.Equal(t, a, b)
+	DeleteClientIP(a)
+	// the ipv6 is derived from the name, not from the order of the leases
+	b, _ = LeaseClientIPv6ByName("fced:5::1/64", "alice", "", "alice/2")
+	assert.Equal(t, a, b)
+	// another device of the user gets another ipv6
+	c, _ := LeaseClientIPv6ByName("fced:5::1/64", "alice", "", "alice/3")
+	assert.NotEqual(t, "", c)
+	assert.NotEqual(t, a, c)
+}
@@ -0,0 +1,198 @@
+package register
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Reservation is a static ip of the store, it is never leased dynamically
+type Reservation struct {
+	IP   string `json:"ip"`
+	Name string `json:"name,omitempty"`
+}
+
+// storedLease is a lease of the store with its expiration
+type storedLease struct {
+	IP      string    `json:"ip"`
+	Owner   string    `json:"owner,omitempty"`
+	Pair    string    `json:"pair,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// storeFile is the json file of the store
+type storeFile struct {
+	Reservations []Reservation `json:"reservations"`
+	Leases       []storedLease `json:"leases"`
+}
+
+var (
+	// storePath is the file the leases are persisted to, it is empty if the store is not open
+	storePath    string
+	reservations []Reservation
+	reserved     = map[netip.Addr]bool{}
+	dirty        atomic.Bool
+	stopFlush    chan struct{}
+)
+
+// Reservations returns the reservations of the store
+func Reservations() []Reservation {
+	mu.Lock()
+	defer mu.Unlock()
+	return slices.Clone(reservations)
+}
+
+// flushInterval is the interval the refreshed leases are saved at, new and deleted leases are saved at once
+const flushInterval = 10 * time.Second
+
+// Open loads the reservations and the leases of the store file with their remaining time,
+// then persists the leases to it until Close. A missing file is created.
+// The reservations must be addresses of one of the pools if any is given.
+func Open(path string, pools ...netip.Prefix) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if storePath != "" {
+		return errors.New("lease store is already open")
+	}
+	var f storeFile
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+	}
+	set := make(map[netip.Addr]bool, len(f.Reservations))
+	for _, r := range f.Reservations {
+		ip, err := parseReservation(r.IP, pools)
+		if err != nil {
+			return err
+		}
+		set[ip] = true
+	}
+	reservations, reserved = f.Reservations, set
+	now := time.Now()
+	for _, l := range f.Leases {
+		ip, err := netip.ParseAddr(l.IP)
+		if err != nil {
+			continue
+		}
+		if ttl := l.Expires.Sub(now); ttl > 0 && !reserved[ip.Unmap()] {
+			_register.Set(l.IP, lease{owner: l.Owner, pair: l.Pair}, ttl)
+		}
+	}
+	storePath = path
+	if err = save(); err != nil {
+		storePath = ""
+		return err
+	}
+	stopFlush = make(chan struct{})
+	go flush(stopFlush)
+	log.Printf("loaded %d leases and %d reservations from %s", _register.ItemCount(), len(reservations), path)
+	return nil
+}
+
+// parseReservation returns the canonical address of a reservation, which must be in one of the pools if any is given
+func parseReservation(s string, pools []netip.Prefix) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil || ip.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("invalid reservation %q", s)
+	}
+	ip = ip.Unmap()
+	if len(pools) == 0 {
+		return ip, nil
+	}
+	for _, pool := range pools {
+		if pool.Contains(ip) {
+			return ip, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("reservation %s is out of the pool %v", ip, pools)
+}
+
+// Close saves the leases and stops persisting them
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if storePath == "" {
+		return nil
+	}
+	close(stopFlush)
+	err := save()
+	storePath = ""
+	return err
+}
+
+// flush saves the refreshed leases until stop is closed
+func flush(stop <-chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !dirty.Load() {
+				continue
+			}
+			mu.Lock()
+			if err := save(); err != nil {
+				log.Printf("failed to save leases: %v", err)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// persist saves the leases at once if the store is open, it is called with mu held
+func persist() {
+	if err := save(); err != nil {
+		log.Printf("failed to save leases: %v", err)
+	}
+}
+
+// save writes the leases to a temporary file which replaces the store file, it is called with mu held
+func save() error {
+	if storePath == "" {
+		return nil
+	}
+	dirty.Store(false)
+	f := storeFile{Reservations: reservations, Leases: []storedLease{}}
+	if f.Reservations == nil {
+		f.Reservations = []Reservation{}
+	}
+	for k, v := range _register.Items() {
+		l := v.Object.(lease)
+		f.Leases = append(f.Leases, storedLease{IP: k, Owner: l.owner, Pair: l.pair, Expires: time.Unix(0, v.Expiration)})
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(storePath), filepath.Base(storePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), storePath)
+}
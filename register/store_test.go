@@ -0,0 +1,53 @@
+package register
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	expired := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	assert.Nil(t, os.WriteFile(path, []byte(`{
+		"reservations": [{"ip": "10.9.0.2", "name": "router"}, {"ip": "fced:9:0:0:0:0:a09:3"}],
+		"leases": [{"ip": "10.9.0.4", "owner": "old", "expires": "`+expired+`"}]
+	}`), 0600))
+	assert.Nil(t, Open(path, netip.MustParsePrefix("10.9.0.1/24"), netip.MustParsePrefix("fced:9::1/64")))
+
+	// the reserved ips are skipped, the non canonical ones too, the expired lease is dropped
+	ip, _ := LeaseClientIP("10.9.0.1/24", "10.9.0.2", "a")
+	assert.Equal(t, "10.9.0.3", ip)
+	ipv6, _ := LeaseClientIPv6("fced:9::1/64", ip, "a")
+	assert.NotEqual(t, "fced:9::a09:3", ipv6)
+	ip, _ = LeaseClientIP("10.9.0.1/24", "", "b")
+	assert.Equal(t, "10.9.0.4", ip)
+	assert.Nil(t, Close())
+
+	// a restart keeps the leases with their remaining time
+	_register.Flush()
+	assert.Nil(t, Open(path))
+	defer Close()
+	item, ok := _register.Items()["10.9.0.3"]
+	assert.True(t, ok)
+	assert.InDelta(t, float64(30*time.Minute), float64(time.Until(time.Unix(0, item.Expiration))), float64(time.Minute))
+	ip, _ = LeaseClientIP("10.9.0.1/24", "", "a")
+	assert.Equal(t, "10.9.0.3", ip)
+	assert.Contains(t, ListClientIPs(), "10.9.0.3 "+ipv6)
+	ip, _ = LeaseClientIP("10.9.0.1/24", "", "c")
+	assert.Equal(t, "10.9.0.5", ip)
+}
+
+func TestStore_InvalidReservations(t *testing.T) {
+	pools := []netip.Prefix{netip.MustParsePrefix("10.9.0.1/24"), netip.MustParsePrefix("fced:9::1/64")}
+	for _, ip := range []string{"10.9.0", "router", "fe80::1%eth0", "10.8.0.2", "fced:8::2"} {
+		path := filepath.Join(t.TempDir(), "leases.json")
+		assert.Nil(t, os.WriteFile(path, []byte(`{"reservations": [{"ip": "10.9.0.2"}, {"ip": "`+ip+`"}]}`), 0600))
+		assert.NotNil(t, Open(path, pools...), ip)
+		assert.Nil(t, Close())
+	}
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ChanListener is a Listener fed through a channel, it suits the transports
+// whose connections are produced by handlers rather than an accept loop.
+type ChanListener struct {
+	addr   net.Addr
+	closer func() error
+	conns  chan Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewChanListener returns a ChanListener, closer is called once when the listener is closed.
+func NewChanListener(addr net.Addr, closer func() error) *ChanListener {
+	return &ChanListener{
+		addr:   addr,
+		closer: closer,
+		conns:  make(chan Conn, 512),
+		done:   make(chan struct{}),
+	}
+}
+
+// Push hands a new connection to Accept, it closes the connection and returns false if the listener is closed.
+func (l *ChanListener) Push(conn Conn) bool {
+	select {
+	case <-l.done:
+		conn.Close()
+		return false
+	case l.conns <- conn:
+		return true
+	}
+}
+
+// TryPush hands a new connection to Accept without blocking, it closes the connection and returns false
+// if the listener is closed or its queue is full.
+func (l *ChanListener) TryPush(conn Conn) bool {
+	select {
+	case <-l.done:
+	default:
+		select {
+		case l.conns <- conn:
+			return true
+		default:
+		}
+	}
+	conn.Close()
+	return false
+}
+
+// Done returns a channel which is closed when the listener is closed.
+func (l *ChanListener) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *ChanListener) Accept() (Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case conn := <-l.conns:
+		return conn, nil
+	}
+}
+
+func (l *ChanListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *ChanListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		if l.closer != nil {
+			err = l.closer()
+		}
+	})
+	return err
+}
+
+// CloseOnDone closes the listener when the context is done and returns it.
+func CloseOnDone(ctx context.Context, l Listener) Listener {
+	context.AfterFunc(ctx, func() { l.Close() })
+	return l
+}
@@ -0,0 +1,55 @@
+package dtls
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPSKMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := config.Config{LocalAddr: "127.0.0.1:0", Key: "freedom", PSKMode: true, BufferSize: 1500}
+	l, err := (&Transport{}).Listen(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if b, err := conn.ReadPacket(); err == nil {
+					conn.WritePacket(b)
+				}
+			}()
+		}
+	}()
+
+	// the identity hint sent in the clear is not the key
+	assert.NotContains(t, string(pskConfig(server).PSKIdentityHint), server.Key)
+
+	client := config.Config{ServerAddr: l.Addr().String(), Key: "freedom", PSKMode: true, BufferSize: 1500}
+	conn, err := (&Transport{}).Dial(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Nil(t, conn.WritePacket([]byte("hello")))
+	b, err := conn.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), b)
+
+	// the psk is derived from the key, a client with another key fails the dtls handshake
+	client.Key = "other"
+	dialCtx, dialCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer dialCancel()
+	_, err = (&Transport{}).Dial(dialCtx, client)
+	assert.NotNil(t, err)
+}
@@ -1,6 +1,9 @@
 package dtls
 
 import (
+	"net"
+
+	"github.com/net-byte/vtun/common/config"
 	"github.com/pion/dtls/v2"
 )
 
@@ -20,3 +23,42 @@ func splitRead(conn *dtls.Conn, expectLen int, packet []byte) (int, error) {
 	}
 	return count, nil
 }
+
+// dtlsConn sends every packet as a single dtls record
+type dtlsConn struct {
+	conn   *dtls.Conn
+	buffer []byte
+}
+
+func newConn(config config.Config, conn *dtls.Conn) *dtlsConn {
+	return &dtlsConn{conn: conn, buffer: make([]byte, config.BufferSize)}
+}
+
+func (c *dtlsConn) ReadPacket() ([]byte, error) {
+	n, err := c.conn.Read(c.buffer)
+	if err != nil {
+		return nil, err
+	}
+	b := c.buffer[:n]
+	if n == 0 {
+		return b, nil
+	}
+	return b, nil
+}
+
+func (c *dtlsConn) WritePacket(b []byte) error {
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *dtlsConn) Datagram() bool {
+	return true
+}
+
+func (c *dtlsConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *dtlsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,37 @@
+package dtls
+
+import (
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/transport"
+	"github.com/pion/dtls/v2"
+)
+
+func init() {
+	transport.Register(&Transport{})
+}
+
+// Transport is the dtls transport
+type Transport struct{}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return "dtls"
+}
+
+// pskIdentityHint is sent in the clear during the dtls handshake, so it is not a secret
+var pskIdentityHint = []byte("vtun")
+
+// pskConfig returns the dtls config of the psk mode, the psk is derived from the shared key
+// so the dtls handshake does not expose the key of the session handshake
+func pskConfig(config config.Config) *dtls.Config {
+	psk := xcrypto.DeriveKey(config.Key, xcrypto.LabelDTLS, 32)
+	return &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return psk, nil
+		},
+		PSKIdentityHint:      pskIdentityHint,
+		CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256, dtls.TLS_PSK_WITH_AES_128_CCM_8},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+}
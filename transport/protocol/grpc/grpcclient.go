@@ -3,28 +3,32 @@ package grpc
 import (
 	"context"
 	"crypto/tls"
-	"log"
+	"net"
 	"time"
 
 	"github.com/net-byte/vtun/transport/protocol/grpc/proto"
 
-	"github.com/golang/snappy"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 
-	"github.com/net-byte/vtun/common/cache"
-	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/water"
+	"github.com/net-byte/vtun/transport"
+	"github.com/net-byte/vtun/transport/tunnel"
 )
 
-// StartClient starts the grpc client
-func StartClient(iface *water.Interface, config config.Config) {
-	log.Println("vtun grpc client started")
-	go tunToGrpc(config, iface)
+// StartClientForApi starts the grpc client on the given streams
+func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), onConfig func(config.Config), _ctx context.Context) {
+	tunnel.StartClientForApi(&Transport{}, config, outputStream, inputStream, writeCallback, readCallback, onConfig, _ctx)
+}
+
+// Dial connects to the grpc server and opens the tunnel stream
+func (t *Transport) Dial(ctx context.Context, config config.Config) (transport.Conn, error) {
+	addr, err := net.ResolveTCPAddr("tcp", config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 	}
@@ -39,83 +43,27 @@ func StartClient(iface *water.Interface, config config.Config) {
 		Timeout:             10 * time.Second, // wait 10 second for ping ack before considering the connection dead
 		PermitWithoutStream: true,             // send pings even without active streams
 	}
-	for {
-		conn, err := grpc.Dial(config.ServerAddr,
-			grpc.WithBlock(),
-			grpc.WithTransportCredentials(creds),
-			grpc.WithKeepaliveParams(heartbeat),
-		)
-		if err != nil {
-			time.Sleep(3 * time.Second)
-			netutil.PrintErr(err, config.Verbose)
-			continue
-		}
-		streamClient := proto.NewGrpcServeClient(conn)
-		stream, err := streamClient.Tunnel(context.Background())
-		if err != nil {
-			conn.Close()
-			netutil.PrintErr(err, config.Verbose)
-			continue
-		}
-		cache.GetCache().Set("grpcconn", stream, 24*time.Hour)
-		grpcToTun(config, stream, iface)
-		cache.GetCache().Delete("grpcconn")
-		conn.Close()
-	}
-}
-
-// tunToGrpc sends packets from tun to grpc
-func tunToGrpc(config config.Config, iface *water.Interface) {
-	packet := make([]byte, config.BufferSize)
-	for {
-		n, err := iface.Read(packet)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if v, ok := cache.GetCache().Get("grpcconn"); ok {
-			b := packet[:n]
-			if config.Obfs {
-				b = cipher.XOR(b)
-			}
-			if config.Compress {
-				b = snappy.Encode(nil, b)
-			}
-			grpcconn := v.(proto.GrpcServe_TunnelClient)
-			err = grpcconn.Send(&proto.PacketData{Data: b})
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				continue
-			}
-			counter.IncrWrittenBytes(n)
-		}
+	conn, err := grpc.DialContext(ctx, config.ServerAddr,
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(heartbeat),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return netutil.Dialer(config).DialContext(ctx, "tcp", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// grpcToTun sends packets from grpc to tun
-func grpcToTun(config config.Config, stream proto.GrpcServe_TunnelClient, iface *water.Interface) {
-	for {
-		packet, err := stream.Recv()
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		b := packet.Data[:]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				break
-			}
-		}
-		if config.Obfs {
-			b = cipher.XOR(b)
-		}
-		_, err = iface.Write(b)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		counter.IncrReadBytes(len(b))
+	streamCtx, cancel := context.WithCancel(ctx)
+	streamClient := proto.NewGrpcServeClient(conn)
+	stream, err := streamClient.Tunnel(streamCtx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
 	}
+	return newConn(stream, addr, func() error {
+		cancel()
+		return conn.Close()
+	}), nil
 }
@@ -0,0 +1,62 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/net-byte/vtun/transport/protocol/grpc/proto"
+)
+
+// packetStream is implemented by both sides of the tunnel stream
+type packetStream interface {
+	Send(*proto.PacketData) error
+	Recv() (*proto.PacketData, error)
+	Context() context.Context
+}
+
+// streamConn sends every packet as a message of the tunnel stream
+type streamConn struct {
+	stream packetStream
+	addr   net.Addr
+	closer func() error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newConn(stream packetStream, addr net.Addr, closer func() error) *streamConn {
+	return &streamConn{
+		stream: stream,
+		addr:   addr,
+		closer: closer,
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *streamConn) ReadPacket() ([]byte, error) {
+	packet, err := c.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	b := packet.Data
+	return b, nil
+}
+
+func (c *streamConn) WritePacket(b []byte) error {
+	return c.stream.Send(&proto.PacketData{Data: b})
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		if c.closer != nil {
+			err = c.closer()
+		}
+	})
+	return err
+}
@@ -1,34 +1,45 @@
 package grpc
 
 import (
-	"github.com/net-byte/vtun/transport/protocol/grpc/proto"
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"strings"
-	"time"
 
-	"github.com/golang/snappy"
+	"github.com/net-byte/vtun/transport/protocol/grpc/proto"
+
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 
-	"github.com/net-byte/vtun/common/cache"
-	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/counter"
-	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/water"
+	"github.com/net-byte/vtun/transport"
 )
 
 // The StreamService is the implementation of the StreamServer interface
 type StreamService struct {
 	proto.UnimplementedGrpcServeServer
-	config config.Config
-	iface  *water.Interface
+	config   config.Config
+	listener *transport.ChanListener
 }
 
 // Tunnel implements the StreamServer interface
 func (s *StreamService) Tunnel(srv proto.GrpcServe_TunnelServer) error {
-	toServer(srv, s.config, s.iface)
+	var addr net.Addr
+	if p, ok := peer.FromContext(srv.Context()); ok {
+		addr = p.Addr
+	}
+	conn := newConn(srv, addr, nil)
+	if !s.listener.Push(conn) {
+		return nil
+	}
+	// the stream ends when the handler returns
+	select {
+	case <-conn.done:
+	case <-srv.Context().Done():
+	}
 	return nil
 }
 
@@ -41,82 +52,35 @@ func GetHTTPServeMux() *http.ServeMux {
 	return mux
 }
 
-// StartServer starts the grpc server
-func StartServer(iface *water.Interface, config config.Config) {
-	log.Printf("vtun grpc server started on %v", config.LocalAddr)
+// Listen starts the grpc listener
+func (t *Transport) Listen(ctx context.Context, config config.Config) (transport.Listener, error) {
 	creds, err := credentials.NewServerTLSFromFile(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	mux := GetHTTPServeMux()
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
-	proto.RegisterGrpcServeServer(grpcServer, &StreamService{config: config, iface: iface})
-	go toClient(config, iface)
-	err = http.ListenAndServeTLS(config.LocalAddr, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
-			grpcServer.ServeHTTP(w, r)
-		} else {
-			mux.ServeHTTP(w, r)
-		}
-		return
-	}))
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", config.LocalAddr)
 	if err != nil {
-		log.Fatalf("grpc server error: %v", err)
+		return nil, err
 	}
-}
-
-// toClient sends packets from tun to grpc
-func toClient(config config.Config, iface *water.Interface) {
-	packet := make([]byte, config.BufferSize)
-	for {
-		n, err := iface.Read(packet)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		b := packet[:n]
-		if key := netutil.GetDstKey(b); key != "" {
-			if v, ok := cache.GetCache().Get(key); ok {
-				if config.Obfs {
-					b = cipher.XOR(b)
-				}
-				if config.Compress {
-					b = snappy.Encode(nil, b)
-				}
-				err := v.(proto.GrpcServe_TunnelServer).Send(&proto.PacketData{Data: b})
-				if err != nil {
-					cache.GetCache().Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+	mux := GetHTTPServeMux()
+	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
+				grpcServer.ServeHTTP(w, r)
+			} else {
+				mux.ServeHTTP(w, r)
 			}
-		}
+		}),
 	}
-}
-
-// toServer sends packets from grpc to tun
-func toServer(srv proto.GrpcServe_TunnelServer, config config.Config, iface *water.Interface) {
-	for {
-		packet, err := srv.Recv()
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
+	cl := transport.NewChanListener(ln.Addr(), srv.Close)
+	proto.RegisterGrpcServeServer(grpcServer, &StreamService{config: config, listener: cl})
+	go func() {
+		err := srv.ServeTLS(ln, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("grpc server error: %v", err)
+			cl.Close()
 		}
-		b := packet.Data[:]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				break
-			}
-		}
-		if config.Obfs {
-			b = cipher.XOR(b)
-		}
-		if key := netutil.GetSrcKey(b); key != "" {
-			cache.GetCache().Set(key, srv, 24*time.Hour)
-			iface.Write(b)
-			counter.IncrReadBytes(len(b))
-		}
-	}
+	}()
+	return transport.CloseOnDone(ctx, cl), nil
 }
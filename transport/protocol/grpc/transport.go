@@ -0,0 +1,15 @@
+package grpc
+
+import "github.com/net-byte/vtun/transport"
+
+func init() {
+	transport.Register(&Transport{})
+}
+
+// Transport is the grpc transport
+type Transport struct{}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return "grpc"
+}
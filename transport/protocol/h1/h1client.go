@@ -2,72 +2,40 @@ package h1
 
 import (
 	"context"
-	"github.com/net-byte/vtun/common/counter"
-	"github.com/net-byte/vtun/common/x/xtun"
-	"github.com/net-byte/vtun/transport/protocol/tcp"
-	"log"
 	"time"
 
-	"github.com/net-byte/vtun/common/cache"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/water"
+	"github.com/net-byte/vtun/transport"
+	"github.com/net-byte/vtun/transport/protocol/tcp"
+	"github.com/net-byte/vtun/transport/tunnel"
 )
 
-var _ctx context.Context
-var _cancel context.CancelFunc
+// StartClientForApi starts the h1 client on the given streams
+func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), onConfig func(config.Config), _ctx context.Context) {
+	t := &Transport{name: config.Protocol}
+	if t.name != "https" {
+		t.name = "http"
+	}
+	tunnel.StartClientForApi(t, config, outputStream, inputStream, writeCallback, readCallback, onConfig, _ctx)
+}
 
-func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
+// Dial connects to the h1 server
+func (t *Transport) Dial(ctx context.Context, config config.Config) (transport.Conn, error) {
 	var cl *Client
-	tcA := RandomStringByStringNonce(16, config.Key, 123)
-	tcB := RandomStringByStringNonce(32, config.Key, 456)
-	tcC := RandomStringByStringNonce(64, config.Key, 789)
-	ua := RandomUserAgent(config.Key)
-	if config.Protocol == "https" {
+	if t.name == "https" {
 		cl = NewTLSClient(config)
 	} else {
-		cl = NewClient(config.ServerAddr, config.Host)
+		cl = NewClient(config.ServerAddr, config.Host, netutil.Dialer(config))
 	}
-	cl.TokenCookieA = tcA
-	cl.TokenCookieB = tcB
-	cl.TokenCookieC = tcC
+	cl.TokenCookieA = RandomStringByStringNonce(16, config.Key, 123)
+	cl.TokenCookieB = RandomStringByStringNonce(32, config.Key, 456)
+	cl.TokenCookieC = RandomStringByStringNonce(64, config.Key, 789)
 	cl.Path = "/" + RandomStringByInt64(32, time.Now().UnixMilli())
-	cl.UserAgent = ua
-	go tcp.Tun2Conn(config, outputStream, _ctx, readCallback)
-	for xtun.ContextOpened(_ctx) {
-		conn, err := cl.Dial()
-		if err != nil {
-			time.Sleep(3 * time.Second)
-			netutil.PrintErr(err, config.Verbose)
-			continue
-		}
-		err = tcp.Handshake(config, conn)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			continue
-		}
-		cache.GetCache().Set(tcp.ConnTag, conn, 24*time.Hour)
-		tcp.Conn2Tun(config, conn, inputStream, _ctx, writeCallback)
-		cache.GetCache().Delete(tcp.ConnTag)
+	cl.UserAgent = RandomUserAgent(config.Key)
+	conn, err := cl.Dial()
+	if err != nil {
+		return nil, err
 	}
-}
-
-// StartClient starts the h1 client
-func StartClient(iFace *water.Interface, config config.Config) {
-	log.Println("vtun h1 client started")
-	_ctx, _cancel = context.WithCancel(context.Background())
-	outputStream := make(chan []byte, 3000)
-	go xtun.ReadFromTun(iFace, config, outputStream, _ctx, _cancel)
-	inputStream := make(chan []byte, 3000)
-	go xtun.WriteToTun(iFace, config, inputStream, _ctx, _cancel)
-	StartClientForApi(
-		config, outputStream, inputStream,
-		func(n int) { counter.IncrWrittenBytes(n) },
-		func(n int) { counter.IncrReadBytes(n) },
-		_ctx,
-	)
-}
-
-func Close() {
-	_cancel()
+	return tcp.NewConn(config, conn), nil
 }
@@ -1,27 +1,33 @@
 package h1
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/transport"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
-	"github.com/net-byte/water"
-	"log"
-	"net/http"
 )
 
-// StartServer starts the h1 server
-func StartServer(iFace *water.Interface, config config.Config) {
-	log.Printf("vtun h1 server started on %v", config.LocalAddr)
+// Listen starts the h1 listener
+func (t *Transport) Listen(ctx context.Context, config config.Config) (transport.Listener, error) {
 	webSrv := NewHandle(netutil.GetDefaultHttpHandleFunc())
 	webSrv.TokenCookieA = RandomStringByStringNonce(16, config.Key, 123)
 	webSrv.TokenCookieB = RandomStringByStringNonce(32, config.Key, 456)
 	webSrv.TokenCookieC = RandomStringByStringNonce(64, config.Key, 789)
-	http.Handle("/", webSrv)
-	srv := &http.Server{Addr: config.LocalAddr, Handler: nil}
-	go func(srv *http.Server) {
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", config.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Addr: config.LocalAddr, Handler: webSrv}
+	go func() {
 		var err error
-		if config.Protocol == "https" {
+		if t.name == "https" {
 			tlsConfig := &tls.Config{
 				MinVersion:       tls.VersionTLS13,
 				CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -35,22 +41,28 @@ func StartServer(iFace *water.Interface, config config.Config) {
 				},
 			}
 			srv.TLSConfig = tlsConfig
-			err = srv.ListenAndServeTLS(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+			err = srv.ServeTLS(ln, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
 		} else {
-			err = srv.ListenAndServe()
+			err = srv.Serve(ln)
 		}
-		if err != http.ErrServerClosed {
-			panic(err)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("h1 server error: %v", err)
+			webSrv.Close()
 		}
-	}(srv)
-	// server -> client
-	go tcp.ToClient(config, iFace)
-	// client -> server
-	for {
-		conn, err := webSrv.Accept()
-		if err != nil {
-			continue
+	}()
+	cl := transport.NewChanListener(ln.Addr(), func() error {
+		webSrv.Close()
+		return srv.Close()
+	})
+	go func() {
+		defer cl.Close()
+		for {
+			conn, err := webSrv.Accept()
+			if err != nil {
+				return
+			}
+			cl.Push(tcp.NewConn(config, conn))
 		}
-		go tcp.ToServer(config, conn, iFace)
-	}
+	}()
+	return transport.CloseOnDone(ctx, cl), nil
 }
@@ -2,6 +2,7 @@ package h1
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -28,12 +29,15 @@ func (dl dialer) GetProto() string {
 }
 func (dl dialer) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
 	client := &http.Client{
-		Timeout: timeout,
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dl.NetDialer.DialContext},
 	}
 	return client.Do(req)
 }
 func (dl dialer) DialTimeout(serverAddr string, timeout time.Duration) (net.Conn, error) {
-	return net.DialTimeout("tcp", serverAddr, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dl.NetDialer.DialContext(ctx, "tcp", serverAddr)
 }
 
 type Client struct {
@@ -49,6 +53,7 @@ type Client struct {
 	Timeout      time.Duration
 	Host         string
 	ServerAddr   string
+	NetDialer    *net.Dialer
 
 	Dialer NetDialer
 }
@@ -178,7 +183,7 @@ func (cl *Client) getRx(token string) (net.Conn, []byte, error) { //io.ReadClose
 	}
 }
 
-func NewClient(serverAddr, host string) *Client {
+func NewClient(serverAddr, host string, netDialer *net.Dialer) *Client {
 	if host == "" {
 		host = serverAddr
 	}
@@ -195,6 +200,7 @@ func NewClient(serverAddr, host string) *Client {
 		Timeout:      timeout,
 		Host:         host,
 		ServerAddr:   serverAddr,
+		NetDialer:    netDialer,
 	}
 	cl.Dialer = dialer(*cl)
 	return cl
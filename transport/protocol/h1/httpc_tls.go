@@ -1,8 +1,10 @@
 package h1
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
 	"net"
 	"net/http"
 	"time"
@@ -11,6 +13,7 @@ import (
 type dialerT struct {
 	Transport *http.Transport
 	TLSConfig *tls.Config
+	NetDialer *net.Dialer
 }
 
 func (dl *dialerT) GetProto() string {
@@ -26,7 +29,9 @@ func (dl *dialerT) Do(req *http.Request, timeout time.Duration) (*http.Response,
 }
 
 func (dl *dialerT) DialTimeout(host string, timeout time.Duration) (net.Conn, error) {
-	tx, err := net.DialTimeout("tcp", host, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tx, err := dl.NetDialer.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return nil, err
 	}
@@ -35,7 +40,7 @@ func (dl *dialerT) DialTimeout(host string, timeout time.Duration) (net.Conn, er
 }
 
 func NewTLSClient(config config.Config) *Client {
-	cl := NewClient(config.ServerAddr, config.Host)
+	cl := NewClient(config.ServerAddr, config.Host, netutil.Dialer(config))
 
 	tlsConfig := &tls.Config{
 		MinVersion:       tls.VersionTLS13,
@@ -57,11 +62,13 @@ func NewTLSClient(config config.Config) *Client {
 
 	Transport := &http.Transport{
 		TLSClientConfig: tlsConfig,
+		DialContext:     cl.NetDialer.DialContext,
 	}
 
 	cl.Dialer = &dialerT{
 		TLSConfig: tlsConfig,
 		Transport: Transport,
+		NetDialer: cl.NetDialer,
 	}
 
 	return cl
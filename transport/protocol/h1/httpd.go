@@ -47,6 +47,7 @@ type state struct {
 
 func NewHandle(handler http.Handler) *Server {
 	srv := &Server{
+		die:          make(chan struct{}),
 		states:       make(map[string]*state),
 		accepts:      make(chan net.Conn, 512),
 		TxMethod:     txMethod,
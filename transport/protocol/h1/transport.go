@@ -0,0 +1,18 @@
+package h1
+
+import "github.com/net-byte/vtun/transport"
+
+func init() {
+	transport.Register(&Transport{name: "http"})
+	transport.Register(&Transport{name: "https"})
+}
+
+// Transport is the h1 transport, https runs it over tls
+type Transport struct {
+	name string
+}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return t.name
+}
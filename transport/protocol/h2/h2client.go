@@ -4,29 +4,28 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"github.com/golang/snappy"
-	"github.com/net-byte/vtun/common/cache"
-	"github.com/net-byte/vtun/common/cipher"
+	"io"
+	"net"
+	"net/http"
+
 	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/vtun/common/x/xproto"
-	"github.com/net-byte/vtun/common/x/xtun"
-	"github.com/net-byte/water"
+	"github.com/net-byte/vtun/transport"
+	"github.com/net-byte/vtun/transport/tunnel"
 	"golang.org/x/net/http2"
-	"io"
-	"log"
-	"net/http"
-	"time"
 )
 
-const ConnTag = "h2conn"
-
-var _ctx context.Context
-var _cancel context.CancelFunc
+// StartClientForApi starts the h2 client on the given streams
+func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), onConfig func(config.Config), _ctx context.Context) {
+	tunnel.StartClientForApi(&Transport{}, config, outputStream, inputStream, writeCallback, readCallback, onConfig, _ctx)
+}
 
-func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
-	go tunToH2(config, outputStream, _ctx, readCallback)
+// Dial connects to the h2 server
+func (t *Transport) Dial(ctx context.Context, config config.Config) (transport.Conn, error) {
+	addr, err := net.ResolveTCPAddr("tcp", config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 	}
@@ -39,111 +38,22 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 		Client: &http.Client{
 			Transport: &http2.Transport{
 				TLSClientConfig: tlsConfig,
+				DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return (&tls.Dialer{NetDialer: netutil.Dialer(config), Config: cfg}).DialContext(ctx, network, addr)
+				},
 			},
 		},
 		Header: httpHeader,
 	}
-	for xtun.ContextOpened(_ctx) {
-		ctx, cancel := context.WithCancel(_ctx)
-		conn, resp, err := client.Connect(ctx, fmt.Sprintf("https://%s%s", config.ServerAddr, config.Path))
-		if err != nil {
-			cancel()
-			time.Sleep(3 * time.Second)
-			netutil.PrintErrF(config.Verbose, "Initiate conn: %s\n", err)
-			continue
-		}
-		if resp.StatusCode != http.StatusOK {
-			cancel()
-			time.Sleep(3 * time.Second)
-			netutil.PrintErrF(config.Verbose, "bad status code: %d\n", resp.StatusCode)
-			continue
-		}
-		cache.GetCache().Set(ConnTag, conn, 24*time.Hour)
-		h2ToTun(config, conn, inputStream, ctx, cancel, writeCallback)
-		cache.GetCache().Delete(ConnTag)
-		conn.Close()
-	}
-}
-
-// StartClient starts the h2 client
-func StartClient(iFace *water.Interface, config config.Config) {
-	log.Println("vtun h2 client started")
-	_ctx, _cancel = context.WithCancel(context.Background())
-	outputStream := make(chan []byte, 3000)
-	go xtun.ReadFromTun(iFace, config, outputStream, _ctx, _cancel)
-	inputStream := make(chan []byte, 3000)
-	go xtun.WriteToTun(iFace, config, inputStream, _ctx, _cancel)
-	StartClientForApi(
-		config, outputStream, inputStream,
-		func(n int) { counter.IncrWrittenBytes(n) },
-		func(n int) { counter.IncrReadBytes(n) },
-		_ctx,
-	)
-}
-
-// tunToH2 sends packets from tun to h2
-func tunToH2(config config.Config, outputStream <-chan []byte, _ctx context.Context, callback func(int)) {
-	header := make([]byte, xproto.HeaderLength)
-	for xtun.ContextOpened(_ctx) {
-		b := <-outputStream
-		if v, ok := cache.GetCache().Get(ConnTag); ok {
-			if config.Obfs {
-				b = cipher.XOR(b)
-			}
-			if config.Compress {
-				b = snappy.Encode(nil, b)
-			}
-			xproto.WriteLength(header, len(b))
-			conn := v.(*Conn)
-			n, err := conn.Write(xproto.Merge(header, b))
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				continue
-			}
-			callback(n)
-		}
+	conn, resp, err := client.Connect(ctx, fmt.Sprintf("https://%s%s", config.ServerAddr, config.Path))
+	if err != nil {
+		return nil, fmt.Errorf("initiate conn: %w", err)
 	}
-}
-
-// h2ToTun sends packets from h2 to tun
-func h2ToTun(config config.Config, conn *Conn, inputStream chan<- []byte, _ctx context.Context, _cancel context.CancelFunc, callback func(int)) {
-	defer _cancel()
-	buffer := make([]byte, config.BufferSize)
-	header := make([]byte, xproto.HeaderLength)
-	for xtun.ContextOpened(_ctx) {
-		n, err := conn.Read(header)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if n != xproto.HeaderLength {
-			netutil.PrintErrF(config.Verbose, "n %d != header_length %d\n", n, xproto.HeaderLength)
-			break
-		}
-		length := xproto.ReadLength(header)
-		count, err := conn.Read(buffer[:length])
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if count != length {
-			netutil.PrintErrF(config.Verbose, "count %d != length %d\n", count, length)
-			break
-		}
-		b := buffer[:count]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				break
-			}
-		}
-		if config.Obfs {
-			b = cipher.XOR(b)
-		}
-		inputStream <- xproto.Copy(b)
-		callback(n)
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
 	}
+	return newPacketConn(config, conn, addr), nil
 }
 
 type Client struct {
@@ -184,7 +94,3 @@ var defaultClient = Client{
 	Method: http.MethodPost,
 	Client: &http.Client{Transport: &http2.Transport{}},
 }
-
-func Close() {
-	_cancel()
-}
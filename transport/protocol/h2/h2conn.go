@@ -2,8 +2,13 @@ package h2
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"net"
 	"sync"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
 )
 
 type Conn struct {
@@ -39,3 +44,51 @@ func (c *Conn) Close() error {
 	c.cancel()
 	return c.wc.Close()
 }
+
+// packetConn sends every packet with a length header over a h2 stream
+type packetConn struct {
+	conn   *Conn
+	addr   net.Addr
+	header []byte
+	buffer []byte
+}
+
+func newPacketConn(config config.Config, conn *Conn, addr net.Addr) *packetConn {
+	return &packetConn{
+		conn:   conn,
+		addr:   addr,
+		header: make([]byte, xproto.HeaderLength),
+		buffer: make([]byte, config.BufferSize),
+	}
+}
+
+func (c *packetConn) ReadPacket() ([]byte, error) {
+	if _, err := io.ReadFull(c.conn, c.header); err != nil {
+		return nil, err
+	}
+	length := xproto.ReadLength(c.header)
+	if length > len(c.buffer) {
+		return nil, fmt.Errorf("length %d exceeds buffer size %d", length, len(c.buffer))
+	}
+	count, err := io.ReadFull(c.conn, c.buffer[:length])
+	if err != nil {
+		return nil, err
+	}
+	b := c.buffer[:count]
+	return b, nil
+}
+
+func (c *packetConn) WritePacket(b []byte) error {
+	header := make([]byte, xproto.HeaderLength)
+	xproto.WriteLength(header, len(b))
+	_, err := c.conn.Write(xproto.Merge(header, b))
+	return err
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *packetConn) Close() error {
+	return c.conn.Close()
+}
@@ -1,37 +1,44 @@
 package h2
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/golang/snappy"
-	"github.com/net-byte/vtun/common/cache"
-	"github.com/net-byte/vtun/common/cipher"
-	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/counter"
-	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/vtun/common/x/xproto"
-	"github.com/net-byte/water"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"time"
+	"net/netip"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/transport"
 )
 
-// StartServer starts the h2 server
-func StartServer(iFace *water.Interface, config config.Config) {
-	log.Printf("vtun h2 server started on %v", config.LocalAddr)
+// Listen starts the h2 listener
+func (t *Transport) Listen(ctx context.Context, config config.Config) (transport.Listener, error) {
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", config.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Addr: config.LocalAddr}
+	cl := transport.NewChanListener(ln.Addr(), srv.Close)
 	mux := http.NewServeMux()
 	mux.Handle(config.Path, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		ServeHTTP(writer, request, config, iFace)
+		ServeHTTP(writer, request, config, cl)
 	}))
-	srv := &http.Server{
-		Addr:    config.LocalAddr,
-		Handler: mux,
-	}
-	go toClient(config, iFace)
-	log.Fatal(srv.ListenAndServeTLS(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath))
+	srv.Handler = mux
+	go func() {
+		err := srv.ServeTLS(ln, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("h2 server error: %v", err)
+			cl.Close()
+		}
+	}()
+	return transport.CloseOnDone(ctx, cl), nil
 }
 
-func ServeHTTP(w http.ResponseWriter, r *http.Request, config config.Config, iFace *water.Interface) {
+// ServeHTTP hands the h2 stream to the listener and holds it open until the connection is closed
+func ServeHTTP(w http.ResponseWriter, r *http.Request, config config.Config, cl *transport.ChanListener) {
 	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusOK)
 	conn, err := Accept(w, r)
@@ -41,86 +48,14 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request, config config.Config, iFa
 		return
 	}
 	defer conn.Close()
-	toServer(conn, config, iFace)
-}
-
-// toClient sends packets from tun to h2
-func toClient(config config.Config, iFace *water.Interface) {
-	packet := make([]byte, config.BufferSize)
-	header := make([]byte, xproto.HeaderLength)
-	for {
-		n, err := iFace.Read(packet)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		b := packet[:n]
-		if key := netutil.GetDstKey(b); key != "" {
-			if v, ok := cache.GetCache().Get(key); ok {
-				if config.Obfs {
-					b = cipher.XOR(b)
-				}
-				if config.Compress {
-					b = snappy.Encode(nil, b)
-				}
-				xproto.WriteLength(header, len(b))
-				n, err = v.(*Conn).Write(xproto.Merge(header, b))
-				if err != nil {
-					cache.GetCache().Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
-			}
-		}
+	var addr net.Addr
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		addr = net.TCPAddrFromAddrPort(ap)
 	}
-}
-
-// toServer sends packets from h2 to tun
-func toServer(conn *Conn, config config.Config, iFace *water.Interface) {
-	defer conn.Close()
-	buffer := make([]byte, config.BufferSize)
-	header := make([]byte, xproto.HeaderLength)
-	for {
-		n, err := conn.Read(header)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if n != xproto.HeaderLength {
-			netutil.PrintErrF(config.Verbose, "n %d != header_length %d\n", n, xproto.HeaderLength)
-			break
-		}
-		length := xproto.ReadLength(header)
-		count, err := conn.Read(buffer[:length])
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if count != length {
-			netutil.PrintErrF(config.Verbose, "count %d != length %d\n", count, length)
-			break
-		}
-		b := buffer[:count]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				break
-			}
-		}
-		if config.Obfs {
-			b = cipher.XOR(b)
-		}
-		if key := netutil.GetSrcKey(b); key != "" {
-			cache.GetCache().Set(key, conn, 24*time.Hour)
-			_, err := iFace.Write(b)
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				return
-			}
-			counter.IncrReadBytes(xproto.HeaderLength + n)
-		}
+	if !cl.Push(newPacketConn(config, conn, addr)) {
+		return
 	}
+	<-r.Context().Done()
 }
 
 var ErrHTTP2NotSupported = fmt.Errorf("HTTP2 not supported")
@@ -0,0 +1,15 @@
+package h2
+
+import "github.com/net-byte/vtun/transport"
+
+func init() {
+	transport.Register(&Transport{})
+}
+
+// Transport is the h2 transport
+type Transport struct{}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return "h2"
+}
@@ -1,6 +1,11 @@
 package kcp
 
 import (
+	"fmt"
+	"net"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
 	"github.com/xtaci/kcp-go"
 )
 
@@ -20,3 +25,53 @@ func splitRead(session *kcp.UDPSession, expectLen int, packet []byte) (int, erro
 	}
 	return count, nil
 }
+
+// kcpConn sends every packet with a length header over a kcp session
+type kcpConn struct {
+	session *kcp.UDPSession
+	header  []byte
+	buffer  []byte
+}
+
+func newConn(config config.Config, session *kcp.UDPSession) *kcpConn {
+	return &kcpConn{
+		session: session,
+		header:  make([]byte, xproto.HeaderLength),
+		buffer:  make([]byte, config.BufferSize),
+	}
+}
+
+func (c *kcpConn) ReadPacket() ([]byte, error) {
+	n, err := splitRead(c.session, xproto.HeaderLength, c.header)
+	if err != nil {
+		return nil, err
+	}
+	if n != xproto.HeaderLength {
+		return nil, fmt.Errorf("n %d != header_length %d", n, xproto.HeaderLength)
+	}
+	length := xproto.ReadLength(c.header)
+	count, err := splitRead(c.session, length, c.buffer)
+	if err != nil {
+		return nil, err
+	}
+	if count != length || count <= 0 {
+		return nil, fmt.Errorf("count %d != length %d", count, length)
+	}
+	b := c.buffer[:count]
+	return b, nil
+}
+
+func (c *kcpConn) WritePacket(b []byte) error {
+	header := make([]byte, xproto.HeaderLength)
+	xproto.WriteLength(header, len(b))
+	_, err := c.session.Write(xproto.Merge(header, b))
+	return err
+}
+
+func (c *kcpConn) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+func (c *kcpConn) Close() error {
+	return c.session.Close()
+}
@@ -0,0 +1,15 @@
+package kcp
+
+import "github.com/net-byte/vtun/transport"
+
+func init() {
+	transport.Register(&Transport{})
+}
+
+// Transport is the kcp transport
+type Transport struct{}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return "kcp"
+}
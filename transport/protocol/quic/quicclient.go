@@ -3,28 +3,23 @@ package quic
 import (
 	"context"
 	"crypto/tls"
-	"log"
+	"net"
 	"time"
 
-	"github.com/golang/snappy"
-	"github.com/net-byte/water"
-	"github.com/quic-go/quic-go"
-
-	"github.com/net-byte/vtun/common/cache"
-	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/vtun/common/x/xproto"
-	"github.com/net-byte/vtun/common/x/xtun"
+	"github.com/net-byte/vtun/transport"
+	"github.com/net-byte/vtun/transport/tunnel"
+	"github.com/quic-go/quic-go"
 )
 
-const ConnTag = "stream"
-
-var _ctx context.Context
-var _cancel context.CancelFunc
+// StartClientForApi starts the quic client on the given streams
+func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), onConfig func(config.Config), _ctx context.Context) {
+	tunnel.StartClientForApi(&Transport{}, config, outputStream, inputStream, writeCallback, readCallback, onConfig, _ctx)
+}
 
-func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
+// Dial connects to the quic server and opens the packet stream
+func (t *Transport) Dial(ctx context.Context, config config.Config) (transport.Conn, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 		NextProtos:         []string{"vtun"},
@@ -32,111 +27,28 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
-	go tunToStream(config, outputStream, _ctx, writeCallback)
-	for xtun.ContextOpened(_ctx) {
-		conn, err := quic.DialAddr(_ctx, config.ServerAddr, tlsConfig, &quic.Config{
-			KeepAlivePeriod: 10 * time.Second,
-		})
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			time.Sleep(3 * time.Second)
-			continue
-		}
-		stream, err := conn.OpenStreamSync(context.Background())
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			conn.CloseWithError(quic.ApplicationErrorCode(0x01), "closed")
-			continue
-		}
-		cache.GetCache().Set(ConnTag, stream, 24*time.Hour)
-		streamToTun(config, stream, inputStream, _ctx, readCallback)
-		cache.GetCache().Delete(ConnTag)
+	addr, err := net.ResolveUDPAddr("udp", config.ServerAddr)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// StartClient starts the quic client
-func StartClient(iFace *water.Interface, config config.Config) {
-	log.Println("vtun quic client started")
-	_ctx, _cancel = context.WithCancel(context.Background())
-	outputStream := make(chan []byte, 3000)
-	go xtun.ReadFromTun(iFace, config, outputStream, _ctx, _cancel)
-	inputStream := make(chan []byte, 3000)
-	go xtun.WriteToTun(iFace, config, inputStream, _ctx, _cancel)
-	StartClientForApi(
-		config, outputStream, inputStream,
-		func(n int) { counter.IncrWrittenBytes(n) },
-		func(n int) { counter.IncrReadBytes(n) },
-		_ctx,
-	)
-}
-
-// tunToStream sends packets from tun to quic
-func tunToStream(config config.Config, outputStream <-chan []byte, _ctx context.Context, callback func(int)) {
-	header := make([]byte, xproto.HeaderLength)
-	for xtun.ContextOpened(_ctx) {
-		b := <-outputStream
-		if v, ok := cache.GetCache().Get(ConnTag); ok {
-			if config.Obfs {
-				b = cipher.XOR(b)
-			}
-			if config.Compress {
-				b = snappy.Encode(nil, b)
-			}
-			xproto.WriteLength(header, len(b))
-			session := v.(quic.Stream)
-			n, err := session.Write(xproto.Merge(header, b))
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				continue
-			}
-			callback(xproto.HeaderLength + n)
-		}
+	packetConn, err := netutil.ListenPacket(ctx, config)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// streamToTun sends packets from quic to tun
-func streamToTun(config config.Config, stream quic.Stream, inputStream chan<- []byte, _ctx context.Context, callback func(int)) {
-	buffer := make([]byte, config.BufferSize)
-	header := make([]byte, xproto.HeaderLength)
-	defer stream.Close()
-	for xtun.ContextOpened(_ctx) {
-		n, err := stream.Read(header)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if n != xproto.HeaderLength {
-			netutil.PrintErrF(config.Verbose, "n %d != header_length %d\n", n, xproto.HeaderLength)
-			break
-		}
-		length := xproto.ReadLength(header)
-		count, err := splitRead(stream, length, buffer)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if count != length || count <= 0 {
-			netutil.PrintErrF(config.Verbose, "count %d != length %d\n", count, length)
-			break
-		}
-		b := buffer[:count]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				netutil.PrintErr(err, config.Verbose)
-				break
-			}
-		}
-		if config.Obfs {
-			b = cipher.XOR(b)
-		}
-		c := make([]byte, len(b))
-		copy(c, b)
-		inputStream <- c
-		callback(n)
+	conn, err := quic.Dial(ctx, packetConn, addr, tlsConfig, &quic.Config{
+		KeepAlivePeriod: 10 * time.Second,
+	})
+	if err != nil {
+		packetConn.Close()
+		return nil, err
 	}
-}
-
-func Close() {
-	_cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(quic.ApplicationErrorCode(0x01), "closed")
+		packetConn.Close()
+		return nil, err
+	}
+	c := newConn(config, conn, stream, true)
+	c.packetConn = packetConn
+	return c, nil
 }
@@ -1,6 +1,11 @@
 package quic
 
 import (
+	"fmt"
+	"net"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
 	"github.com/quic-go/quic-go"
 )
 
@@ -20,3 +25,67 @@ func splitRead(stream quic.Stream, expectLen int, packet []byte) (int, error) {
 	}
 	return count, nil
 }
+
+// streamConn sends every packet with a length header over a quic stream
+type streamConn struct {
+	conn   quic.Connection
+	stream quic.Stream
+	client bool
+	header []byte
+	buffer []byte
+	// packetConn is the socket of the client which is not closed with conn
+	packetConn net.PacketConn
+}
+
+func newConn(config config.Config, conn quic.Connection, stream quic.Stream, client bool) *streamConn {
+	return &streamConn{
+		conn:   conn,
+		stream: stream,
+		client: client,
+		header: make([]byte, xproto.HeaderLength),
+		buffer: make([]byte, config.BufferSize),
+	}
+}
+
+func (c *streamConn) ReadPacket() ([]byte, error) {
+	n, err := splitRead(c.stream, xproto.HeaderLength, c.header)
+	if err != nil {
+		return nil, err
+	}
+	if n != xproto.HeaderLength {
+		return nil, fmt.Errorf("n %d != header_length %d", n, xproto.HeaderLength)
+	}
+	length := xproto.ReadLength(c.header)
+	count, err := splitRead(c.stream, length, c.buffer)
+	if err != nil {
+		return nil, err
+	}
+	if count != length || count <= 0 {
+		return nil, fmt.Errorf("count %d != length %d", count, length)
+	}
+	b := c.buffer[:count]
+	return b, nil
+}
+
+func (c *streamConn) WritePacket(b []byte) error {
+	header := make([]byte, xproto.HeaderLength)
+	xproto.WriteLength(header, len(b))
+	_, err := c.stream.Write(xproto.Merge(header, b))
+	return err
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *streamConn) Close() error {
+	c.stream.CancelRead(0)
+	err := c.stream.Close()
+	if c.client {
+		c.conn.CloseWithError(quic.ApplicationErrorCode(0x01), "closed")
+		if c.packetConn != nil {
+			c.packetConn.Close()
+		}
+	}
+	return err
+}
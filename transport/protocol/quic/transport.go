@@ -0,0 +1,15 @@
+package quic
+
+import "github.com/net-byte/vtun/transport"
+
+func init() {
+	transport.Register(&Transport{})
+}
+
+// Transport is the quic transport
+type Transport struct{}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return "quic"
+}
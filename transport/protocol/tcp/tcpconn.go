@@ -1,6 +1,15 @@
 package tcp
 
-import "net"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/transport"
+)
 
 func splitRead(conn net.Conn, expectLen int, packet []byte) (int, error) {
 	count := 0
@@ -18,3 +27,62 @@ func splitRead(conn net.Conn, expectLen int, packet []byte) (int, error) {
 	}
 	return count, nil
 }
+
+// tcpConn is the framing of the tcp family, every frame is a packet header followed by the packet
+type tcpConn struct {
+	conn   net.Conn
+	header []byte
+	buffer []byte
+}
+
+// NewConn returns the tcp framing on conn, it is shared by the tls, utls and http transports.
+func NewConn(config config.Config, conn net.Conn) transport.Conn {
+	return &tcpConn{
+		conn:   conn,
+		header: make([]byte, xproto.PacketHeaderLength),
+		buffer: make([]byte, config.BufferSize),
+	}
+}
+
+func (c *tcpConn) ReadPacket() ([]byte, error) {
+	n, err := io.ReadFull(c.conn, c.header)
+	if err != nil {
+		return nil, err
+	}
+	ph := xproto.ParsePacketHeader(c.header[:n])
+	if ph == nil {
+		return nil, errors.New("ph == nil")
+	}
+	if err = xproto.CheckVersion(ph.ProtocolVersion); err != nil {
+		return nil, err
+	}
+	if ph.Length > len(c.buffer) {
+		return nil, fmt.Errorf("frame length <%d> exceeds buffer size <%d>", ph.Length, len(c.buffer))
+	}
+	n, err = splitRead(c.conn, ph.Length, c.buffer[:ph.Length])
+	if err != nil {
+		return nil, err
+	}
+	if n != ph.Length {
+		return nil, errors.New(fmt.Sprintf("received length <%d> not equals <%d>!", n, ph.Length))
+	}
+	return c.buffer[:n], nil
+}
+
+func (c *tcpConn) WritePacket(b []byte) error {
+	ph := &xproto.PacketHeader{
+		ProtocolVersion: xproto.ProtocolVersion,
+		Length:          len(b),
+	}
+	// one write of the header and the packet, so that they share a tls record and a tcp segment
+	_, err := c.conn.Write(xproto.Merge(ph.Bytes(), b))
+	return err
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *tcpConn) Close() error {
+	return c.conn.Close()
+}
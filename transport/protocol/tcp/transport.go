@@ -0,0 +1,15 @@
+package tcp
+
+import "github.com/net-byte/vtun/transport"
+
+func init() {
+	transport.Register(&Transport{})
+}
+
+// Transport is the tcp transport
+type Transport struct{}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return "tcp"
+}
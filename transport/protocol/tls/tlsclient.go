@@ -3,21 +3,21 @@ package tls
 import (
 	"context"
 	"crypto/tls"
-	"github.com/net-byte/vtun/common/cache"
+
 	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/vtun/common/x/xtun"
+	"github.com/net-byte/vtun/transport"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
-	"github.com/net-byte/water"
-	"log"
-	"time"
+	"github.com/net-byte/vtun/transport/tunnel"
 )
 
-var _ctx context.Context
-var _cancel context.CancelFunc
+// StartClientForApi starts the tls client on the given streams
+func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), onConfig func(config.Config), _ctx context.Context) {
+	tunnel.StartClientForApi(&Transport{}, config, outputStream, inputStream, writeCallback, readCallback, onConfig, _ctx)
+}
 
-func StartClientForApi(config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), _ctx context.Context) {
+// Dial connects to the tls server
+func (t *Transport) Dial(ctx context.Context, config config.Config) (transport.Conn, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSInsecureSkipVerify,
 		MinVersion:         tls.VersionTLS13,
@@ -35,42 +35,13 @@ func StartClientForApi(config config.Config, outputStream <-chan []byte, inputSt
 	if config.TLSSni != "" {
 		tlsConfig.ServerName = config.TLSSni
 	}
-	go tcp.Tun2Conn(config, outputStream, _ctx, readCallback)
-	for xtun.ContextOpened(_ctx) {
-		conn, err := tls.Dial("tcp", config.ServerAddr, tlsConfig)
-		if err != nil {
-			time.Sleep(3 * time.Second)
-			netutil.PrintErr(err, config.Verbose)
-			continue
-		}
-		err = tcp.Handshake(config, conn)
-		if err != nil {
-			time.Sleep(3 * time.Second)
-			netutil.PrintErr(err, config.Verbose)
-			continue
-		}
-		cache.GetCache().Set(tcp.ConnTag, conn, 24*time.Hour)
-		tcp.Conn2Tun(config, conn, inputStream, _ctx, writeCallback)
-		cache.GetCache().Delete(tcp.ConnTag)
+	dialer := &tls.Dialer{
+		NetDialer: netutil.Dialer(config),
+		Config:    tlsConfig,
 	}
-}
-
-// StartClient starts the tls client
-func StartClient(iFace *water.Interface, config config.Config) {
-	log.Println("vtun tls client started")
-	_ctx, _cancel = context.WithCancel(context.Background())
-	outputStream := make(chan []byte, 3000)
-	go xtun.ReadFromTun(iFace, config, outputStream, _ctx, _cancel)
-	inputStream := make(chan []byte, 3000)
-	go xtun.WriteToTun(iFace, config, inputStream, _ctx, _cancel)
-	StartClientForApi(
-		config, outputStream, inputStream,
-		func(n int) { counter.IncrWrittenBytes(n) },
-		func(n int) { counter.IncrReadBytes(n) },
-		_ctx,
-	)
-}
-
-func Close() {
-	_cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	return tcp.NewConn(config, conn), nil
 }
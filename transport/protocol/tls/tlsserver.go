@@ -1,19 +1,22 @@
 package tls
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"net"
+
 	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/transport"
 	"github.com/net-byte/vtun/transport/protocol/tcp"
-	"github.com/net-byte/water"
-	"log"
 )
 
-// StartServer starts the tls server
-func StartServer(iFace *water.Interface, config config.Config) {
-	log.Printf("vtun tls server started on %v", config.LocalAddr)
+// Listen starts the tls listener
+func (t *Transport) Listen(ctx context.Context, config config.Config) (transport.Listener, error) {
 	cert, err := tls.LoadX509KeyPair(config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	tlsConfig := &tls.Config{
 		Certificates:     []tls.Certificate{cert},
@@ -31,27 +34,41 @@ func StartServer(iFace *water.Interface, config config.Config) {
 	}
 	ln, err := tls.Listen("tcp", config.LocalAddr, tlsConfig)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	// server -> client
-	go tcp.ToClient(config, iFace)
-	// client -> server
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			continue
-		}
-		sniffConn := NewPeekPreDataConn(conn)
-		switch sniffConn.Type {
-		case TypeHttp:
-			if sniffConn.Handle() {
-				continue
-			}
-		case TypeHttp2:
-			if sniffConn.Handle() {
+	return transport.CloseOnDone(ctx, Serve(config, ln)), nil
+}
+
+// Serve accepts the tls connections of ln and hands the tunnel ones to the returned listener,
+// the plain http requests are answered with the default http response.
+func Serve(config config.Config, ln net.Listener) transport.Listener {
+	cl := transport.NewChanListener(ln.Addr(), ln.Close)
+	go func() {
+		defer cl.Close()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				netutil.PrintErr(err, config.Verbose)
 				continue
 			}
+			go func() {
+				sniffConn := NewPeekPreDataConn(conn)
+				switch sniffConn.Type {
+				case TypeHttp:
+					if sniffConn.Handle() {
+						return
+					}
+				case TypeHttp2:
+					if sniffConn.Handle() {
+						return
+					}
+				}
+				cl.Push(tcp.NewConn(config, sniffConn))
+			}()
 		}
-		go tcp.ToServer(config, sniffConn, iFace)
-	}
+	}()
+	return cl
 }
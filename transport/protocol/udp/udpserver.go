@@ -1,140 +1,197 @@
 package udp
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
-	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
-	"github.com/net-byte/vtun/common/counter"
 	"github.com/net-byte/vtun/common/netutil"
-	"github.com/net-byte/water"
-	"github.com/patrickmn/go-cache"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/transport"
 )
 
-// Server the server struct
-type Server struct {
+// idleTimeout is the time after which a silent client is dropped
+const idleTimeout = 30 * time.Minute
+
+// maxPending is the number of clients waiting for the handshake reply, the packets of new clients are dropped beyond it
+const maxPending = 256
+
+// listener demultiplexes the packets of the udp socket by client address
+type listener struct {
+	*transport.ChanListener
 	config    config.Config
-	iFace     *water.Interface
 	localConn *net.UDPConn
-	connCache *cache.Cache
+	mu        sync.Mutex
+	conns     map[string]*serverConn
+	pending   int
+}
+
+// serverConn is the server side of a udp client
+type serverConn struct {
+	l       *listener
+	key     string
+	cliAddr *net.UDPAddr
+	packets chan []byte
+	done    chan struct{}
+	once    sync.Once
+	// replied is set by the first packet written to the client, the conn is pending until then
+	replied atomic.Bool
+	timer   *time.Timer
 }
 
-// StartServer starts the udp server
-func StartServer(iFace *water.Interface, config config.Config) {
-	log.Printf("vtun udp server started on %v", config.LocalAddr)
+// Listen starts the udp listener
+func (t *Transport) Listen(ctx context.Context, config config.Config) (transport.Listener, error) {
 	localAddr, err := net.ResolveUDPAddr("udp", config.LocalAddr)
 	if err != nil {
-		log.Fatalln("failed to get udp socket:", err)
+		return nil, err
 	}
 	conn, err := net.ListenUDP("udp", localAddr)
 	if err != nil {
-		log.Fatalln("failed to listen on udp socket:", err)
+		return nil, err
+	}
+	l := &listener{
+		ChanListener: transport.NewChanListener(conn.LocalAddr(), conn.Close),
+		config:       config,
+		localConn:    conn,
+		conns:        make(map[string]*serverConn),
 	}
-	defer conn.Close()
-	s := &Server{config: config, iFace: iFace, localConn: conn, connCache: cache.New(30*time.Minute, 10*time.Minute)}
-	go s.tunToUdp()
-	s.udpToTun()
+	go l.readLoop()
+	return transport.CloseOnDone(ctx, l), nil
 }
 
-// tunToUdp sends packets from tun to udp
-func (s *Server) tunToUdp() {
-	packet := make([]byte, s.config.BufferSize)
+// readLoop dispatches the received packets to the client connections
+func (l *listener) readLoop() {
+	defer l.closeConns()
+	defer l.Close()
+	packet := make([]byte, l.config.BufferSize)
 	for {
-		n, err := s.iFace.Read(packet)
+		n, cliAddr, err := l.localConn.ReadFromUDP(packet)
 		if err != nil {
-			netutil.PrintErr(err, s.config.Verbose)
-			break
-		}
-		b := packet[:n]
-		if key := netutil.GetDstKey(b); key != "" {
-			if v, ok := s.connCache.Get(key); ok {
-				if s.config.Obfs {
-					b = cipher.XOR(b)
-				}
-				if s.config.Compress {
-					b = snappy.Encode(nil, b)
-				}
-				_, err := s.localConn.WriteToUDP(b, v.(*net.UDPAddr))
-				if err != nil {
-					s.connCache.Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
+			netutil.PrintErr(err, l.config.Verbose)
+			continue
 		}
-	}
-}
-
-// udpToTun sends packets from udp to tun
-func (s *Server) udpToTun() {
-	packet := make([]byte, s.config.BufferSize)
-	for {
-		n, cliAddr, err := s.localConn.ReadFromUDP(packet)
-		if err != nil || n == 0 {
-			netutil.PrintErr(err, s.config.Verbose)
+		if n == 0 {
 			continue
 		}
-		b := packet[:n]
-		if s.config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				netutil.PrintErr(err, s.config.Verbose)
+		key := cliAddr.String()
+		l.mu.Lock()
+		c, ok := l.conns[key]
+		if !ok {
+			if l.pending >= maxPending {
+				l.mu.Unlock()
 				continue
 			}
+			c = &serverConn{l: l, key: key, cliAddr: cliAddr, packets: make(chan []byte, 1024), done: make(chan struct{})}
+			c.timer = time.AfterFunc(handshakeTimeout(l.config), c.expire)
+			l.conns[key] = c
+			l.pending++
 		}
-		if s.config.Obfs {
-			b = cipher.XOR(b)
+		l.mu.Unlock()
+		if !ok && !l.TryPush(c) {
+			select {
+			case <-l.Done():
+				return
+			default:
+				continue
+			}
 		}
-
-		cidrIP, _, err := net.ParseCIDR(s.config.CIDR)
-		if err != nil {
-			netutil.PrintErr(err, s.config.Verbose)
-			return
+		select {
+		case c.packets <- xproto.Copy(packet[:n]):
+		default:
+			// drop the packet if the client is too slow
 		}
+	}
+}
 
-		if dstKey := netutil.GetDstKey(b); dstKey != "" {
-			// the package come from vtun udp client in-code ping operation
-			if dstKey == "0.0.0.0" {
-				srcKey := netutil.GetSrcKey(b)
-				s.connCache.Set(srcKey, cliAddr, 24*time.Hour)
-				continue
-			}
+// closeConns closes the connections of all clients
+func (l *listener) closeConns() {
+	l.mu.Lock()
+	conns := make([]*serverConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
 
-			// the package come from vtun udp client, send to this vtun udp server
-			if dstKey == cidrIP.String() {
-				if key := netutil.GetSrcKey(b); key != "" {
-					s.iFace.Write(b)
-					s.connCache.Set(key, cliAddr, 24*time.Hour)
-					counter.IncrReadBytes(n)
-				}
-				continue
-			}
+// handshakeTimeout returns the time a client is given to complete the handshake
+func handshakeTimeout(config config.Config) time.Duration {
+	if config.Timeout > 0 {
+		return time.Duration(config.Timeout) * time.Second
+	}
+	return 30 * time.Second
+}
 
-			// the package come from vtun udp client, send to another client
-			if v, ok := s.connCache.Get(dstKey); ok {
-				_, err := s.localConn.WriteToUDP(b, v.(*net.UDPAddr))
-				if err != nil {
-					s.connCache.Delete(dstKey)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
-				continue
-			}
+// expire closes the client if the server did not reply to its handshake in time
+func (c *serverConn) expire() {
+	if !c.replied.Load() {
+		c.Close()
+	}
+}
 
+// reply marks the client as no longer pending
+func (c *serverConn) reply() {
+	c.l.mu.Lock()
+	defer c.l.mu.Unlock()
+	if c.replied.Swap(true) {
+		return
+	}
+	c.timer.Stop()
+	if c.l.conns[c.key] == c {
+		c.l.pending--
+	}
+}
 
-			// if reaches here the package is coming from them client but with other machine as destiny
-			// send to tun interface, if iptables configured it can masquarede and forward to the correct destiny
-			if key := netutil.GetSrcKey(b); key != "" {
-				s.iFace.Write(b)
-				s.connCache.Set(key, cliAddr, 24*time.Hour)
-				counter.IncrReadBytes(n)
-				continue
-			}
+func (c *serverConn) ReadPacket() ([]byte, error) {
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+		return nil, net.ErrClosed
+	case <-timer.C:
+		return nil, errors.New("udp client timeout " + c.key)
+	case b := <-c.packets:
+		return b, nil
+	}
+}
 
-			log.Printf("pkg ignored %s %s %s",cliAddr, cidrIP, dstKey)
-		}
+func (c *serverConn) WritePacket(b []byte) error {
+	if !c.replied.Load() {
+		c.reply()
 	}
+	_, err := c.l.localConn.WriteToUDP(b, c.cliAddr)
+	return err
+}
+
+func (c *serverConn) Datagram() bool {
+	return true
+}
+
+func (c *serverConn) RemoteAddr() net.Addr {
+	return c.cliAddr
+}
+
+func (c *serverConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.timer.Stop()
+		c.l.mu.Lock()
+		if c.l.conns[c.key] == c {
+			delete(c.l.conns, c.key)
+			if !c.replied.Swap(true) {
+				c.l.pending--
+			}
+		}
+		c.l.mu.Unlock()
+	})
+	return nil
 }
@@ -0,0 +1,71 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func listenTest(t *testing.T) (*listener, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := config.Config{LocalAddr: "127.0.0.1:0", BufferSize: 1500, Timeout: 1}
+	l, err := (&Transport{}).Listen(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.(*listener), cancel
+}
+
+func pendingConns(l *listener) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pending
+}
+
+func TestListener_Pending(t *testing.T) {
+	l, cancel := listenTest(t)
+	defer cancel()
+	client, err := net.DialUDP("udp", nil, l.localConn.LocalAddr().(*net.UDPAddr))
+	assert.Nil(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err)
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+	assert.Nil(t, conn.WritePacket([]byte("reply")))
+	assert.Equal(t, 0, pendingConns(l))
+
+	// the sources beyond maxPending are dropped without stalling the replied client
+	for i := 0; i < maxPending+16; i++ {
+		c, err := net.DialUDP("udp", nil, l.localConn.LocalAddr().(*net.UDPAddr))
+		assert.Nil(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte("hello"))
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool { return pendingConns(l) == maxPending }, time.Second, 10*time.Millisecond)
+	_, err = client.Write([]byte("again"))
+	assert.Nil(t, err)
+	b, err := conn.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), b)
+	b, err = conn.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("again"), b)
+
+	// the pending clients expire on the handshake timeout, the replied client is kept
+	assert.Eventually(t, func() bool { return pendingConns(l) == 0 }, 3*time.Second, 50*time.Millisecond)
+	l.mu.Lock()
+	assert.Len(t, l.conns, 1)
+	l.mu.Unlock()
+	pending, err := l.Accept()
+	assert.Nil(t, err)
+	for err == nil {
+		_, err = pending.ReadPacket()
+	}
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
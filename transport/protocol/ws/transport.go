@@ -0,0 +1,18 @@
+package ws
+
+import "github.com/net-byte/vtun/transport"
+
+func init() {
+	transport.Register(&Transport{name: "ws"})
+	transport.Register(&Transport{name: "wss"})
+}
+
+// Transport is the websocket transport, wss runs it over tls
+type Transport struct {
+	name string
+}
+
+// Name returns the protocol name
+func (t *Transport) Name() string {
+	return t.name
+}
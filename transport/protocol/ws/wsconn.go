@@ -0,0 +1,54 @@
+package ws
+
+import (
+	"net"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/net-byte/vtun/common/config"
+)
+
+// wsConn sends every packet as a binary websocket message
+type wsConn struct {
+	conn   net.Conn
+	config config.Config
+	state  ws.State
+	wmu    sync.Mutex
+}
+
+func newConn(config config.Config, conn net.Conn, state ws.State) *wsConn {
+	return &wsConn{conn: conn, config: config, state: state}
+}
+
+func (c *wsConn) ReadPacket() ([]byte, error) {
+	for {
+		b, op, err := wsutil.ReadData(c.conn, c.state)
+		if err != nil {
+			return nil, err
+		}
+		// the keepalive is in the session layer, the text messages of older clients are ignored
+		if op != ws.OpBinary {
+			continue
+		}
+		return b, nil
+	}
+}
+
+func (c *wsConn) WritePacket(b []byte) error {
+	return c.writeMessage(ws.OpBinary, b)
+}
+
+func (c *wsConn) writeMessage(op ws.OpCode, b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return wsutil.WriteMessage(c.conn, c.state, op, b)
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
@@ -1,44 +1,62 @@
 package ws
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
-	"github.com/golang/snappy"
-	"github.com/net-byte/vtun/common/cache"
-	"github.com/net-byte/vtun/common/cipher"
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/counter"
-	"github.com/net-byte/vtun/common/netutil"
 	"github.com/net-byte/vtun/register"
-	"github.com/net-byte/water"
+	"github.com/net-byte/vtun/transport"
 )
 
-// StartServer starts the ws server
-func StartServer(iFace *water.Interface, config config.Config) {
-	// server -> client
-	go toClient(config, iFace)
-	// client -> server
-	http.HandleFunc(config.Path, func(w http.ResponseWriter, r *http.Request) {
-		if !checkPermission(w, r, config) {
-			return
+// Listen starts the ws listener
+func (t *Transport) Listen(ctx context.Context, config config.Config) (transport.Listener, error) {
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", config.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Addr: config.LocalAddr}
+	cl := transport.NewChanListener(ln.Addr(), srv.Close)
+	srv.Handler = newServeMux(config, cl)
+	go func() {
+		var err error
+		if t.name == "wss" && config.TLSCertificateFilePath != "" && config.TLSCertificateKeyFilePath != "" {
+			err = srv.ServeTLS(ln, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("websocket server error: %v", err)
 		}
+		cl.Close()
+	}()
+	return transport.CloseOnDone(ctx, cl), nil
+}
+
+// newServeMux returns the http handlers of the ws server
+func newServeMux(config config.Config, cl *transport.ChanListener) *http.ServeMux {
+	mux := http.NewServeMux()
+	// client -> server
+	// the client is authenticated by the handshake of the session, no secret is sent with the upgrade
+	mux.HandleFunc(config.Path, func(w http.ResponseWriter, r *http.Request) {
 		wsconn, _, _, err := ws.UpgradeHTTP(r, w)
 		if err != nil {
 			log.Printf("[server] failed to upgrade http %v", err)
 			return
 		}
-		toServer(config, wsconn, iFace)
+		cl.Push(newConn(config, wsconn, ws.StateServerSide))
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("Content-Length", "6")
@@ -49,7 +67,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		w.Write([]byte(`follow`))
 	})
 
-	http.HandleFunc("/ip", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/ip", func(w http.ResponseWriter, req *http.Request) {
 		ip := req.Header.Get("X-Forwarded-For")
 		if ip == "" {
 			ip, _, _ = net.SplitHostPort(req.RemoteAddr)
@@ -58,7 +76,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, resp)
 	})
 
-	http.HandleFunc("/register/pick/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/pick/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -67,7 +85,22 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, resp)
 	})
 
-	http.HandleFunc("/register/delete/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/pick/ipv6", func(w http.ResponseWriter, r *http.Request) {
+		if !checkPermission(w, r, config) {
+			return
+		}
+		// the ipv6 is paired with the ipv4 picked before
+		ipv4 := net.ParseIP(r.URL.Query().Get("ip"))
+		if ipv4 == nil || ipv4.To4() == nil {
+			io.WriteString(w, "error")
+			return
+		}
+		ip, pl := register.LeaseClientIPv6(config.CIDRv6, ipv4.String(), "")
+		resp := fmt.Sprintf("%v/%v", ip, pl)
+		io.WriteString(w, resp)
+	})
+
+	mux.HandleFunc("/register/delete/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -78,7 +111,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, "OK")
 	})
 
-	http.HandleFunc("/register/keepalive/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/keepalive/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -89,14 +122,14 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, "OK")
 	})
 
-	http.HandleFunc("/register/list/ip", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/list/ip", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
 		io.WriteString(w, strings.Join(register.ListClientIPs(), "\r\n"))
 	})
 
-	http.HandleFunc("/register/prefix/ipv4", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/prefix/ipv4", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -110,7 +143,7 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, resp)
 	})
 
-	http.HandleFunc("/register/prefix/ipv6", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register/prefix/ipv6", func(w http.ResponseWriter, r *http.Request) {
 		if !checkPermission(w, r, config) {
 			return
 		}
@@ -124,88 +157,19 @@ func StartServer(iFace *water.Interface, config config.Config) {
 		io.WriteString(w, resp)
 	})
 
-	http.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, counter.PrintBytes(true))
 	})
-
-	log.Printf("vtun websocket server started on %v", config.LocalAddr)
-	if config.Protocol == "wss" && config.TLSCertificateFilePath != "" && config.TLSCertificateKeyFilePath != "" {
-		http.ListenAndServeTLS(config.LocalAddr, config.TLSCertificateFilePath, config.TLSCertificateKeyFilePath, nil)
-	} else {
-		http.ListenAndServe(config.LocalAddr, nil)
-	}
-
+	return mux
 }
 
-// checkPermission checks the permission of the request
+// checkPermission checks the admin key of the requests of the register api, which is disabled without admin key
 func checkPermission(w http.ResponseWriter, req *http.Request, config config.Config) bool {
-	if config.Key == "" {
-		return true
-	}
-	key := req.Header.Get("key")
-	if key != config.Key {
+	key, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if config.AdminKey == "" || !ok || subtle.ConstantTimeCompare([]byte(key), []byte(config.AdminKey)) != 1 {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("No permission"))
 		return false
 	}
 	return true
 }
-
-// toClient sends data to client
-func toClient(config config.Config, iFace *water.Interface) {
-	packet := make([]byte, config.BufferSize)
-	for {
-		n, err := iFace.Read(packet)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		b := packet[:n]
-		if key := netutil.GetDstKey(b); key != "" {
-			if v, ok := cache.GetCache().Get(key); ok {
-				if config.Obfs {
-					b = cipher.XOR(b)
-				}
-				if config.Compress {
-					b = snappy.Encode(nil, b)
-				}
-				err := wsutil.WriteServerBinary(v.(net.Conn), b)
-				if err != nil {
-					cache.GetCache().Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
-			}
-		}
-	}
-}
-
-// toServer sends data to server
-func toServer(config config.Config, wsconn net.Conn, iFace *water.Interface) {
-	defer wsconn.Close()
-	for {
-		b, op, err := wsutil.ReadClientData(wsconn)
-		if err != nil {
-			netutil.PrintErr(err, config.Verbose)
-			break
-		}
-		if op == ws.OpText {
-			if config.Verbose {
-				log.Println(string(b[:]))
-			}
-			wsutil.WriteServerMessage(wsconn, op, b)
-		} else if op == ws.OpBinary {
-			if config.Compress {
-				b, _ = snappy.Decode(nil, b)
-			}
-			if config.Obfs {
-				b = cipher.XOR(b)
-			}
-			if key := netutil.GetSrcKey(b); key != "" {
-				cache.GetCache().Set(key, wsconn, 24*time.Hour)
-				counter.IncrReadBytes(len(b))
-				iFace.Write(b)
-			}
-		}
-	}
-}
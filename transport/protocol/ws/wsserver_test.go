@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, mux *http.ServeMux, path string, header http.Header) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestServeMux_Permission(t *testing.T) {
+	cfg := config.Config{Key: "freedom", Path: "/freedom", CIDR: "172.16.0.1/24"}
+	cl := transport.NewChanListener(nil, nil)
+	mux := newServeMux(cfg, cl)
+
+	// the client upgrades without sending any key, the session handshake authenticates it
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := cfg
+	client.ServerAddr = srv.Listener.Addr().String()
+	client.Protocol = "ws"
+	conn := netutil.ConnectServer(context.Background(), client)
+	if assert.NotNil(t, conn) {
+		conn.Close()
+	}
+	_, err := cl.Accept()
+	assert.Nil(t, err)
+
+	// the register api is disabled without admin key, the shared key does not open it
+	assert.Equal(t, http.StatusForbidden, get(t, mux, "/register/prefix/ipv4", nil))
+	assert.Equal(t, http.StatusForbidden, get(t, mux, "/register/prefix/ipv4", http.Header{"Key": {"freedom"}}))
+
+	cfg.AdminKey = "admin"
+	mux = newServeMux(cfg, transport.NewChanListener(nil, nil))
+	assert.Equal(t, http.StatusForbidden, get(t, mux, "/register/prefix/ipv4", http.Header{"Authorization": {"Bearer freedom"}}))
+	assert.Equal(t, http.StatusOK, get(t, mux, "/register/prefix/ipv4", http.Header{"Authorization": {"Bearer admin"}}))
+}
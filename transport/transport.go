@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// Conn is a packet oriented connection established by a transport.
+// Every WritePacket sends one frame to the peer and every ReadPacket returns one frame.
+type Conn interface {
+	// ReadPacket reads the next frame, the returned slice is only valid until the next call.
+	ReadPacket() ([]byte, error)
+	// WritePacket writes b as a single frame, calls are serialized by the caller.
+	WritePacket(b []byte) error
+	// RemoteAddr returns the address of the peer.
+	RemoteAddr() net.Addr
+	// Close closes the connection.
+	Close() error
+}
+
+// Datagram is implemented by the connections of the transports which send every frame in one datagram,
+// their frames must then fit in the path mtu.
+type Datagram interface {
+	// Datagram reports whether every frame is sent in one datagram.
+	Datagram() bool
+}
+
+// Listener accepts the connections of a transport on the server side.
+type Listener interface {
+	// Accept waits for and returns the next connection.
+	Accept() (Conn, error)
+	// Addr returns the listener's network address.
+	Addr() net.Addr
+	// Close stops listening, any blocked Accept call returns an error.
+	Close() error
+}
+
+// Transport is the interface implemented by every vtun protocol.
+type Transport interface {
+	// Name returns the protocol name used by the -p flag.
+	Name() string
+	// Listen starts listening on config.LocalAddr, the listener is closed when the context is done.
+	Listen(ctx context.Context, config config.Config) (Listener, error)
+	// Dial connects to config.ServerAddr.
+	Dial(ctx context.Context, config config.Config) (Conn, error)
+}
+
+var (
+	mu         sync.RWMutex
+	transports = make(map[string]Transport)
+)
+
+// Register makes a transport available by its name, it panics if the name is already registered.
+func Register(t Transport) {
+	mu.Lock()
+	defer mu.Unlock()
+	if t == nil {
+		panic("transport: register transport is nil")
+	}
+	name := t.Name()
+	if _, dup := transports[name]; dup {
+		panic("transport: register called twice for transport " + name)
+	}
+	transports[name] = t
+}
+
+// Get returns the transport registered with the given name.
+func Get(name string) (Transport, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %q", name)
+	}
+	return t, nil
+}
+
+// Names returns the sorted names of the registered transports.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
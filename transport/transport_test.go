@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTransport struct{ name string }
+
+func (t *fakeTransport) Name() string { return t.name }
+
+func (t *fakeTransport) Listen(ctx context.Context, config config.Config) (Listener, error) {
+	return nil, nil
+}
+
+func (t *fakeTransport) Dial(ctx context.Context, config config.Config) (Conn, error) {
+	return nil, nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register(&fakeTransport{name: "fake-b"})
+	Register(&fakeTransport{name: "fake-a"})
+	tr, err := Get("fake-a")
+	assert.Nil(t, err)
+	assert.Equal(t, "fake-a", tr.Name())
+	_, err = Get("fake-c")
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"fake-a", "fake-b"}, Names())
+	assert.Panics(t, func() { Register(&fakeTransport{name: "fake-a"}) })
+}
+
+func TestCloseOnDone(t *testing.T) {
+	closed := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	l := CloseOnDone(ctx, NewChanListener(nil, func() error { close(closed); return nil }))
+	cancel()
+	<-closed
+	_, err := l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+type nopConn struct{ closed bool }
+
+func (c *nopConn) ReadPacket() ([]byte, error) { return nil, net.ErrClosed }
+func (c *nopConn) WritePacket(b []byte) error  { return nil }
+func (c *nopConn) RemoteAddr() net.Addr        { return nil }
+func (c *nopConn) Close() error                { c.closed = true; return nil }
+
+func TestChanListener_TryPush(t *testing.T) {
+	l := NewChanListener(nil, nil)
+	for i := 0; i < cap(l.conns); i++ {
+		assert.True(t, l.TryPush(&nopConn{}))
+	}
+	c := &nopConn{}
+	assert.False(t, l.TryPush(c))
+	assert.True(t, c.closed)
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+	assert.NotNil(t, conn)
+	assert.True(t, l.TryPush(&nopConn{}))
+	l.Close()
+	c = &nopConn{}
+	assert.False(t, l.TryPush(c))
+	assert.True(t, c.closed)
+}
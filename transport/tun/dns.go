@@ -0,0 +1,70 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xproto"
+)
+
+// resolvConf is the resolver configuration managed without systemd-resolved
+const resolvConf = "/etc/resolv.conf"
+
+var errNoResolved = errors.New("systemd-resolved is not available")
+
+// setDNS points the resolver of the system to the dns servers of the tunnel. In global mode every query goes to them,
+// otherwise only the queries of the search domains, which needs systemd-resolved. The previous settings are journaled.
+func setDNS(config config.Config, name string, execr *netutil.ExecCmdRecorder) error {
+	servers, err := xproto.ParseAddrs(config.DNS)
+	if err != nil {
+		return fmt.Errorf("invalid dns: %w", err)
+	}
+	domains, err := xproto.ParseDomains(config.DNSSearch)
+	if err != nil {
+		return fmt.Errorf("invalid dns search: %w", err)
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		log.Printf("dns is only supported on linux, ignored")
+		return nil
+	}
+	err = setResolved(execr, name, servers, domains, config.GlobalMode)
+	if !errors.Is(err, errNoResolved) {
+		return err
+	}
+	if !config.GlobalMode {
+		log.Printf("%v, dns is only set in global mode", err)
+		return nil
+	}
+	return setResolvConf(execr, resolvConf, servers, domains)
+}
+
+// setResolvConf replaces the resolver configuration path, its content is journaled to be restored
+func setResolvConf(execr *netutil.ExecCmdRecorder, path string, servers []netip.Addr, domains []string) error {
+	execr.Record("write " + path)
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("# generated by vtun, restored when it stops\n")
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(domains, " "))
+	}
+	if err = _journal.add(change{Kind: "file", Dst: path, Value: string(old)}); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/net-byte/vtun/common/netutil"
+	"golang.org/x/sys/unix"
+)
+
+const resolvedManager = "org.freedesktop.resolve1.Manager"
+
+// resolvedDNS and resolvedDomain are the arguments of SetLinkDNS and SetLinkDomains
+type resolvedDNS struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// setResolved sets the dns servers and search domains of the link name through systemd-resolved.
+// In global mode the link is the default route of the queries, errNoResolved is returned without the service.
+func setResolved(execr *netutil.ExecCmdRecorder, name string, servers []netip.Addr, domains []string, global bool) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNoResolved, err)
+	}
+	defer conn.Close()
+	resolved := conn.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")
+
+	var dns []resolvedDNS
+	for _, server := range servers {
+		family := unix.AF_INET
+		if server.Is6() {
+			family = unix.AF_INET6
+		}
+		dns = append(dns, resolvedDNS{Family: int32(family), Address: server.AsSlice()})
+	}
+	var search []resolvedDomain
+	for _, domain := range domains {
+		search = append(search, resolvedDomain{Domain: domain})
+	}
+	if global {
+		// the root routing domain routes every query to the link
+		search = append(search, resolvedDomain{Domain: ".", RoutingOnly: true})
+	}
+
+	execr.Record(fmt.Sprintf("resolved dns %s %v", name, servers))
+	c := change{Kind: "resolved", Dev: name}
+	if err = _journal.add(c); err != nil {
+		return err
+	}
+	err = resolved.Call(resolvedManager+".SetLinkDNS", 0, int32(index), dns).Err
+	if err != nil {
+		_journal.remove(c)
+		var dbusErr dbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+			return fmt.Errorf("%w: %v", errNoResolved, err)
+		}
+		return fmt.Errorf("set dns of %s: %w", name, err)
+	}
+	execr.Record(fmt.Sprintf("resolved domain %s %v", name, search))
+	if err = resolved.Call(resolvedManager+".SetLinkDomains", 0, int32(index), search).Err; err != nil {
+		return fmt.Errorf("set domains of %s: %w", name, err)
+	}
+	execr.Record(fmt.Sprintf("resolved default-route %s %v", name, global))
+	if err = resolved.Call(resolvedManager+".SetLinkDefaultRoute", 0, int32(index), global).Err; err != nil {
+		// the older versions route by the domains only
+		var dbusErr dbus.Error
+		if !errors.As(err, &dbusErr) || dbusErr.Name != "org.freedesktop.DBus.Error.UnknownMethod" {
+			return fmt.Errorf("set default route of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// revertResolved reverts the dns settings of the link name, systemd-resolved forgets them with a deleted link
+func revertResolved(execr *netutil.ExecCmdRecorder, name string) error {
+	execr.Record("resolved revert " + name)
+	c := change{Kind: "resolved", Dev: name}
+	index, err := linkIndex(name)
+	if err != nil {
+		return _journal.remove(c)
+	}
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resolved := conn.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")
+	if err = resolved.Call(resolvedManager+".RevertLink", 0, int32(index)).Err; err != nil {
+		return fmt.Errorf("revert dns of %s: %w", name, err)
+	}
+	return _journal.remove(c)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/net-byte/vtun/common/netutil"
+)
+
+// setResolved is only available on linux
+func setResolved(execr *netutil.ExecCmdRecorder, name string, servers []netip.Addr, domains []string, global bool) error {
+	return errNoResolved
+}
+
+func revertResolved(execr *netutil.ExecCmdRecorder, name string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,44 @@
+package tun
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resolv.conf")
+	assert.Nil(t, os.WriteFile(path, []byte("nameserver 192.168.1.1\n"), 0644))
+	defer func() { _journal = &journal{} }()
+
+	_journal = &journal{}
+	assert.Nil(t, OpenJournal(filepath.Join(dir, "vtun.state.json")))
+	execr := netutil.ExecCmdRecorder{}
+	servers := []netip.Addr{netip.MustParseAddr("172.16.0.1"), netip.MustParseAddr("fced:9999::1")}
+	assert.Nil(t, setResolvConf(&execr, path, servers, []string{"vpn", "corp.example.com"}))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "nameserver 172.16.0.1\nnameserver fced:9999::1\nsearch vpn corp.example.com\n")
+
+	// the previous configuration is restored with the routes
+	assert.Nil(t, RollbackJournal(&execr))
+	data, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "nameserver 192.168.1.1\n", string(data))
+	assert.Empty(t, _journal.changes)
+}
+
+func TestSetDNS(t *testing.T) {
+	execr := netutil.ExecCmdRecorder{}
+	// without dns servers the resolver is not changed
+	assert.Nil(t, setDNS(config.Config{DNSSearch: "vpn"}, "vtun-missing", &execr))
+	assert.Empty(t, execr.String())
+	assert.NotNil(t, setDNS(config.Config{DNS: "172.16.0.1/24"}, "vtun-missing", &execr))
+	assert.NotNil(t, setDNS(config.Config{DNS: "172.16.0.1", DNSSearch: "corp example"}, "vtun-missing", &execr))
+}
@@ -0,0 +1,281 @@
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/net-byte/vtun/common/netutil"
+)
+
+// change is a journaled change of the system routes or addresses with the way to revert it
+type change struct {
+	// Kind is route, addr or rule for the netlink changes which are deleted, nftables for the tables which are deleted,
+	// resolved for the dns settings of the link Dev, sysctl and file for the settings and files restored to Value
+	// and cmd for the changes reverted by Undo
+	Kind  string     `json:"kind"`
+	Dst   string     `json:"dst,omitempty"`
+	Dev   string     `json:"dev,omitempty"`
+	Table uint32     `json:"table,omitempty"`
+	Rule  *rule      `json:"rule,omitempty"`
+	Value string     `json:"value,omitempty"`
+	Undo  [][]string `json:"undo,omitempty"`
+}
+
+// equal reports whether the changes are the same
+func (c change) equal(x change) bool {
+	if (c.Rule == nil) != (x.Rule == nil) || c.Rule != nil && *c.Rule != *x.Rule {
+		return false
+	}
+	return c.Kind == x.Kind && c.Dst == x.Dst && c.Dev == x.Dev && c.Table == x.Table && c.Value == x.Value &&
+		slices.EqualFunc(c.Undo, x.Undo, slices.Equal[[]string])
+}
+
+// journal records the changes to a state file before they are applied, so they are reverted
+// after a crash by the next run or by the cleanup command. Its zero value keeps them in memory.
+// The lock file next to the state file is held while the journal is open, so two instances never share a state file.
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	lock    *os.File
+	changes []change
+}
+
+var _journal = &journal{}
+
+// OpenJournal reverts the changes left in the state file by a previous run which did not stop cleanly,
+// then records the changes of this run to it. It fails if another running instance uses the state file.
+func OpenJournal(path string) error {
+	if path == "" {
+		return nil
+	}
+	lock, err := lockStateFile(path)
+	if err != nil {
+		return err
+	}
+	if err = revertStateFile(path); err != nil {
+		lock.Close()
+		return err
+	}
+	_journal.mu.Lock()
+	defer _journal.mu.Unlock()
+	_journal.path, _journal.lock = path, lock
+	return nil
+}
+
+// CloseJournal releases the state file once the changes of this run are reverted
+func CloseJournal() error {
+	_journal.mu.Lock()
+	defer _journal.mu.Unlock()
+	if _journal.lock == nil {
+		return nil
+	}
+	err := _journal.lock.Close()
+	_journal.path, _journal.lock = "", nil
+	return err
+}
+
+// Cleanup reverts the changes left in the state file and removes it, it fails if a running instance uses the state file
+func Cleanup(path string) error {
+	if path == "" {
+		return nil
+	}
+	lock, err := lockStateFile(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	return revertStateFile(path)
+}
+
+// lockStateFile locks the lock file of the state file and writes the pid of this process to it,
+// it fails with the pid of the owner if another running instance holds it
+func lockStateFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		owner, _ := io.ReadAll(f)
+		f.Close()
+		return nil, fmt.Errorf("state file %s is used by the running vtun %s, choose another one with -state: %w",
+			path, strings.TrimSpace(string(owner)), err)
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// revertStateFile reverts the changes left in the state file and removes it, the caller holds its lock
+func revertStateFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var changes []change
+	if err = json.Unmarshal(data, &changes); err != nil {
+		return fmt.Errorf("state file %s: %w", path, err)
+	}
+	log.Printf("reverting %d changes left in %s", len(changes), path)
+	execr := netutil.ExecCmdRecorder{}
+	err = revert(&execr, changes)
+	log.Printf("revert commands:\n%s", execr.String())
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// RollbackJournal reverts the changes of this run
+func RollbackJournal(execr *netutil.ExecCmdRecorder) error {
+	_journal.mu.Lock()
+	changes := slices.Clone(_journal.changes)
+	_journal.mu.Unlock()
+	return revert(execr, changes)
+}
+
+// add records the change before it is applied
+func (j *journal) add(c change) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.changes = append(j.changes, c)
+	return j.save()
+}
+
+// has reports whether the change is recorded
+func (j *journal) has(c change) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.ContainsFunc(j.changes, c.equal)
+}
+
+// remove forgets the last record of the change once it is reverted or found to be applied before
+func (j *journal) remove(c change) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		if j.changes[i].equal(c) {
+			j.changes = slices.Delete(j.changes, i, i+1)
+			return j.save()
+		}
+	}
+	return nil
+}
+
+// save writes the changes to a temporary file which replaces the state file, the file is removed without changes
+func (j *journal) save() error {
+	if j.path == "" {
+		return nil
+	}
+	if len(j.changes) == 0 {
+		err := os.Remove(j.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(j.changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// revert reverts the changes from the last one
+func revert(execr *netutil.ExecCmdRecorder, changes []change) error {
+	var errs []error
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		switch c.Kind {
+		case "route", "addr":
+			dst, err := netip.ParsePrefix(c.Dst)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			errs = append(errs, withRtnl(execr, func(r *rtnl) error {
+				if c.Kind == "route" {
+					return r.DelRoute(dst, c.Dev, c.Table)
+				}
+				return r.DelAddr(c.Dev, dst)
+			}))
+		case "rule":
+			if c.Rule == nil {
+				errs = append(errs, errors.New("rule change without rule"))
+				continue
+			}
+			errs = append(errs, withRtnl(execr, func(r *rtnl) error {
+				return r.DelRule(*c.Rule)
+			}))
+		case "nftables":
+			errs = append(errs, delNftTable(execr, c.Dst))
+		case "sysctl":
+			execr.Record(fmt.Sprintf("sysctl %s=%s", c.Dst, c.Value))
+			if err := os.WriteFile(sysctlPath(c.Dst), []byte(c.Value), 0644); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			errs = append(errs, _journal.remove(c))
+		case "resolved":
+			errs = append(errs, revertResolved(execr, c.Dev))
+		case "file":
+			execr.Record("restore " + c.Dst)
+			if err := os.WriteFile(c.Dst, []byte(c.Value), 0644); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			errs = append(errs, _journal.remove(c))
+		case "cmd":
+			for _, cmd := range c.Undo {
+				if len(cmd) > 0 {
+					execr.ExecCmd(cmd[0], cmd[1:]...)
+				}
+			}
+			errs = append(errs, _journal.remove(c))
+		default:
+			errs = append(errs, fmt.Errorf("unknown change %q", c.Kind))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// execChange journals the undo commands, then executes the command
+func execChange(execr *netutil.ExecCmdRecorder, undo [][]string, c string, args ...string) {
+	if err := _journal.add(change{Kind: "cmd", Undo: undo}); err != nil {
+		log.Printf("failed to journal %s: %v", c, err)
+	}
+	execr.ExecCmd(c, args...)
+}
@@ -0,0 +1,78 @@
+package tun
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires touch")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vtun.state.json")
+	marker := filepath.Join(dir, "reverted")
+	defer func() { _journal = &journal{} }()
+
+	_journal = &journal{}
+	assert.Nil(t, OpenJournal(path))
+	execr := netutil.ExecCmdRecorder{}
+	execChange(&execr, [][]string{{"touch", marker}}, "true")
+	assert.FileExists(t, path)
+
+	// the process crashes, which releases the state file, the next run reverts the change
+	_journal.lock.Close()
+	_journal = &journal{}
+	assert.Nil(t, OpenJournal(path))
+	assert.FileExists(t, marker)
+	assert.NoFileExists(t, path)
+
+	// the change reverted by the run is forgotten
+	assert.Nil(t, os.Remove(marker))
+	execChange(&execr, [][]string{{"touch", marker}}, "true")
+	assert.Nil(t, RollbackJournal(&execr))
+	assert.FileExists(t, marker)
+	assert.NoFileExists(t, path)
+	assert.Empty(t, _journal.changes)
+	assert.Nil(t, CloseJournal())
+
+	assert.Nil(t, Cleanup(path))
+	assert.Nil(t, os.WriteFile(path, []byte("{"), 0644))
+	assert.NotNil(t, Cleanup(path))
+}
+
+func TestJournal_Lock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires touch")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vtun.state.json")
+	marker := filepath.Join(dir, "reverted")
+	defer func() { CloseJournal(); _journal = &journal{} }()
+
+	_journal = &journal{}
+	assert.Nil(t, OpenJournal(path))
+	execr := netutil.ExecCmdRecorder{}
+	execChange(&execr, [][]string{{"touch", marker}}, "true")
+	running := _journal
+
+	// another instance refuses the state file of the running one and leaves its changes
+	_journal = &journal{}
+	err := OpenJournal(path)
+	assert.ErrorContains(t, err, strconv.Itoa(os.Getpid()))
+	assert.NotNil(t, Cleanup(path))
+	assert.NoFileExists(t, marker)
+	assert.FileExists(t, path)
+
+	// the state file is free once the running instance stopped
+	_journal = running
+	assert.Nil(t, RollbackJournal(&execr))
+	assert.Nil(t, CloseJournal())
+	assert.Nil(t, OpenJournal(path))
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"golang.org/x/sys/unix"
+)
+
+// killSwitchTable is the nftables table of the kill switch
+const killSwitchTable = "vtun-killswitch"
+
+// resolveTimeout bounds the resolution of the server address
+const resolveTimeout = 5 * time.Second
+
+// localPrefixes are the destinations of the local links which the kill switch allows, like dhcp and the neighbor discovery
+var localPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff02::/16"),
+}
+
+// killSwitch is the kill switch installed by this run, it is only replaced when the interface or the server addresses change
+var killSwitch struct {
+	mu        sync.Mutex
+	installed bool
+	name      string
+	endpoints []netip.AddrPort
+}
+
+// nftRule is a rule of a chain and its nft syntax, which is recorded
+type nftRule struct {
+	text  string
+	exprs []expr.Any
+}
+
+// setKillSwitch rejects the packets which do not go out of the tun interface name, except the ones to the server,
+// of the sockets marked with the fwmark, to the excluded routes and to the local links, so no traffic leaks while the client connects.
+// The excluded routes bypass the tunnel by design, so they bypass the kill switch too.
+// It is installed before the first dial without the interface, then updated when the interface is created
+// and before every reconnection. The server address is resolved before the kill switch is installed, later with the
+// sockets marked with the fwmark, which the kill switch allows. Without fwmark, or if it cannot be resolved,
+// the previous addresses stay allowed.
+// The table is journaled, it stays after a crash until the next run or the cleanup command.
+func setKillSwitch(config config.Config, name string, execr *netutil.ExecCmdRecorder) error {
+	killSwitch.mu.Lock()
+	defer killSwitch.mu.Unlock()
+	endpoints, err := serverEndpoints(config)
+	if err != nil {
+		if !killSwitch.installed {
+			return err
+		}
+		if config.Verbose {
+			log.Printf("kill switch: %v, the previous server addresses stay allowed", err)
+		}
+		endpoints = killSwitch.endpoints
+	}
+	if killSwitch.installed && killSwitch.name == name && slices.Equal(killSwitch.endpoints, endpoints) {
+		return nil
+	}
+	excluded, err := ParseRoutes(config.ExcludeRoutes)
+	if err != nil {
+		return err
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables: %w", err)
+	}
+	execr.Record("nftables add table inet " + killSwitchTable)
+	table, chain := addNftTable(conn, killSwitchTable, &nftables.Chain{
+		Name:     "output",
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	for _, rule := range killSwitchRules(config, name, endpoints, excluded) {
+		execr.Record(fmt.Sprintf("nftables add rule inet %s output %s", killSwitchTable, rule.text))
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: rule.exprs})
+	}
+	if err = flushNftTable(conn, killSwitchTable); err != nil {
+		return err
+	}
+	killSwitch.installed, killSwitch.name, killSwitch.endpoints = true, name, endpoints
+	return nil
+}
+
+// resetKillSwitch forgets the kill switch once its table is deleted
+func resetKillSwitch() {
+	killSwitch.mu.Lock()
+	defer killSwitch.mu.Unlock()
+	killSwitch.installed, killSwitch.name, killSwitch.endpoints = false, "", nil
+}
+
+// killSwitchRules returns the rules of the output chain of the kill switch, the interface name is allowed if not empty
+func killSwitchRules(config config.Config, name string, endpoints []netip.AddrPort, excluded []netip.Prefix) []nftRule {
+	var rules []nftRule
+	accept := &expr.Verdict{Kind: expr.VerdictAccept}
+	add := func(text string, exprs []expr.Any, verdict expr.Any) {
+		rules = append(rules, nftRule{text: text, exprs: append(exprs, verdict)})
+	}
+	add("oifname lo accept", matchOutput("lo"), accept)
+	if name != "" {
+		add(fmt.Sprintf("oifname %s accept", name), matchOutput(name), accept)
+	}
+	if config.FwMark != 0 {
+		add(fmt.Sprintf("mark %#x accept", config.FwMark), matchMark(uint32(config.FwMark)), accept)
+	}
+	for _, endpoint := range endpoints {
+		add(fmt.Sprintf("tcp daddr %s accept", endpoint), matchEndpoint(endpoint, unix.IPPROTO_TCP), accept)
+		add(fmt.Sprintf("udp daddr %s accept", endpoint), matchEndpoint(endpoint, unix.IPPROTO_UDP), accept)
+	}
+	for _, p := range append(excluded, localPrefixes...) {
+		add(fmt.Sprintf("daddr %s accept", p), matchPrefix(p, false), accept)
+	}
+	// the other connections fail at once instead of timing out
+	add("reject", nil, &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED})
+	return rules
+}
+
+// serverEndpoints resolves the addresses of the server with the sockets marked with the fwmark
+func serverEndpoints(config config.Config) ([]netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server port %q", port)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := netutil.Resolver(config).LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []netip.AddrPort
+	for _, addr := range addrs {
+		endpoints = append(endpoints, netip.AddrPortFrom(addr.Unmap(), uint16(portNum)))
+	}
+	return endpoints, nil
+}
+
+// matchEndpoint matches the packets of the protocol to the address and port of the endpoint
+func matchEndpoint(endpoint netip.AddrPort, proto byte) []expr.Any {
+	exprs := matchPrefix(netip.PrefixFrom(endpoint.Addr(), endpoint.Addr().BitLen()), false)
+	return append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binary.BigEndian.AppendUint16(nil, endpoint.Port())},
+	)
+}
+
+// matchMark matches the packets of the sockets with the mark
+func matchMark(mark uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binary.NativeEndian.AppendUint32(nil, mark)},
+	}
+}
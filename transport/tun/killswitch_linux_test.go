@@ -0,0 +1,78 @@
+//go:build linux
+
+package tun
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestServerEndpoints(t *testing.T) {
+	endpoints, err := serverEndpoints(config.Config{ServerAddr: "127.0.0.1:3001"})
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:3001")}, endpoints)
+	endpoints, err = serverEndpoints(config.Config{ServerAddr: "[::1]:443"})
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("[::1]:443")}, endpoints)
+	_, err = serverEndpoints(config.Config{ServerAddr: "127.0.0.1"})
+	assert.NotNil(t, err)
+	_, err = serverEndpoints(config.Config{ServerAddr: "127.0.0.1:65536"})
+	assert.NotNil(t, err)
+}
+
+func TestKillSwitchRules(t *testing.T) {
+	cfg := config.Config{FwMark: 0x1a}
+	endpoints := []netip.AddrPort{netip.MustParseAddrPort("203.0.113.1:3001")}
+	excluded := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	var texts []string
+	for _, rule := range killSwitchRules(cfg, "vtun0", endpoints, excluded) {
+		texts = append(texts, rule.text)
+	}
+	assert.Equal(t, []string{
+		"oifname lo accept",
+		"oifname vtun0 accept",
+		"mark 0x1a accept",
+		"tcp daddr 203.0.113.1:3001 accept",
+		"udp daddr 203.0.113.1:3001 accept",
+		"daddr 10.0.0.0/8 accept",
+		"daddr 255.255.255.255/32 accept",
+		"daddr fe80::/10 accept",
+		"daddr ff02::/16 accept",
+		"reject",
+	}, texts)
+
+	// before the interface is created only the server and the local links are allowed
+	rules := killSwitchRules(config.Config{}, "", endpoints, nil)
+	texts = texts[:0]
+	for _, rule := range rules {
+		texts = append(texts, rule.text)
+	}
+	assert.Equal(t, []string{
+		"oifname lo accept",
+		"tcp daddr 203.0.113.1:3001 accept",
+		"udp daddr 203.0.113.1:3001 accept",
+		"daddr 255.255.255.255/32 accept",
+		"daddr fe80::/10 accept",
+		"daddr ff02::/16 accept",
+		"reject",
+	}, texts)
+
+	// every rule ends with its verdict, the last one rejects the rest
+	for _, rule := range rules[:len(rules)-1] {
+		assert.Equal(t, &expr.Verdict{Kind: expr.VerdictAccept}, rule.exprs[len(rule.exprs)-1], rule.text)
+	}
+	last := rules[len(rules)-1].exprs
+	assert.Len(t, last, 1)
+	assert.IsType(t, &expr.Reject{}, last[0])
+
+	// the endpoint rules match the address, the protocol and the port
+	exprs := rules[1].exprs
+	assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{203, 0, 113, 1}}, exprs[4])
+	assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}}, exprs[6])
+	assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x0b, 0xb9}}, exprs[8])
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package tun
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes the exclusive lock of the file without waiting, it is released when the file is closed or the process exits
+func lockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
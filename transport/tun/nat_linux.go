@@ -0,0 +1,74 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+)
+
+// natTable is the nftables table of the masquerade rules
+const natTable = "vtun"
+
+// SetNAT enables the ip forwarding and masquerades the client addresses out of the default route interface.
+// The changes are journaled, so they are reverted with the routes.
+func SetNAT(config config.Config) error {
+	execr := netutil.ExecCmdRecorder{}
+	err := setNAT(&execr, config)
+	if config.Verbose {
+		log.Printf("set nat commands:\n%s", execr.String())
+	}
+	return err
+}
+
+func setNAT(execr *netutil.ExecCmdRecorder, config config.Config) error {
+	oif, err := netutil.DefaultRouteInterface()
+	if err != nil {
+		return fmt.Errorf("default route interface: %w", err)
+	}
+	var prefixes []netip.Prefix
+	for _, cidr := range []string{config.CIDR, config.CIDRv6} {
+		if cidr == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	for _, p := range prefixes {
+		key := "net.ipv4.ip_forward"
+		if p.Addr().Is6() {
+			key = "net.ipv6.conf.all.forwarding"
+		}
+		execr.Record(fmt.Sprintf("sysctl %s=1", key))
+		if err = setSysctl(key, "1"); err != nil {
+			return err
+		}
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables: %w", err)
+	}
+	execr.Record("nftables add table inet " + natTable)
+	table, chain := addNftTable(conn, natTable, &nftables.Chain{
+		Name:     "postrouting",
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	for _, p := range prefixes {
+		execr.Record(fmt.Sprintf("nftables add rule inet %s postrouting saddr %s oifname %s masquerade", natTable, p, oif))
+		exprs := append(matchPrefix(p, true), matchOutput(oif)...)
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: append(exprs, &expr.Masq{})})
+	}
+	return flushNftTable(conn, natTable)
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package tun
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetNAT(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := netutil.DefaultRouteInterface(); err != nil {
+		t.Skipf("no default route: %v", err)
+	}
+	conn, err := nftables.New()
+	assert.Nil(t, err)
+	if natTableOf(t, conn) != nil {
+		t.Skip("the nat table is in use")
+	}
+	forward, err := os.ReadFile(sysctlPath("net.ipv4.ip_forward"))
+	assert.Nil(t, err)
+
+	execr := netutil.ExecCmdRecorder{}
+	// setting twice replaces the table
+	for i := 0; i < 2; i++ {
+		err = setNAT(&execr, config.Config{CIDR: "198.18.0.1/24"})
+		if err != nil && strings.Contains(err.Error(), "nftables") {
+			RollbackJournal(&execr)
+			t.Skipf("nftables is not available: %v", err)
+		}
+		assert.Nil(t, err)
+	}
+	table := natTableOf(t, conn)
+	assert.NotNil(t, table)
+	rules, err := conn.GetRules(table, &nftables.Chain{Name: "postrouting", Table: table})
+	assert.Nil(t, err)
+	assert.Len(t, rules, 1)
+	assert.Contains(t, _journal.changes, change{Kind: "nftables", Dst: natTable})
+	assert.Contains(t, execr.String(), "saddr 198.18.0.0/24")
+
+	// the table and the forwarding are reverted with the routes
+	assert.Nil(t, RollbackJournal(&execr))
+	assert.Nil(t, natTableOf(t, conn))
+	restored, _ := os.ReadFile(sysctlPath("net.ipv4.ip_forward"))
+	assert.Equal(t, string(forward), string(restored))
+	assert.Nil(t, delNftTable(&execr, natTable))
+}
+
+func natTableOf(t *testing.T, conn *nftables.Conn) *nftables.Table {
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		t.Skipf("nftables is not available: %v", err)
+	}
+	for _, table := range tables {
+		if table.Name == natTable {
+			return table
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/net-byte/vtun/common/netutil"
+	"golang.org/x/sys/unix"
+)
+
+// rtnl configures the links, addresses and routes through rtnetlink.
+// Adding what exists and deleting what is missing are not errors, so every call is idempotent.
+// The added addresses and routes are journaled before they are applied.
+type rtnl struct {
+	conn  *rtnetlink.Conn
+	execr *netutil.ExecCmdRecorder
+}
+
+// dialRtnl opens a rtnetlink connection, the requests are recorded to execr
+func dialRtnl(execr *netutil.ExecCmdRecorder) (*rtnl, error) {
+	conn, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return nil, fmt.Errorf("rtnetlink: %w", err)
+	}
+	return &rtnl{conn: conn, execr: execr}, nil
+}
+
+func (r *rtnl) Close() error {
+	return r.conn.Close()
+}
+
+// linkIndex returns the index of the link name
+func linkIndex(name string) (uint32, error) {
+	iFace, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(iFace.Index), nil
+}
+
+// SetLink sets the mtu of the link name and brings it up
+func (r *rtnl) SetLink(name string, mtu int) error {
+	r.execr.Record(fmt.Sprintf("netlink link set dev %s mtu %d up", name, mtu))
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	rx, err := r.conn.Link.Get(index)
+	if err != nil {
+		return fmt.Errorf("get link %s: %w", name, err)
+	}
+	err = r.conn.Link.Set(&rtnetlink.LinkMessage{
+		Family: unix.AF_UNSPEC,
+		Type:   rx.Type,
+		Index:  index,
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+		Attributes: &rtnetlink.LinkAttributes{
+			// the name, type and qdisc are always encoded
+			Name:      rx.Attributes.Name,
+			MTU:       uint32(mtu),
+			Type:      rx.Attributes.Type,
+			QueueDisc: rx.Attributes.QueueDisc,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("set link %s: %w", name, err)
+	}
+	return nil
+}
+
+// AddAddr adds the address prefix to the link name
+func (r *rtnl) AddAddr(name string, prefix netip.Prefix) error {
+	r.execr.Record(fmt.Sprintf("netlink addr add %s dev %s", prefix, name))
+	msg, err := addrMessage(name, prefix)
+	if err != nil {
+		return err
+	}
+	c := change{Kind: "addr", Dst: prefix.String(), Dev: name}
+	if err = _journal.add(c); err != nil {
+		return err
+	}
+	if err = r.conn.Address.New(msg); err != nil {
+		// the address which was there is not reverted
+		_journal.remove(c)
+		if errors.Is(err, unix.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("add address %s to %s: %w", prefix, name, err)
+	}
+	return nil
+}
+
+// DelAddr deletes the address prefix from the link name
+func (r *rtnl) DelAddr(name string, prefix netip.Prefix) error {
+	r.execr.Record(fmt.Sprintf("netlink addr del %s dev %s", prefix, name))
+	c := change{Kind: "addr", Dst: prefix.String(), Dev: name}
+	msg, err := addrMessage(name, prefix)
+	if err != nil {
+		// the addresses of a deleted link are gone with it
+		return _journal.remove(c)
+	}
+	if err = r.conn.Address.Delete(msg); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+		return fmt.Errorf("delete address %s from %s: %w", prefix, name, err)
+	}
+	return _journal.remove(c)
+}
+
+func addrMessage(name string, prefix netip.Prefix) (*rtnetlink.AddressMessage, error) {
+	index, err := linkIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	family := unix.AF_INET
+	if prefix.Addr().Is6() {
+		family = unix.AF_INET6
+	}
+	return &rtnetlink.AddressMessage{
+		Family:       uint8(family),
+		PrefixLength: uint8(prefix.Bits()),
+		Scope:        unix.RT_SCOPE_UNIVERSE,
+		Index:        index,
+		Attributes: &rtnetlink.AddressAttributes{
+			Address: prefix.Addr().AsSlice(),
+			Local:   prefix.Addr().AsSlice(),
+		},
+	}, nil
+}
+
+// AddRoute routes dst to the link name of the table, through gateway if it is valid, the table 0 is the main one
+func (r *rtnl) AddRoute(dst netip.Prefix, gateway netip.Addr, name string, table uint32) error {
+	if gateway.IsValid() {
+		r.execr.Record(fmt.Sprintf("netlink route add %s via %s dev %s table %d", dst, gateway, name, table))
+	} else {
+		r.execr.Record(fmt.Sprintf("netlink route add %s dev %s table %d", dst, name, table))
+	}
+	msg := routeMessage(dst, table)
+	if name != "" {
+		index, err := linkIndex(name)
+		if err != nil {
+			return err
+		}
+		msg.Attributes.OutIface = index
+	}
+	msg.Protocol = unix.RTPROT_BOOT
+	msg.Type = unix.RTN_UNICAST
+	msg.Scope = unix.RT_SCOPE_LINK
+	if gateway.IsValid() {
+		msg.Scope = unix.RT_SCOPE_UNIVERSE
+		msg.Attributes.Gateway = gateway.AsSlice()
+	}
+	c := change{Kind: "route", Dst: dst.Masked().String(), Dev: name, Table: table}
+	if err := _journal.add(c); err != nil {
+		return err
+	}
+	if err := r.conn.Route.Add(msg); err != nil {
+		// the route which was there is not reverted
+		_journal.remove(c)
+		if errors.Is(err, unix.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("add route %s: %w", dst, err)
+	}
+	return nil
+}
+
+// DelRoute deletes the route of dst of the table, on the link name if it is not empty
+func (r *rtnl) DelRoute(dst netip.Prefix, name string, table uint32) error {
+	r.execr.Record(fmt.Sprintf("netlink route del %s table %d", dst, table))
+	c := change{Kind: "route", Dst: dst.Masked().String(), Dev: name, Table: table}
+	msg := routeMessage(dst, table)
+	if name != "" {
+		index, err := linkIndex(name)
+		if err != nil {
+			// the routes of a deleted link are gone with it
+			return _journal.remove(c)
+		}
+		msg.Attributes.OutIface = index
+	}
+	// like ip route del, any scope matches
+	msg.Scope = unix.RT_SCOPE_NOWHERE
+	if err := r.conn.Route.Delete(msg); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("delete route %s: %w", dst, err)
+	}
+	return _journal.remove(c)
+}
+
+func routeMessage(dst netip.Prefix, table uint32) *rtnetlink.RouteMessage {
+	dst = dst.Masked()
+	family := unix.AF_INET
+	if dst.Addr().Is6() {
+		family = unix.AF_INET6
+	}
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	msg := &rtnetlink.RouteMessage{
+		Family:    uint8(family),
+		Table:     unix.RT_TABLE_UNSPEC,
+		DstLength: uint8(dst.Bits()),
+		Attributes: rtnetlink.RouteAttributes{
+			Dst:   dst.Addr().AsSlice(),
+			Table: table,
+		},
+	}
+	// the header only holds the tables below 256
+	if table < 256 {
+		msg.Table = uint8(table)
+	}
+	return msg
+}
+
+// AddRule adds the policy routing rule
+func (r *rtnl) AddRule(ru rule) error {
+	r.execr.Record("netlink rule add " + ru.String())
+	c := change{Kind: "rule", Rule: &ru}
+	if err := _journal.add(c); err != nil {
+		return err
+	}
+	if err := r.conn.Rule.Add(ruleMessage(ru)); err != nil {
+		// the rule which was there is not reverted
+		_journal.remove(c)
+		if errors.Is(err, unix.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("add rule %s: %w", ru, err)
+	}
+	return nil
+}
+
+// DelRule deletes the policy routing rule
+func (r *rtnl) DelRule(ru rule) error {
+	r.execr.Record("netlink rule del " + ru.String())
+	if err := r.conn.Rule.Delete(ruleMessage(ru)); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("delete rule %s: %w", ru, err)
+	}
+	return _journal.remove(change{Kind: "rule", Rule: &ru})
+}
+
+func ruleMessage(ru rule) *rtnetlink.RuleMessage {
+	family := unix.AF_INET
+	if ru.IPv6 {
+		family = unix.AF_INET6
+	}
+	msg := &rtnetlink.RuleMessage{
+		Family: uint8(family),
+		Table:  unix.RT_TABLE_UNSPEC,
+		Action: unix.FR_ACT_TO_TBL,
+		Attributes: &rtnetlink.RuleAttributes{
+			Table:    &ru.Table,
+			Priority: &ru.Priority,
+		},
+	}
+	if ru.Table < 256 {
+		msg.Table = uint8(ru.Table)
+	}
+	if ru.Mark != 0 {
+		mask := uint32(0xffffffff)
+		msg.Attributes.FwMark = &ru.Mark
+		msg.Attributes.FwMask = &mask
+	}
+	if ru.Invert {
+		msg.Flags = unix.FIB_RULE_INVERT
+	}
+	if ru.Suppress {
+		suppress := uint32(0)
+		msg.Attributes.SuppressPrefixLen = &suppress
+	}
+	return msg
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package tun
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/water"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTun creates a tun interface, the test is skipped without the privilege
+func newTestTun(t *testing.T) *water.Interface {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	iFace, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		t.Skipf("failed to create tun interface: %v", err)
+	}
+	t.Cleanup(func() { iFace.Close() })
+	return iFace
+}
+
+func TestRtnl(t *testing.T) {
+	iFace := newTestTun(t)
+	execr := netutil.ExecCmdRecorder{}
+	r, err := dialRtnl(&execr)
+	assert.Nil(t, err)
+	defer r.Close()
+
+	assert.Nil(t, r.SetLink(iFace.Name(), 1400))
+	link, err := net.InterfaceByName(iFace.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, 1400, link.MTU)
+	assert.NotZero(t, link.Flags&net.FlagUp)
+
+	addr := netip.MustParsePrefix("198.18.0.10/24")
+	addrv6 := netip.MustParsePrefix("fd00:198:18::10/64")
+	// adding twice is not an error
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, r.AddAddr(iFace.Name(), addr))
+		assert.Nil(t, r.AddAddr(iFace.Name(), addrv6))
+	}
+	addrs, _ := link.Addrs()
+	var got []string
+	for _, a := range addrs {
+		got = append(got, a.String())
+	}
+	assert.Contains(t, got, "198.18.0.10/24")
+
+	route := netip.MustParsePrefix("198.19.1.0/24")
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, r.AddRoute(route, netip.Addr{}, iFace.Name(), 0))
+	}
+	assert.True(t, hasRoute(t, r, route))
+	assert.Contains(t, _journal.changes, change{Kind: "route", Dst: route.String(), Dev: iFace.Name()})
+	// deleting twice is not an error
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, r.DelRoute(route, iFace.Name(), 0))
+		assert.Nil(t, r.DelAddr(iFace.Name(), addr))
+	}
+	assert.False(t, hasRoute(t, r, route))
+	assert.NotContains(t, _journal.changes, change{Kind: "route", Dst: route.String(), Dev: iFace.Name()})
+
+	assert.NotNil(t, r.AddAddr("vtun-missing", addr))
+	assert.Contains(t, execr.String(), "netlink route add 198.19.1.0/24 dev "+iFace.Name())
+}
+
+func hasRoute(t *testing.T, r *rtnl, dst netip.Prefix) bool {
+	routes, err := r.conn.Route.List()
+	assert.Nil(t, err)
+	for _, route := range routes {
+		addr, ok := netip.AddrFromSlice(route.Attributes.Dst)
+		if ok && netip.PrefixFrom(addr.Unmap(), int(route.DstLength)) == dst {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRtnlRule(t *testing.T) {
+	iFace := newTestTun(t)
+	execr := netutil.ExecCmdRecorder{}
+	r, err := dialRtnl(&execr)
+	assert.Nil(t, err)
+	defer r.Close()
+	assert.Nil(t, r.SetLink(iFace.Name(), 1400))
+
+	// only the packets of the mark look up the table, the other traffic is not affected
+	ru := rule{Priority: 32000, Table: 7674, Mark: 7674}
+	route := netip.MustParsePrefix("0.0.0.0/0")
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, r.AddRoute(route, netip.Addr{}, iFace.Name(), ru.Table))
+		assert.Nil(t, r.AddRule(ru))
+	}
+	assert.Contains(t, _journal.changes, change{Kind: "rule", Rule: &ru})
+	assert.True(t, hasRule(t, r, ru))
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, r.DelRule(ru))
+		assert.Nil(t, r.DelRoute(route, iFace.Name(), ru.Table))
+	}
+	assert.False(t, hasRule(t, r, ru))
+	assert.NotContains(t, _journal.changes, change{Kind: "rule", Rule: &ru})
+	assert.NotContains(t, _journal.changes, change{Kind: "route", Dst: route.String(), Dev: iFace.Name(), Table: ru.Table})
+	assert.Contains(t, execr.String(), "netlink rule add pref 32000 fwmark 0x1dfa table 7674")
+}
+
+func hasRule(t *testing.T, r *rtnl, ru rule) bool {
+	rules, err := r.conn.Rule.List()
+	assert.Nil(t, err)
+	for _, rx := range rules {
+		if rx.Attributes != nil && rx.Attributes.Priority != nil && *rx.Attributes.Priority == ru.Priority &&
+			rx.Attributes.Table != nil && *rx.Attributes.Table == ru.Table {
+			return true
+		}
+	}
+	return false
+}
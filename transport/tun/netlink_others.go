@@ -0,0 +1,37 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/net-byte/vtun/common/netutil"
+)
+
+// rtnl is only available on linux, the other systems exec their route commands
+type rtnl struct{}
+
+func dialRtnl(execr *netutil.ExecCmdRecorder) (*rtnl, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (r *rtnl) Close() error { return nil }
+
+func (r *rtnl) SetLink(name string, mtu int) error { return errors.ErrUnsupported }
+
+func (r *rtnl) AddAddr(name string, prefix netip.Prefix) error { return errors.ErrUnsupported }
+
+func (r *rtnl) DelAddr(name string, prefix netip.Prefix) error { return errors.ErrUnsupported }
+
+func (r *rtnl) AddRoute(dst netip.Prefix, gateway netip.Addr, name string, table uint32) error {
+	return errors.ErrUnsupported
+}
+
+func (r *rtnl) DelRoute(dst netip.Prefix, name string, table uint32) error {
+	return errors.ErrUnsupported
+}
+
+func (r *rtnl) AddRule(ru rule) error { return errors.ErrUnsupported }
+
+func (r *rtnl) DelRule(ru rule) error { return errors.ErrUnsupported }
@@ -0,0 +1,98 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/net-byte/vtun/common/netutil"
+	"golang.org/x/sys/unix"
+)
+
+// addNftTable replaces the inet table name and adds its chain of the hook, the table is journaled
+// and the rules are added to the chain before conn is flushed
+func addNftTable(conn *nftables.Conn, name string, chain *nftables.Chain) (*nftables.Table, *nftables.Chain) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: name}
+	// adding before deleting replaces the table left by another run in the same batch
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+	chain.Table = table
+	return table, conn.AddChain(chain)
+}
+
+// flushNftTable applies the batch of the table name, the batch is applied as a whole or not at all.
+// A table replaced by this run is journaled once.
+func flushNftTable(conn *nftables.Conn, name string) error {
+	c := change{Kind: "nftables", Dst: name}
+	journaled := _journal.has(c)
+	if !journaled {
+		if err := _journal.add(c); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		if !journaled {
+			_journal.remove(c)
+		}
+		return fmt.Errorf("nftables: %w", err)
+	}
+	return nil
+}
+
+// delNftTable deletes the inet table name, deleting a missing table is not an error
+func delNftTable(execr *netutil.ExecCmdRecorder, name string) error {
+	execr.Record("nftables delete table inet " + name)
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables: %w", err)
+	}
+	conn.DelTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: name})
+	if err = conn.Flush(); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("delete table %s: %w", name, err)
+	}
+	if name == killSwitchTable {
+		resetKillSwitch()
+	}
+	return _journal.remove(change{Kind: "nftables", Dst: name})
+}
+
+// matchPrefix matches the packets whose source or destination address is in the prefix
+func matchPrefix(p netip.Prefix, source bool) []expr.Any {
+	proto, offset := byte(unix.NFPROTO_IPV4), uint32(16)
+	if p.Addr().Is6() {
+		proto, offset = unix.NFPROTO_IPV6, 24
+	}
+	addr := p.Masked().Addr().AsSlice()
+	if source {
+		offset -= uint32(len(addr))
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(addr)),
+			Mask:           net.CIDRMask(p.Bits(), len(addr)*8),
+			Xor:            make([]byte, len(addr)),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	}
+}
+
+// matchOutput matches the packets going out of the interface name
+func matchOutput(name string) []expr.Any {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+)
+
+// SetNAT is only available on linux, the other systems set up the nat by hand
+func SetNAT(config config.Config) error {
+	return errors.ErrUnsupported
+}
+
+func delNftTable(execr *netutil.ExecCmdRecorder, name string) error {
+	return errors.ErrUnsupported
+}
+
+func setKillSwitch(config config.Config, name string, execr *netutil.ExecCmdRecorder) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,91 @@
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/net-byte/vtun/common/config"
+)
+
+// the priorities of the rules of the policy routing global mode, before the rule of the main table at 32766
+const (
+	suppressPriority = 32764
+	tablePriority    = 32765
+)
+
+// rule is a policy routing rule which looks up the table, for the packets without Mark if Invert is set.
+// Suppress ignores the default routes of the table, so the more specific routes of the main table still apply.
+type rule struct {
+	IPv6     bool   `json:"ipv6,omitempty"`
+	Priority uint32 `json:"priority"`
+	Table    uint32 `json:"table"`
+	Mark     uint32 `json:"mark,omitempty"`
+	Invert   bool   `json:"invert,omitempty"`
+	Suppress bool   `json:"suppress,omitempty"`
+}
+
+// String returns the rule as ip rule prints it
+func (ru rule) String() string {
+	var b strings.Builder
+	if ru.IPv6 {
+		b.WriteString("-6 ")
+	}
+	fmt.Fprintf(&b, "pref %d ", ru.Priority)
+	if ru.Invert {
+		b.WriteString("not ")
+	}
+	if ru.Mark != 0 {
+		fmt.Fprintf(&b, "fwmark %#x ", ru.Mark)
+	}
+	fmt.Fprintf(&b, "table %d", ru.Table)
+	if ru.Suppress {
+		b.WriteString(" suppress_prefixlength 0")
+	}
+	return b.String()
+}
+
+// setPolicyRoute routes the packets which are not marked as the tunnel sockets to the default routes
+// of the table numbered as the mark, it needs no host route to the server nor the physical interface
+func setPolicyRoute(r *rtnl, config config.Config, name string) error {
+	mark := uint32(config.FwMark)
+	for _, ipv6 := range []bool{false, true} {
+		dst := netip.MustParsePrefix("0.0.0.0/0")
+		if ipv6 {
+			dst = netip.MustParsePrefix("::/0")
+		}
+		if err := r.AddRoute(dst, netip.Addr{}, name, mark); err != nil {
+			return err
+		}
+		// the main table is looked up first without its default routes
+		if err := r.AddRule(rule{IPv6: ipv6, Priority: suppressPriority, Table: 254, Suppress: true}); err != nil {
+			return err
+		}
+		if err := r.AddRule(rule{IPv6: ipv6, Priority: tablePriority, Table: mark, Mark: mark, Invert: true}); err != nil {
+			return err
+		}
+	}
+	// the replies to the marked sockets pass the reverse path filter
+	return setSysctl("net.ipv4.conf.all.src_valid_mark", "1")
+}
+
+// sysctlPath returns the file of the sysctl key
+func sysctlPath(key string) string {
+	return "/proc/sys/" + strings.ReplaceAll(key, ".", "/")
+}
+
+// setSysctl sets the sysctl key to value, the previous value is journaled
+func setSysctl(key string, value string) error {
+	old, err := os.ReadFile(sysctlPath(key))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(old)) == value {
+		return nil
+	}
+	if err = _journal.add(change{Kind: "sysctl", Dst: key, Value: strings.TrimSpace(string(old))}); err != nil {
+		return err
+	}
+	return os.WriteFile(sysctlPath(key), []byte(value), 0644)
+}
@@ -0,0 +1,180 @@
+package tun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/water"
+)
+
+// ParseRoutes parses a comma separated list of prefixes for the split tunneling.
+// An entry starting with @ is a file with one prefix per line, the lines starting with # are comments.
+// An address is a host prefix.
+func ParseRoutes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if path, ok := strings.CutPrefix(entry, "@"); ok {
+			ps, err := readRoutes(path)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, ps...)
+			continue
+		}
+		p, err := parseRoute(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// readRoutes reads a file of prefixes
+func readRoutes(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		p, err := parseRoute(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, scanner.Err()
+}
+
+func parseRoute(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// setSplitRoutes routes the included prefixes to the tun interface and the excluded ones to the local gateway
+func setSplitRoutes(config config.Config, iFace *water.Interface, execr *netutil.ExecCmdRecorder) error {
+	include, err := ParseRoutes(config.IncludeRoutes)
+	if err != nil {
+		return fmt.Errorf("error include routes %v: %w", config.IncludeRoutes, err)
+	}
+	exclude, err := ParseRoutes(config.ExcludeRoutes)
+	if err != nil {
+		return fmt.Errorf("error exclude routes %v: %w", config.ExcludeRoutes, err)
+	}
+	var errs []error
+	for _, p := range include {
+		errs = append(errs, tunRoute(execr, iFace.Name(), p, "add"))
+	}
+	physicaliFace := netutil.GetInterface()
+	for _, p := range exclude {
+		gateway := config.LocalGateway
+		if p.Addr().Is6() {
+			gateway = config.LocalGatewayv6
+		}
+		if gateway == "" {
+			log.Printf("no local gateway to exclude %v", p)
+			continue
+		}
+		errs = append(errs, gatewayRoute(execr, physicaliFace, gateway, p))
+	}
+	return errors.Join(errs...)
+}
+
+// tunRoute adds or deletes the route of the prefix to the tun interface
+func tunRoute(execr *netutil.ExecCmdRecorder, name string, p netip.Prefix, action string) error {
+	var cmd func(action string) []string
+	os := runtime.GOOS
+	if os == "linux" {
+		return withRtnl(execr, func(r *rtnl) error {
+			if action == "add" {
+				return r.AddRoute(p, netip.Addr{}, name, 0)
+			}
+			return r.DelRoute(p, name, 0)
+		})
+	} else if os == "darwin" {
+		family := "-net"
+		if p.Addr().Is6() {
+			family = "-inet6"
+		}
+		cmd = func(action string) []string {
+			return []string{"route", action, family, p.String(), "-interface", name}
+		}
+	} else if os == "windows" {
+		family := "ipv4"
+		if p.Addr().Is6() {
+			family = "ipv6"
+		}
+		cmd = func(action string) []string {
+			return []string{"cmd", "/C", "netsh", "interface", family, action, "route", p.String(), name}
+		}
+	} else {
+		log.Printf("not support os %v", os)
+		return nil
+	}
+	undo := [][]string{cmd("delete")}
+	if action == "add" {
+		add := cmd("add")
+		execChange(execr, undo, add[0], add[1:]...)
+		return nil
+	}
+	execr.ExecCmd(undo[0][0], undo[0][1:]...)
+	return _journal.remove(change{Kind: "cmd", Undo: undo})
+}
+
+// gatewayRoute adds the route of the prefix to the local gateway on the physical interface
+func gatewayRoute(execr *netutil.ExecCmdRecorder, physicaliFace string, gateway string, p netip.Prefix) error {
+	os := runtime.GOOS
+	if os == "linux" {
+		gw, err := netip.ParseAddr(gateway)
+		if err != nil {
+			return err
+		}
+		return withRtnl(execr, func(r *rtnl) error {
+			return r.AddRoute(p, gw, physicaliFace, 0)
+		})
+	} else if os == "darwin" {
+		family := "-net"
+		if p.Addr().Is6() {
+			family = "-inet6"
+		}
+		execChange(execr, [][]string{{"route", "delete", family, p.String(), gateway}}, "route", "add", family, p.String(), gateway)
+	} else if os == "windows" {
+		if p.Addr().Is4() {
+			execChange(execr, [][]string{{"cmd", "/C", "route", "delete", p.String()}}, "cmd", "/C", "route", "add", p.String(), gateway, "metric", "5")
+		} else {
+			execChange(execr, [][]string{{"cmd", "/C", "route", "-6", "delete", p.String()}}, "cmd", "/C", "route", "-6", "add", p.String(), gateway, "metric", "5")
+		}
+	} else {
+		log.Printf("not support os %v", os)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package tun
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lan.txt")
+	err := os.WriteFile(path, []byte("# rfc1918\n10.0.0.0/8\n\n172.16.0.0/12\n 192.168.1.1/16 \nfd00::/8\n"), 0644)
+	assert.Nil(t, err)
+
+	prefixes, err := ParseRoutes("8.8.8.8, 1.1.1.0/24,@" + path + ",2001:db8::1")
+	assert.Nil(t, err)
+	var want []netip.Prefix
+	for _, s := range []string{"8.8.8.8/32", "1.1.1.0/24", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fd00::/8", "2001:db8::1/128"} {
+		want = append(want, netip.MustParsePrefix(s))
+	}
+	assert.Equal(t, want, prefixes)
+
+	prefixes, err = ParseRoutes("")
+	assert.Nil(t, err)
+	assert.Empty(t, prefixes)
+
+	_, err = ParseRoutes("10.0.0.0/33")
+	assert.NotNil(t, err)
+	_, err = ParseRoutes("@" + filepath.Join(t.TempDir(), "missing.txt"))
+	assert.NotNil(t, err)
+	assert.Nil(t, os.WriteFile(path, []byte("10.0.0.0/8\nlan\n"), 0644))
+	_, err = ParseRoutes("@" + path)
+	assert.ErrorContains(t, err, path+":2")
+}
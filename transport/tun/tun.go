@@ -1,18 +1,19 @@
 package tun
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"runtime"
-	"strconv"
 
 	"github.com/net-byte/vtun/common/config"
 	"github.com/net-byte/vtun/common/netutil"
 	"github.com/net-byte/water"
 )
 
-// CreateTun creates a tun interface
-func CreateTun(config config.Config) (iFace *water.Interface) {
+// CreateTun creates a tun interface and sets its addresses and the routes of the config
+func CreateTun(config config.Config) (*water.Interface, error) {
 	c := water.Config{DeviceType: water.TUN}
 	c.PlatformSpecificParams = water.PlatformSpecificParams{}
 	os := runtime.GOOS
@@ -25,49 +26,79 @@ func CreateTun(config config.Config) (iFace *water.Interface) {
 	}
 	iFace, err := water.New(c)
 	if err != nil {
-		log.Fatalln("failed to create tun interface:", err)
+		return nil, fmt.Errorf("failed to create tun interface: %w", err)
 	}
 	log.Printf("interface created %v", iFace.Name())
-	setRoute(config, iFace)
-	return iFace
+	if err = setRoute(config, iFace); err != nil {
+		iFace.Close()
+		return nil, fmt.Errorf("failed to configure tun interface: %w", err)
+	}
+	return iFace, nil
 }
 
 // setRoute sets the system routes
-func setRoute(config config.Config, iFace *water.Interface) {
+func setRoute(config config.Config, iFace *water.Interface) error {
 	ip, _, err := net.ParseCIDR(config.CIDR)
 	if err != nil {
-		log.Panicf("error cidr %v", config.CIDR)
+		return fmt.Errorf("error cidr %v", config.CIDR)
 	}
 	ipv6, _, err := net.ParseCIDR(config.CIDRv6)
 	if err != nil {
-		log.Panicf("error ipv6 cidr %v", config.CIDRv6)
+		return fmt.Errorf("error ipv6 cidr %v", config.CIDRv6)
 	}
 
 	execr := netutil.ExecCmdRecorder{}
 	os := runtime.GOOS
 	if os == "linux" {
-		execr.ExecCmd("/sbin/ip", "link", "set", "dev", iFace.Name(), "mtu", strconv.Itoa(config.MTU))
-		execr.ExecCmd("/sbin/ip", "addr", "add", config.CIDR, "dev", iFace.Name())
-		execr.ExecCmd("/sbin/ip", "-6", "addr", "add", config.CIDRv6, "dev", iFace.Name())
-		execr.ExecCmd("/sbin/ip", "link", "set", "dev", iFace.Name(), "up")
-		if !config.ServerMode && config.GlobalMode {
+		err = withRtnl(&execr, func(r *rtnl) error {
+			if err := r.SetLink(iFace.Name(), config.MTU); err != nil {
+				return err
+			}
+			for _, cidr := range []string{config.CIDR, config.CIDRv6} {
+				if err := r.AddAddr(iFace.Name(), netip.MustParsePrefix(cidr)); err != nil {
+					return err
+				}
+			}
+			if config.ServerMode || !config.GlobalMode {
+				return nil
+			}
+			if config.FwMark != 0 {
+				return setPolicyRoute(r, config, iFace.Name())
+			}
 			physicaliFace := netutil.GetInterface()
 			serverAddrIP := netutil.LookupServerAddrIP(config.ServerAddr)
-			if physicaliFace != "" && serverAddrIP != nil {
-				if config.LocalGateway != "" {
-					execr.ExecCmd("/sbin/ip", "route", "add", "0.0.0.0/1", "dev", iFace.Name())
-					execr.ExecCmd("/sbin/ip", "route", "add", "128.0.0.0/1", "dev", iFace.Name())
-					if serverAddrIP.To4() != nil {
-						execr.ExecCmd("/sbin/ip", "route", "add", serverAddrIP.To4().String()+"/32", "via", config.LocalGateway, "dev", physicaliFace)
+			if physicaliFace == "" || serverAddrIP == nil {
+				return nil
+			}
+			if gateway, err := netip.ParseAddr(config.LocalGateway); err == nil {
+				for _, p := range []string{"0.0.0.0/1", "128.0.0.0/1"} {
+					if err := r.AddRoute(netip.MustParsePrefix(p), netip.Addr{}, iFace.Name(), 0); err != nil {
+						return err
 					}
 				}
-				if config.LocalGatewayv6 != "" {
-					execr.ExecCmd("/sbin/ip", "-6", "route", "add", "::/1", "dev", iFace.Name())
-					if serverAddrIP.To16() != nil {
-						execr.ExecCmd("/sbin/ip", "-6", "route", "add", serverAddrIP.To16().String()+"/128", "via", config.LocalGatewayv6, "dev", physicaliFace)
+				if serverAddr, ok := netip.AddrFromSlice(serverAddrIP.To4()); ok {
+					if err := r.AddRoute(netip.PrefixFrom(serverAddr, 32), gateway, physicaliFace, 0); err != nil {
+						return err
+					}
+				}
+			}
+			if gateway, err := netip.ParseAddr(config.LocalGatewayv6); err == nil {
+				if err := r.AddRoute(netip.MustParsePrefix("::/1"), netip.Addr{}, iFace.Name(), 0); err != nil {
+					return err
+				}
+				if serverAddr, ok := netip.AddrFromSlice(serverAddrIP.To16()); ok {
+					if err := r.AddRoute(netip.PrefixFrom(serverAddr, 128), gateway, physicaliFace, 0); err != nil {
+						return err
 					}
 				}
 			}
+			return nil
+		})
+		if err == nil && config.KillSwitch && !config.ServerMode && config.GlobalMode {
+			err = setKillSwitch(config, iFace.Name(), &execr)
+		}
+		if err != nil {
+			return err
 		}
 	} else if os == "darwin" {
 		execr.ExecCmd("ifconfig", iFace.Name(), "inet", ip.String(), config.ServerIP, "up")
@@ -77,20 +108,27 @@ func setRoute(config config.Config, iFace *water.Interface) {
 			serverAddrIP := netutil.LookupServerAddrIP(config.ServerAddr)
 			if physicaliFace != "" && serverAddrIP != nil {
 				if config.LocalGateway != "" {
-					execr.ExecCmd("route", "add", "default", config.ServerIP)
+					execChange(&execr, [][]string{
+						{"route", "add", "default", config.LocalGateway},
+						{"route", "change", "default", config.LocalGateway},
+					}, "route", "add", "default", config.ServerIP)
 					execr.ExecCmd("route", "change", "default", config.ServerIP)
-					execr.ExecCmd("route", "add", "0.0.0.0/1", "-interface", iFace.Name())
-					execr.ExecCmd("route", "add", "128.0.0.0/1", "-interface", iFace.Name())
+					for _, p := range []string{"0.0.0.0/1", "128.0.0.0/1"} {
+						execChange(&execr, [][]string{{"route", "delete", p, "-interface", iFace.Name()}}, "route", "add", p, "-interface", iFace.Name())
+					}
 					if serverAddrIP.To4() != nil {
-						execr.ExecCmd("route", "add", serverAddrIP.To4().String(), config.LocalGateway)
+						execChange(&execr, [][]string{{"route", "delete", serverAddrIP.To4().String(), config.LocalGateway}}, "route", "add", serverAddrIP.To4().String(), config.LocalGateway)
 					}
 				}
 				if config.LocalGatewayv6 != "" {
-					execr.ExecCmd("route", "add", "-inet6", "default", config.ServerIPv6)
+					execChange(&execr, [][]string{
+						{"route", "add", "-inet6", "default", config.LocalGatewayv6},
+						{"route", "change", "-inet6", "default", config.LocalGatewayv6},
+					}, "route", "add", "-inet6", "default", config.ServerIPv6)
 					execr.ExecCmd("route", "change", "-inet6", "default", config.ServerIPv6)
-					execr.ExecCmd("route", "add", "-inet6", "::/1", "-interface", iFace.Name())
+					execChange(&execr, [][]string{{"route", "delete", "-inet6", "::/1", "-interface", iFace.Name()}}, "route", "add", "-inet6", "::/1", "-interface", iFace.Name())
 					if serverAddrIP.To16() != nil {
-						execr.ExecCmd("route", "add", "-inet6", serverAddrIP.To16().String(), config.LocalGatewayv6)
+						execChange(&execr, [][]string{{"route", "delete", "-inet6", serverAddrIP.To16().String(), config.LocalGatewayv6}}, "route", "add", "-inet6", serverAddrIP.To16().String(), config.LocalGatewayv6)
 					}
 				}
 			}
@@ -100,17 +138,23 @@ func setRoute(config config.Config, iFace *water.Interface) {
 			serverAddrIP := netutil.LookupServerAddrIP(config.ServerAddr)
 			if serverAddrIP != nil {
 				if config.LocalGateway != "" {
-					execr.ExecCmd("cmd", "/C", "route", "delete", "0.0.0.0", "mask", "0.0.0.0")
+					execChange(&execr, [][]string{
+						{"cmd", "/C", "route", "delete", "0.0.0.0", "mask", "0.0.0.0"},
+						{"cmd", "/C", "route", "add", "0.0.0.0", "mask", "0.0.0.0", config.LocalGateway, "metric", "6"},
+					}, "cmd", "/C", "route", "delete", "0.0.0.0", "mask", "0.0.0.0")
 					execr.ExecCmd("cmd", "/C", "route", "add", "0.0.0.0", "mask", "0.0.0.0", config.ServerIP, "metric", "6")
 					if serverAddrIP.To4() != nil {
-						execr.ExecCmd("cmd", "/C", "route", "add", serverAddrIP.To4().String()+"/32", config.LocalGateway, "metric", "5")
+						execChange(&execr, [][]string{{"cmd", "/C", "route", "delete", serverAddrIP.To4().String()}}, "cmd", "/C", "route", "add", serverAddrIP.To4().String()+"/32", config.LocalGateway, "metric", "5")
 					}
 				}
 				if config.LocalGatewayv6 != "" {
-					execr.ExecCmd("cmd", "/C", "route", "-6", "delete", "::/0", "mask", "::/0")
+					execChange(&execr, [][]string{
+						{"cmd", "/C", "route", "-6", "delete", "::/0", "mask", "::/0"},
+						{"cmd", "/C", "route", "-6", "add", "::/0", "mask", "::/0", config.LocalGatewayv6, "metric", "6"},
+					}, "cmd", "/C", "route", "-6", "delete", "::/0", "mask", "::/0")
 					execr.ExecCmd("cmd", "/C", "route", "-6", "add", "::/0", "mask", "::/0", config.ServerIPv6, "metric", "6")
 					if serverAddrIP.To16() != nil {
-						execr.ExecCmd("cmd", "/C", "route", "-6", "add", serverAddrIP.To16().String()+"/128", config.LocalGatewayv6, "metric", "5")
+						execChange(&execr, [][]string{{"cmd", "/C", "route", "-6", "delete", serverAddrIP.To16().String()}}, "cmd", "/C", "route", "-6", "add", serverAddrIP.To16().String()+"/128", config.LocalGatewayv6, "metric", "5")
 					}
 				}
 			}
@@ -118,46 +162,141 @@ func setRoute(config config.Config, iFace *water.Interface) {
 	} else {
 		log.Printf("not support os %v", os)
 	}
+	if !config.ServerMode {
+		if err = setSplitRoutes(config, iFace, &execr); err != nil {
+			return err
+		}
+		if err = setDNS(config, iFace.Name(), &execr); err != nil {
+			return err
+		}
+	}
 	log.Printf("interface configured %v", iFace.Name())
 
 	if config.Verbose {
 		log.Printf("set route commands:\n%s", execr.String())
 	}
+	return nil
+}
+
+// withRtnl calls fn with a rtnetlink connection
+func withRtnl(execr *netutil.ExecCmdRecorder, fn func(r *rtnl) error) error {
+	r, err := dialRtnl(execr)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(r)
 }
 
-// ResetRoute resets the system routes
-func ResetRoute(config config.Config) {
-	if config.ServerMode || !config.GlobalMode {
-		return
+// ChangeAddr replaces the addresses of the tun interface when the server assigns other ones,
+// on linux the mtu is changed too
+func ChangeAddr(iFace *water.Interface, from config.Config, to config.Config) error {
+	ip, _, err := net.ParseCIDR(to.CIDR)
+	if err != nil {
+		return fmt.Errorf("error cidr %v", to.CIDR)
 	}
+	oldIP, _, _ := net.ParseCIDR(from.CIDR)
+	ipv6, _, _ := net.ParseCIDR(to.CIDRv6)
+	oldIPv6, _, _ := net.ParseCIDR(from.CIDRv6)
 
-	os := runtime.GOOS
 	execr := netutil.ExecCmdRecorder{}
-
-	if os == "darwin" {
-		if config.LocalGateway != "" {
-			execr.ExecCmd("route", "add", "default", config.LocalGateway)
-			execr.ExecCmd("route", "change", "default", config.LocalGateway)
+	os := runtime.GOOS
+	if os == "linux" {
+		err = withRtnl(&execr, func(r *rtnl) error {
+			if from.MTU != to.MTU {
+				if err := r.SetLink(iFace.Name(), to.MTU); err != nil {
+					return err
+				}
+			}
+			for _, change := range [][2]string{{from.CIDR, to.CIDR}, {from.CIDRv6, to.CIDRv6}} {
+				if change[0] == change[1] {
+					continue
+				}
+				if prev, err := netip.ParsePrefix(change[0]); err == nil {
+					if err = r.DelAddr(iFace.Name(), prev); err != nil {
+						return err
+					}
+				}
+				next, err := netip.ParsePrefix(change[1])
+				if err != nil {
+					continue
+				}
+				if err = r.AddAddr(iFace.Name(), next); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else if os == "darwin" {
+		if from.CIDR != to.CIDR {
+			execr.ExecCmd("ifconfig", iFace.Name(), "inet", ip.String(), to.ServerIP, "up")
 		}
-		if config.LocalGatewayv6 != "" {
-			execr.ExecCmd("route", "add", "-inet6", "default", config.LocalGatewayv6)
-			execr.ExecCmd("route", "change", "-inet6", "default", config.LocalGatewayv6)
+		if from.CIDRv6 != to.CIDRv6 && ipv6 != nil {
+			if oldIPv6 != nil {
+				execr.ExecCmd("ifconfig", iFace.Name(), "inet6", oldIPv6.String(), "delete")
+			}
+			execr.ExecCmd("ifconfig", iFace.Name(), "inet6", ipv6.String(), to.ServerIPv6, "up")
 		}
 	} else if os == "windows" {
-		serverAddrIP := netutil.LookupServerAddrIP(config.ServerAddr)
-		if serverAddrIP != nil {
-			if config.LocalGateway != "" {
-				execr.ExecCmd("cmd", "/C", "route", "delete", "0.0.0.0", "mask", "0.0.0.0")
-				execr.ExecCmd("cmd", "/C", "route", "add", "0.0.0.0", "mask", "0.0.0.0", config.LocalGateway, "metric", "6")
-			}
-			if config.LocalGatewayv6 != "" {
-				execr.ExecCmd("cmd", "/C", "route", "-6", "delete", "::/0", "mask", "::/0")
-				execr.ExecCmd("cmd", "/C", "route", "-6", "add", "::/0", "mask", "::/0", config.LocalGatewayv6, "metric", "6")
+		if from.CIDR != to.CIDR {
+			_, ipNet, _ := net.ParseCIDR(to.CIDR)
+			execr.ExecCmd("cmd", "/C", "netsh", "interface", "ip", "set", "address", "name="+iFace.Name(), "static", ip.String(), net.IP(ipNet.Mask).String())
+		}
+		if from.CIDRv6 != to.CIDRv6 && ipv6 != nil {
+			if oldIPv6 != nil {
+				execr.ExecCmd("cmd", "/C", "netsh", "interface", "ipv6", "delete", "address", iFace.Name(), oldIPv6.String())
 			}
+			execr.ExecCmd("cmd", "/C", "netsh", "interface", "ipv6", "add", "address", iFace.Name(), to.CIDRv6)
 		}
+	} else {
+		log.Printf("not support os %v", os)
 	}
+	log.Printf("interface %v address changed from %v to %v", iFace.Name(), oldIP, ip)
 
+	if to.Verbose {
+		log.Printf("change address commands:\n%s", execr.String())
+	}
+	return nil
+}
+
+// AddSubnetRoute routes a subnet behind a client to the tun interface of the server
+func AddSubnetRoute(config config.Config, iFace *water.Interface, subnet netip.Prefix) error {
+	return execSubnetRoute(config, iFace, subnet, "add")
+}
+
+// DeleteSubnetRoute deletes the route of a subnet behind a client
+func DeleteSubnetRoute(config config.Config, iFace *water.Interface, subnet netip.Prefix) error {
+	return execSubnetRoute(config, iFace, subnet, "delete")
+}
+
+func execSubnetRoute(config config.Config, iFace *water.Interface, subnet netip.Prefix, action string) error {
+	execr := netutil.ExecCmdRecorder{}
+	err := tunRoute(&execr, iFace.Name(), subnet, action)
+	if config.Verbose {
+		log.Printf("subnet route commands:\n%s", execr.String())
+	}
+	return err
+}
+
+// SetKillSwitch installs or updates the kill switch of the client, name is the tun interface, empty before it is created
+func SetKillSwitch(config config.Config, name string) error {
+	execr := netutil.ExecCmdRecorder{}
+	err := setKillSwitch(config, name, &execr)
+	if config.Verbose && execr.String() != "" {
+		log.Printf("kill switch commands:\n%s", execr.String())
+	}
+	return err
+}
+
+// ResetRoute reverts the system routes and addresses set by this run
+func ResetRoute(config config.Config) error {
+	execr := netutil.ExecCmdRecorder{}
+	err := RollbackJournal(&execr)
 	if config.Verbose {
 		log.Printf("reset route commands:\n%s", execr.String())
 	}
+	return err
 }
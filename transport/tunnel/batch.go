@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/transport"
+)
+
+// batcher coalesces the packets written within the delay into one payload of up to size bytes,
+// the payload is flushed when it is full or when the delay of its first packet expires
+type batcher struct {
+	mu    sync.Mutex
+	size  int
+	delay time.Duration
+	flush func(batch []byte) error
+	batch []byte
+	timer *time.Timer
+	// err is the error of the last flush of the timer, returned by the next add
+	err    error
+	closed bool
+}
+
+// newBatcher returns the batcher of the config for conn, nil if batching is disabled.
+// If conn sends every frame in one datagram the batch is capped at the mtu, so a batch frame is no larger than the data frame of a full packet.
+func newBatcher(config config.Config, conn transport.Conn, flush func(batch []byte) error) *batcher {
+	if config.Batch <= 0 {
+		return nil
+	}
+	size := config.Batch
+	if size > xproto.MaxBatchSize {
+		size = xproto.MaxBatchSize
+	}
+	if d, ok := conn.(transport.Datagram); ok && d.Datagram() && size > config.MTU {
+		size = config.MTU
+	}
+	if size <= 0 {
+		return nil
+	}
+	delay := time.Duration(config.BatchDelay) * time.Microsecond
+	if delay <= 0 {
+		delay = time.Millisecond
+	}
+	return &batcher{size: size, delay: delay, flush: flush}
+}
+
+// add queues the packet in the batch, a packet which does not fit flushes the batch first
+func (b *batcher) add(packet []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return net.ErrClosed
+	}
+	if err := b.err; err != nil {
+		b.err = nil
+		return err
+	}
+	if len(b.batch) > 0 && len(b.batch)+xproto.HeaderLength+len(packet) > b.size {
+		if err := b.flushLocked(); err != nil {
+			return err
+		}
+	}
+	b.batch = xproto.AppendBatchPacket(b.batch, packet)
+	if len(b.batch) >= b.size {
+		return b.flushLocked()
+	}
+	if len(b.batch) == xproto.HeaderLength+len(packet) {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.delay, b.expire)
+		} else {
+			b.timer.Reset(b.delay)
+		}
+	}
+	return nil
+}
+
+// expire flushes the batch once the delay of its first packet expired
+func (b *batcher) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.batch) == 0 {
+		return
+	}
+	if err := b.flushLocked(); err != nil {
+		b.err = err
+	}
+}
+
+func (b *batcher) flushLocked() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.flush(b.batch)
+	b.batch = b.batch[:0]
+	return err
+}
+
+// close flushes the queued packets, the packets added later are refused
+func (b *batcher) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if len(b.batch) == 0 {
+		return nil
+	}
+	return b.flushLocked()
+}
@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// datagramConn is a pipeConn which declares that it sends every frame in one datagram
+type datagramConn struct {
+	*pipeConn
+}
+
+func (c datagramConn) Datagram() bool {
+	return true
+}
+
+func TestNewBatcher_Cap(t *testing.T) {
+	flush := func(batch []byte) error { return nil }
+	stream, _ := newPipe()
+	datagram := datagramConn{stream}
+	for _, tt := range []struct {
+		name  string
+		conn  transport.Conn
+		mtu   int
+		batch int
+		size  int
+	}{
+		{"stream", stream, 1500, 16384, 16384},
+		{"stream max", stream, 1500, 65536, 32768},
+		{"datagram", datagram, 1500, 16384, 1500},
+		{"datagram small mtu", datagram, 1400, 16384, 1400},
+		{"datagram small batch", datagram, 1500, 1000, 1000},
+		{"datagram no mtu", datagram, 0, 16384, 0},
+	} {
+		b := newBatcher(config.Config{MTU: tt.mtu, Batch: tt.batch}, tt.conn, flush)
+		if tt.size == 0 {
+			assert.Nil(t, b, tt.name)
+			continue
+		}
+		assert.Equal(t, tt.size, b.size, tt.name)
+	}
+
+	// the batches of a datagram transport never exceed the mtu
+	var sizes []int
+	b := newBatcher(config.Config{MTU: 1400, Batch: 16384}, datagram, func(batch []byte) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	})
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, b.add(make([]byte, 100+i*3)))
+	}
+	assert.Nil(t, b.close())
+	assert.NotEmpty(t, sizes)
+	for _, n := range sizes {
+		assert.LessOrEqual(t, n, 1400)
+	}
+}
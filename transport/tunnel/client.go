@@ -0,0 +1,335 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/common/x/xtun"
+	"github.com/net-byte/vtun/transport"
+	"github.com/net-byte/vtun/transport/tun"
+	"github.com/net-byte/water"
+)
+
+// Client forwards packets between the tun streams and the connection of a transport
+type Client struct {
+	config    config.Config
+	transport transport.Transport
+	// id identifies the client to the server across reconnections so it keeps its addresses
+	id    []byte
+	conn  atomic.Pointer[lockedConn]
+	addrs atomic.Pointer[xproto.ServerHandshakePacket]
+	// iFace is reconfigured when the server assigns other addresses on a reconnection
+	iFace *water.Interface
+	// onConfig is called with the config negotiated by the first handshake and whenever a reconnection changes it
+	onConfig func(config.Config)
+}
+
+// lockedConn serializes the writes to a transport connection
+type lockedConn struct {
+	transport.Conn
+	mu sync.Mutex
+}
+
+func (c *lockedConn) WritePacket(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WritePacket(b)
+}
+
+// NewClient returns a client for the given transport, its id is kept next to the state file so a restarted client keeps its addresses
+func NewClient(t transport.Transport, config config.Config) *Client {
+	return &Client{config: config, transport: t, id: loadClientID(config.StateFile)}
+}
+
+// loadClientID returns the id saved next to the state file, a new id is generated and saved if there is none
+func loadClientID(stateFile string) []byte {
+	path := stateFile + ".id"
+	if stateFile != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			id, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err == nil && len(id) == xproto.ClientIDLength {
+				return id
+			}
+			log.Printf("invalid client id in %s, a new one is generated", path)
+		}
+	}
+	id := make([]byte, xproto.ClientIDLength)
+	if _, err := rand.Read(id); err != nil {
+		log.Panicf("failed to generate client id: %v", err)
+	}
+	if stateFile != "" {
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(id)+"\n"), 0600); err != nil {
+			log.Printf("failed to save the client id, the server may assign other addresses after a restart: %v", err)
+		}
+	}
+	return id
+}
+
+// Config returns the config of the client with the addresses assigned by the server
+func (c *Client) Config() config.Config {
+	config := c.config
+	reply := c.addrs.Load()
+	if reply == nil {
+		return config
+	}
+	if reply.CIDRv4.IsValid() {
+		config.CIDR = reply.CIDRv4.String()
+	}
+	if reply.CIDRv6.IsValid() {
+		config.CIDRv6 = reply.CIDRv6.String()
+	}
+	if reply.ServerIP.IsValid() {
+		config.ServerIP = reply.ServerIP.String()
+	}
+	if reply.ServerIPv6.IsValid() {
+		config.ServerIPv6 = reply.ServerIPv6.String()
+	}
+	// the mtu is the smallest of the client and server ones, the pushed routes are added to the included ones
+	if reply.MTU > 0 && reply.MTU < config.MTU {
+		config.MTU = reply.MTU
+	}
+	if len(reply.Routes) > 0 {
+		routes := []string{config.IncludeRoutes}
+		for _, p := range reply.Routes {
+			routes = append(routes, p.String())
+		}
+		config.IncludeRoutes = strings.Trim(strings.Join(routes, ","), ",")
+	}
+	// the dns settings of the client take precedence over the pushed ones
+	if config.DNS == "" && len(reply.DNS) > 0 {
+		var dns []string
+		for _, addr := range reply.DNS {
+			dns = append(dns, addr.String())
+		}
+		config.DNS = strings.Join(dns, ",")
+	}
+	if config.DNSSearch == "" && len(reply.Search) > 0 {
+		config.DNSSearch = strings.Join(reply.Search, ",")
+	}
+	return config
+}
+
+// StartClient connects to the server and creates the tun interface with the addresses it assigns,
+// created is called with the interface and the config it is configured with.
+// The client runs until the context is done, then the session is closed and the interface is left to the caller.
+func StartClient(ctx context.Context, t transport.Transport, config config.Config, created func(*water.Interface, config.Config)) error {
+	log.Printf("vtun %s client started", t.Name())
+	c := NewClient(t, config)
+	// the kill switch is installed before the first dial, so nothing leaks until the tunnel is up
+	if config.KillSwitch {
+		if err := tun.SetKillSwitch(config, ""); err != nil {
+			return fmt.Errorf("failed to set the kill switch: %w", err)
+		}
+	}
+	_ctx, _cancel := context.WithCancel(ctx)
+	defer _cancel()
+	conn := c.connect(_ctx)
+	if conn == nil {
+		return nil
+	}
+	config = c.Config()
+	iFace, err := tun.CreateTun(config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	created(iFace, config)
+	c.iFace = iFace
+	outputStream := make(chan []byte, 3000)
+	go xtun.ReadFromTun(iFace, config, outputStream, _ctx, _cancel)
+	inputStream := make(chan []byte, 3000)
+	go xtun.WriteToTun(iFace, config, inputStream, _ctx, _cancel)
+	c.run(_ctx, conn, outputStream, inputStream,
+		func(n int) { counter.IncrWrittenBytes(n) },
+		func(n int) { counter.IncrReadBytes(n) },
+	)
+	if ctx.Err() == nil {
+		return errors.New("the tun interface is closed")
+	}
+	return nil
+}
+
+// StartClientForApi runs the client of the transport on the given streams until the context is done,
+// onConfig is called with the addresses, mtu, routes and dns negotiated with the server
+func StartClientForApi(t transport.Transport, config config.Config, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), onConfig func(config.Config), _ctx context.Context) {
+	NewClient(t, config).Run(_ctx, outputStream, inputStream, writeCallback, readCallback, onConfig)
+}
+
+// Run dials the server and reconnects whenever the connection is lost until the context is done,
+// onConfig, if not nil, is called with the config negotiated by the first handshake and whenever a reconnection changes it
+func (c *Client) Run(_ctx context.Context, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int), onConfig func(config.Config)) {
+	c.onConfig = onConfig
+	c.run(_ctx, nil, outputStream, inputStream, writeCallback, readCallback)
+}
+
+// run forwards packets on conn, if any, and reconnects whenever the connection is lost until the context is done
+func (c *Client) run(_ctx context.Context, conn *secureConn, outputStream <-chan []byte, inputStream chan<- []byte, writeCallback, readCallback func(int)) {
+	go c.tunToConn(_ctx, outputStream, writeCallback)
+	for {
+		if conn == nil {
+			if conn = c.connect(_ctx); conn == nil {
+				return
+			}
+		}
+		lc := &lockedConn{Conn: conn}
+		c.conn.Store(lc)
+		connCtx, cancel := context.WithCancel(_ctx)
+		stop := context.AfterFunc(connCtx, func() { conn.Close() })
+		interval, timeout := keepAliveTimes(c.config)
+		go conn.keepAlive(connCtx, interval, timeout)
+		c.connToTun(connCtx, lc, inputStream, readCallback)
+		stop()
+		cancel()
+		c.conn.CompareAndSwap(lc, nil)
+		conn.Close()
+		conn = nil
+		c.updateKillSwitch(_ctx)
+	}
+}
+
+// connect dials the server until the handshake succeeds or the context is done
+func (c *Client) connect(_ctx context.Context) *secureConn {
+	for xtun.ContextOpened(_ctx) {
+		conn, err := c.dial(_ctx)
+		if err == nil {
+			return conn
+		}
+		netutil.PrintErr(err, c.config.Verbose)
+		sleep(_ctx, 3*time.Second)
+		c.updateKillSwitch(_ctx)
+	}
+	return nil
+}
+
+// updateKillSwitch allows the server addresses resolved again with the marked sockets before a reconnection
+func (c *Client) updateKillSwitch(_ctx context.Context) {
+	if !c.config.KillSwitch || !xtun.ContextOpened(_ctx) {
+		return
+	}
+	name := ""
+	if c.iFace != nil {
+		name = c.iFace.Name()
+	}
+	if err := tun.SetKillSwitch(c.Config(), name); err != nil {
+		log.Printf("failed to update the kill switch: %v", err)
+	}
+}
+
+// dial connects to the server and runs the handshake, the client asks for the addresses it was assigned before
+func (c *Client) dial(_ctx context.Context) (*secureConn, error) {
+	conn, err := c.transport.Dial(_ctx, c.config)
+	if err != nil {
+		return nil, err
+	}
+	from := c.Config()
+	sc, reply, err := clientHandshake(from, c.id, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	first := c.addrs.Swap(reply) == nil
+	if c.config.Verbose {
+		log.Printf("vtun session %x compression %s cipher %s", reply.SessionID,
+			xproto.CodecNames([]byte{reply.Codec}), xproto.CipherNames([]byte{reply.Cipher}))
+	}
+	to := c.Config()
+	if first || to.CIDR != from.CIDR || to.CIDRv6 != from.CIDRv6 || to.MTU != from.MTU {
+		log.Printf("vtun assigned address %s %s mtu %d", to.CIDR, to.CIDRv6, to.MTU)
+		if c.config.Subnets != "" {
+			log.Printf("vtun routed subnets %v of %s", reply.Subnets, c.config.Subnets)
+		}
+		if !first && c.iFace != nil {
+			if err := tun.ChangeAddr(c.iFace, from, to); err != nil {
+				log.Printf("failed to change address: %v", err)
+			}
+		}
+	}
+	if !first && (to.IncludeRoutes != from.IncludeRoutes || to.DNS != from.DNS || to.DNSSearch != from.DNSSearch) {
+		log.Printf("the pushed routes or dns changed, they are applied when the client restarts")
+	}
+	if c.onConfig != nil && (first || to != from) {
+		c.onConfig(to)
+	}
+	return sc, nil
+}
+
+// RTT returns the smoothed round trip time to the server, it is 0 while disconnected or not measured yet
+func (c *Client) RTT() time.Duration {
+	lc := c.conn.Load()
+	if lc == nil {
+		return 0
+	}
+	if sc, ok := lc.Conn.(*secureConn); ok {
+		srtt, _ := sc.RTT()
+		return srtt
+	}
+	return 0
+}
+
+// tunToConn sends packets from tun to the connection
+func (c *Client) tunToConn(_ctx context.Context, outputStream <-chan []byte, callback func(int)) {
+	for {
+		select {
+		case <-_ctx.Done():
+			return
+		case b := <-outputStream:
+			conn := c.conn.Load()
+			if conn == nil {
+				continue
+			}
+			n := len(b)
+			if err := conn.WritePacket(b); err != nil {
+				netutil.PrintErr(err, c.config.Verbose)
+				continue
+			}
+			callback(n)
+		}
+	}
+}
+
+// connToTun sends packets from the connection to tun
+func (c *Client) connToTun(_ctx context.Context, conn transport.Conn, inputStream chan<- []byte, callback func(int)) {
+	for xtun.ContextOpened(_ctx) {
+		b, err := conn.ReadPacket()
+		if err != nil {
+			if errors.Is(err, errPeerClosed) {
+				log.Printf("vtun session closed by the server %v, reconnecting", conn.RemoteAddr())
+			} else {
+				netutil.PrintErr(err, c.config.Verbose)
+			}
+			break
+		}
+		if len(b) == 0 {
+			continue
+		}
+		select {
+		case inputStream <- xproto.Copy(b):
+		case <-_ctx.Done():
+			return
+		}
+		callback(len(b))
+	}
+}
+
+// sleep pauses the current goroutine for d or until the context is done
+func sleep(_ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-_ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/auth"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeTransport dials in-memory connections to a server running the handshake with assign
+type pipeTransport struct {
+	server config.Config
+	assign assignFunc
+	// conns receives the server side of the sessions
+	conns chan *secureConn
+}
+
+func (t *pipeTransport) Name() string { return "pipe" }
+
+func (t *pipeTransport) Listen(ctx context.Context, config config.Config) (transport.Listener, error) {
+	return nil, nil
+}
+
+func (t *pipeTransport) Dial(ctx context.Context, config config.Config) (transport.Conn, error) {
+	c, s := newPipe()
+	go func() {
+		sc, _, _, err := serverHandshake(t.server, s, nil, t.assign)
+		if err != nil {
+			s.Close()
+			return
+		}
+		t.conns <- sc
+	}()
+	return c, nil
+}
+
+func TestClient_Config(t *testing.T) {
+	c := NewClient(nil, config.Config{CIDR: "172.16.0.10/24", MTU: 1500, IncludeRoutes: "10.1.0.0/16", DNS: "1.1.1.1"})
+	assert.Equal(t, "172.16.0.10/24", c.Config().CIDR)
+
+	c.addrs.Store(&xproto.ServerHandshakePacket{
+		CIDRv4: netip.MustParsePrefix("172.16.0.2/24"),
+		MTU:    1400,
+		Routes: []netip.Prefix{netip.MustParsePrefix("10.2.0.0/16")},
+		DNS:    []netip.Addr{netip.MustParseAddr("172.16.0.1")},
+		Search: []string{"vpn"},
+	})
+	cfg := c.Config()
+	assert.Equal(t, "172.16.0.2/24", cfg.CIDR)
+	assert.Equal(t, 1400, cfg.MTU)
+	assert.Equal(t, "10.1.0.0/16,10.2.0.0/16", cfg.IncludeRoutes)
+	// the dns servers of the client are kept
+	assert.Equal(t, "1.1.1.1", cfg.DNS)
+	assert.Equal(t, "vpn", cfg.DNSSearch)
+
+	// a larger mtu of the server is ignored
+	c.config.MTU = 1300
+	c.config.IncludeRoutes = ""
+	cfg = c.Config()
+	assert.Equal(t, 1300, cfg.MTU)
+	assert.Equal(t, "10.2.0.0/16", cfg.IncludeRoutes)
+}
+
+func TestClient_OnConfig(t *testing.T) {
+	var cidr atomic.Value
+	cidr.Store("172.16.0.2/24")
+	tr := &pipeTransport{
+		server: testConfig("freedom"),
+		assign: func(obj *xproto.ClientHandshakePacket, _ *auth.User) (*xproto.ServerHandshakePacket, error) {
+			return &xproto.ServerHandshakePacket{
+				CIDRv4:   netip.MustParsePrefix(cidr.Load().(string)),
+				ServerIP: netip.MustParseAddr("172.16.0.1"),
+				MTU:      1400,
+				DNS:      []netip.Addr{netip.MustParseAddr("172.16.0.1")},
+			}, nil
+		},
+		conns: make(chan *secureConn, 1),
+	}
+	cfg := testConfig("freedom")
+	cfg.MTU = 1500
+	configs := make(chan config.Config, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewClient(tr, cfg).Run(ctx, make(chan []byte), make(chan []byte), func(int) {}, func(int) {},
+		func(c config.Config) { configs <- c })
+
+	// the first handshake reports the negotiated config
+	sc := <-tr.conns
+	got := <-configs
+	assert.Equal(t, "172.16.0.2/24", got.CIDR)
+	assert.Equal(t, 1400, got.MTU)
+	assert.Equal(t, "172.16.0.1", got.DNS)
+
+	// a reconnection with the same addresses is not reported
+	sc.Close()
+	sc = <-tr.conns
+	select {
+	case got = <-configs:
+		t.Fatalf("unexpected config %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a reconnection with other addresses is
+	cidr.Store("172.16.0.3/24")
+	sc.Close()
+	<-tr.conns
+	got = <-configs
+	assert.Equal(t, "172.16.0.3/24", got.CIDR)
+}
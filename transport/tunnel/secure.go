@@ -0,0 +1,494 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/net-byte/vtun/common/auth"
+	"github.com/net-byte/vtun/common/cipher"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xcrypto"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/transport"
+)
+
+// prologue binds the handshake to the protocol version
+var prologue = []byte{'v', 't', 'u', 'n', xproto.ProtocolVersion}
+
+// secureConn is the session layer on top of a transport connection.
+// The packets are sealed with the keys of the handshake, whatever the transport is,
+// so the transports only have to frame them.
+type secureConn struct {
+	conn   transport.Conn
+	config config.Config
+	xp     *xcrypto.XCrypto
+	// obfs and compress are the options of the session, the server follows each client
+	obfs     bool
+	compress bool
+	wmu      sync.Mutex
+	// lastRecv is the time of the last frame of the peer in unix nanoseconds
+	lastRecv atomic.Int64
+	// srtt and rttvar are the smoothed round trip time and its variation, they are 0 until the first pong
+	rttMu  sync.Mutex
+	srtt   time.Duration
+	rttvar time.Duration
+	// batch coalesces the written packets when batching is enabled, pending are the packets of the last batch not read yet
+	batch   *batcher
+	pending []byte
+	// closeOnce sends the close frame and closes the transport connection once
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// errPeerClosed is returned by ReadPacket once the peer closed the session
+var errPeerClosed = errors.New("session closed by the peer")
+
+// errRejected is returned by the handshake of a client which failed the authentication
+var errRejected = errors.New("rejected by the server, the user is unknown or disabled or the key is wrong")
+
+// closeTimeout bounds the time spent sending the queued packets and the close frame to the peer
+const closeTimeout = time.Second
+
+// aeads are the frame ciphers of the cipher ids
+var aeads = map[byte]xcrypto.AEADFunc{
+	xproto.CipherAESGCM:           xcrypto.NewAESGCM,
+	xproto.CipherChaCha20Poly1305: xcrypto.NewChaCha20Poly1305,
+}
+
+// clientHandshake runs the handshake of the client identified by id on conn and returns the addresses assigned by the server.
+// The user name is sent in the clear and authenticated as part of the prologue,
+// without user the shared key of the config is used.
+func clientHandshake(config config.Config, id []byte, conn transport.Conn) (*secureConn, *xproto.ServerHandshakePacket, error) {
+	timer := time.AfterFunc(handshakeTimeout(config), func() { conn.Close() })
+	defer timer.Stop()
+	if len(config.User) > 255 {
+		return nil, nil, errors.New("user name is too long")
+	}
+	secret := config.Key
+	if config.User != "" {
+		secret = config.Secret
+	}
+	hs, err := xcrypto.NewHandshake(secret, userPrologue(config.User), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := xproto.GenClientHandshakePacket(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj.ClientID = id
+	msg, err := hs.WriteMessage(obj.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &secureConn{conn: conn, config: config, obfs: config.Obfs}
+	header := append([]byte{xproto.ProtocolVersion, byte(len(config.User))}, config.User...)
+	if err = c.writeFrame(xproto.Merge(header, msg)); err != nil {
+		return nil, nil, err
+	}
+	msg, err = c.readHandshake()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(msg) == 1 && msg[0] == xproto.FrameClose {
+		return nil, nil, errRejected
+	}
+	payload, err := hs.ReadMessage(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	reply := xproto.ParseServerHandshakePacket(payload)
+	if reply == nil {
+		return nil, nil, errors.New("invalid handshake reply")
+	}
+	if reply.Error != "" {
+		return nil, nil, fmt.Errorf("rejected by the server: %s", reply.Error)
+	}
+	if bytes.IndexByte(obj.Codecs, reply.Codec) < 0 || bytes.IndexByte(obj.Ciphers, reply.Cipher) < 0 {
+		return nil, nil, fmt.Errorf("the server chose the unsupported compression %s or cipher %s",
+			xproto.CodecNames([]byte{reply.Codec}), xproto.CipherNames([]byte{reply.Cipher}))
+	}
+	c.compress = reply.Codec == xproto.CodecSnappy
+	if c.xp, err = hs.XCryptoWith(aeads[reply.Cipher]); err != nil {
+		return nil, nil, err
+	}
+	// the batch frames fit in the mtu of the server too
+	if reply.MTU > 0 && reply.MTU < config.MTU {
+		config.MTU = reply.MTU
+	}
+	c.batch = newBatcher(config, c.conn, c.writeBatch)
+	c.lastRecv.Store(time.Now().UnixNano())
+	return c, reply, nil
+}
+
+// negotiate returns the first compression codec and cipher offered by the client which the server accepts
+func negotiate(config config.Config, obj *xproto.ClientHandshakePacket) (codec byte, cipherID byte, err error) {
+	codecs := xproto.Codecs(config.Compress)
+	codec, ok := xproto.Negotiate(obj.Codecs, codecs)
+	if !ok {
+		return 0, 0, fmt.Errorf("no common compression, the client offers %s and the server accepts %s",
+			xproto.CodecNames(obj.Codecs), xproto.CodecNames(codecs))
+	}
+	ciphers, err := xproto.ParseCiphers(config.Cipher)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cipherID, ok = xproto.Negotiate(obj.Ciphers, ciphers); !ok {
+		return 0, 0, fmt.Errorf("no common cipher, the client offers %s and the server accepts %s",
+			xproto.CipherNames(obj.Ciphers), xproto.CipherNames(ciphers))
+	}
+	return codec, cipherID, nil
+}
+
+// assignFunc returns the reply to a client which passed the authentication, with the addresses assigned to it
+type assignFunc func(obj *xproto.ClientHandshakePacket, user *auth.User) (*xproto.ServerHandshakePacket, error)
+
+// serverHandshake verifies the handshake of a client on conn and replies with the addresses of assign,
+// the compression and the cipher are negotiated and the obfuscation is detected for each client.
+// A client which is rejected once authenticated is told the reason, before it is only told that it is rejected. With a users database the client
+// must authenticate as one of its enabled users, who is returned, otherwise the shared key of the config
+// is used and the user is nil.
+func serverHandshake(config config.Config, conn transport.Conn, users *auth.Users, assign assignFunc) (*secureConn, *auth.User, *xproto.ServerHandshakePacket, error) {
+	timer := time.AfterFunc(handshakeTimeout(config), func() { conn.Close() })
+	defer timer.Stop()
+	c := &secureConn{conn: conn, config: config}
+	b, err := c.conn.ReadPacket()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// the first byte is the protocol version, the client obfuscates its frames if it only matches once deobfuscated
+	if len(b) > 0 && b[0] != xproto.ProtocolVersion && cipher.XOR([]byte{b[0]})[0] == xproto.ProtocolVersion {
+		c.obfs = true
+		b = cipher.XOR(b)
+	}
+	msg, err := checkHandshake(b)
+	if err != nil {
+		c.reject()
+		return nil, nil, nil, err
+	}
+	if len(msg) == 0 || len(msg) < 1+int(msg[0]) {
+		c.reject()
+		return nil, nil, nil, errors.New("invalid handshake message")
+	}
+	name := string(msg[1 : 1+msg[0]])
+	msg = msg[1+msg[0]:]
+	var user *auth.User
+	secret := config.Key
+	if users != nil {
+		if user, err = users.Lookup(name); err != nil {
+			c.reject()
+			return nil, nil, nil, fmt.Errorf("user %q: %w", name, err)
+		}
+		secret = user.Secret
+	} else if name != "" {
+		c.reject()
+		return nil, nil, nil, fmt.Errorf("user %q: %w", name, auth.ErrUnknownUser)
+	}
+	hs, err := xcrypto.NewHandshake(secret, userPrologue(name), false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	payload, err := hs.ReadMessage(msg)
+	if err != nil {
+		c.reject()
+		return nil, nil, nil, errors.New("authentication failed")
+	}
+	obj := xproto.ParseClientHandshakePacket(payload)
+	if obj == nil {
+		return nil, nil, nil, errors.New("hs == nil")
+	}
+	codec, cipherID, err := negotiate(config, obj)
+	var reply *xproto.ServerHandshakePacket
+	if err == nil {
+		reply, err = assign(obj, user)
+	}
+	if err != nil {
+		if rejection, werr := hs.WriteMessage((&xproto.ServerHandshakePacket{Error: err.Error()}).Bytes()); werr == nil {
+			c.writeFrame(xproto.Merge([]byte{xproto.ProtocolVersion}, rejection))
+		}
+		return nil, nil, nil, err
+	}
+	reply.Codec, reply.Cipher = codec, cipherID
+	c.compress = codec == xproto.CodecSnappy
+	msg, err = hs.WriteMessage(reply.Bytes())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = c.writeFrame(xproto.Merge([]byte{xproto.ProtocolVersion}, msg)); err != nil {
+		return nil, nil, nil, err
+	}
+	if c.xp, err = hs.XCryptoWith(aeads[cipherID]); err != nil {
+		return nil, nil, nil, err
+	}
+	c.batch = newBatcher(config, c.conn, c.writeBatch)
+	c.lastRecv.Store(time.Now().UnixNano())
+	return c, user, reply, nil
+}
+
+// userPrologue returns the prologue of the handshake of the user
+func userPrologue(name string) []byte {
+	return append(xproto.Copy(prologue), name...)
+}
+
+// handshakeTimeout returns the time allowed to complete the handshake
+func handshakeTimeout(config config.Config) time.Duration {
+	if config.Timeout > 0 {
+		return time.Duration(config.Timeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// reject tells a client which fails the authentication that it is rejected, so it does not wait for the handshake timeout.
+// No key is agreed yet, the same frame is sent whatever the reason is so it does not tell which users exist.
+func (c *secureConn) reject() {
+	c.writeFrame([]byte{xproto.ProtocolVersion, xproto.FrameClose})
+}
+
+// readHandshake reads a handshake message and checks its protocol version
+func (c *secureConn) readHandshake() ([]byte, error) {
+	b, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	return checkHandshake(b)
+}
+
+// checkHandshake checks the protocol version of a handshake frame and returns its message
+func checkHandshake(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty handshake message")
+	}
+	if err := xproto.CheckVersion(b[0]); err != nil {
+		return nil, err
+	}
+	return b[1:], nil
+}
+
+func (c *secureConn) readFrame() ([]byte, error) {
+	b, err := c.conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if c.obfs {
+		b = cipher.XOR(b)
+	}
+	return b, nil
+}
+
+// writeFrame writes a frame, the writes of the data and of the pongs of the reading goroutine are serialized
+func (c *secureConn) writeFrame(b []byte) error {
+	if c.obfs {
+		b = cipher.XOR(b)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.conn.WritePacket(b)
+}
+
+// ReadPacket returns the next data packet, the packets of a batch frame are returned one by one.
+// The pings are answered and the frames which fail to open are dropped.
+func (c *secureConn) ReadPacket() ([]byte, error) {
+	for {
+		if len(c.pending) > 0 {
+			packet, rest, ok := xproto.NextBatchPacket(c.pending)
+			if !ok {
+				c.pending = nil
+				continue
+			}
+			c.pending = rest
+			return packet, nil
+		}
+		b, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		b, err = c.xp.Decode(b)
+		if err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+			continue
+		}
+		if len(b) == 0 {
+			continue
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+		typ := b[0]
+		switch typ {
+		case xproto.FramePing:
+			if err = c.writeControl(xproto.FramePong, b[1:]); err != nil {
+				return nil, err
+			}
+			continue
+		case xproto.FramePong:
+			c.updateRTT(b[1:])
+			continue
+		case xproto.FrameClose:
+			return nil, errPeerClosed
+		case xproto.FrameData, xproto.FrameBatch:
+		default:
+			continue
+		}
+		b = b[1:]
+		if c.compress {
+			b, err = snappy.Decode(nil, b)
+			if err != nil {
+				netutil.PrintErr(err, c.config.Verbose)
+				continue
+			}
+		}
+		if typ == xproto.FrameBatch {
+			c.pending = b
+			continue
+		}
+		return b, nil
+	}
+}
+
+// WritePacket seals b into a data frame, or queues it in the next batch frame when batching is enabled
+func (c *secureConn) WritePacket(b []byte) error {
+	if c.batch != nil {
+		return c.batch.add(b)
+	}
+	return c.writeData(xproto.FrameData, b)
+}
+
+// writeBatch seals the queued packets of the batcher into a batch frame, a lone packet into a data frame
+func (c *secureConn) writeBatch(batch []byte) error {
+	if packet, rest, ok := xproto.NextBatchPacket(batch); ok && len(rest) == 0 {
+		return c.writeData(xproto.FrameData, packet)
+	}
+	return c.writeData(xproto.FrameBatch, batch)
+}
+
+// writeData seals the payload into a frame of the type, compressed if the session is
+func (c *secureConn) writeData(typ byte, b []byte) error {
+	if c.compress {
+		b = snappy.Encode(nil, b)
+	}
+	b, err := c.xp.Encode(xproto.Merge([]byte{typ}, b))
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(b)
+}
+
+// writeControl seals a control frame of the type
+func (c *secureConn) writeControl(typ byte, payload []byte) error {
+	b, err := c.xp.Encode(xproto.Merge([]byte{typ}, payload))
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(b)
+}
+
+// Ping sends a ping frame with the current time, the pong of the peer updates the round trip time
+func (c *secureConn) Ping() error {
+	return c.writeControl(xproto.FramePing, xproto.AppendTimestamp(nil, time.Now()))
+}
+
+// updateRTT updates the round trip time with the send time echoed by a pong, like the tcp estimator of RFC 6298
+func (c *secureConn) updateRTT(payload []byte) {
+	sent, ok := xproto.ParseTimestamp(payload)
+	if !ok {
+		return
+	}
+	rtt := time.Since(sent)
+	if rtt < 0 {
+		return
+	}
+	c.rttMu.Lock()
+	defer c.rttMu.Unlock()
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+		return
+	}
+	delta := c.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	c.rttvar = (3*c.rttvar + delta) / 4
+	c.srtt = (7*c.srtt + rtt) / 8
+}
+
+// RTT returns the smoothed round trip time and its variation, they are 0 until the first pong
+func (c *secureConn) RTT() (srtt, rttvar time.Duration) {
+	c.rttMu.Lock()
+	defer c.rttMu.Unlock()
+	return c.srtt, c.rttvar
+}
+
+// LastRecv returns the time of the last frame received from the peer
+func (c *secureConn) LastRecv() time.Time {
+	return time.Unix(0, c.lastRecv.Load())
+}
+
+// keepAlive pings the peer at every interval until the context is done. The connection is closed once
+// nothing was received for the timeout, then a client reconnects and a server drops the session.
+func (c *secureConn) keepAlive(_ctx context.Context, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if idle := time.Since(c.LastRecv()); idle > timeout {
+			log.Printf("no frame from %v for %v, the peer is dead", c.RemoteAddr(), idle.Round(time.Millisecond))
+			c.Close()
+			return
+		}
+		if err := c.Ping(); err != nil {
+			netutil.PrintErr(err, c.config.Verbose)
+		}
+	}
+}
+
+// keepAliveTimes returns the ping interval and the dead peer timeout of the config
+func keepAliveTimes(config config.Config) (interval, timeout time.Duration) {
+	interval, timeout = 10*time.Second, 40*time.Second
+	if config.KeepAlive > 0 {
+		interval = time.Duration(config.KeepAlive) * time.Second
+	}
+	if config.DeadTimeout > 0 {
+		timeout = time.Duration(config.DeadTimeout) * time.Second
+	}
+	return interval, timeout
+}
+
+func (c *secureConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close flushes the queued packets, tells the peer that the session is closed and closes the transport connection.
+// A peer which does not take the frames within the close timeout is not waited for.
+func (c *secureConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.xp != nil {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if c.batch != nil {
+					c.batch.close()
+				}
+				c.writeControl(xproto.FrameClose, nil)
+			}()
+			timer := time.NewTimer(closeTimeout)
+			select {
+			case <-done:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
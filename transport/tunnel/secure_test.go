@@ -0,0 +1,358 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/auth"
+	"github.com/net-byte/vtun/common/cipher"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeConn is one end of an in-memory packet connection
+type pipeConn struct {
+	in   chan []byte
+	out  chan []byte
+	done chan struct{}
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a := make(chan []byte, 16)
+	b := make(chan []byte, 16)
+	done := make(chan struct{})
+	return &pipeConn{in: a, out: b, done: done}, &pipeConn{in: b, out: a, done: done}
+}
+
+func (c *pipeConn) ReadPacket() ([]byte, error) {
+	// the frames written before the close are read first, like on a socket
+	select {
+	case b := <-c.in:
+		return b, nil
+	default:
+	}
+	select {
+	case b := <-c.in:
+		return b, nil
+	case <-c.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (c *pipeConn) WritePacket(b []byte) error {
+	c.out <- xproto.Copy(b)
+	return nil
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr { return &net.UDPAddr{} }
+
+func (c *pipeConn) Close() error {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	return nil
+}
+
+func testConfig(key string) config.Config {
+	return config.Config{Key: key, CIDR: "172.16.0.10/24", CIDRv6: "fced:9999::9999/64", Timeout: 5, Compress: true, Obfs: true}
+}
+
+// testAssign assigns the address the client prefers
+func testAssign(obj *xproto.ClientHandshakePacket, _ *auth.User) (*xproto.ServerHandshakePacket, error) {
+	ip, _ := netip.AddrFromSlice(obj.CIDRv4.To4())
+	return &xproto.ServerHandshakePacket{
+		CIDRv4:   netip.PrefixFrom(ip, 24),
+		ServerIP: netip.MustParseAddr("172.16.0.1"),
+	}, nil
+}
+
+func handshakePair(t *testing.T, client, server config.Config, users *auth.Users) (*secureConn, *secureConn, error) {
+	c, s := newPipe()
+	type result struct {
+		conn *secureConn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		sc, _, _, err := serverHandshake(server, s, users, testAssign)
+		if err != nil {
+			s.Close()
+		}
+		ch <- result{sc, err}
+	}()
+	cc, _, err := clientHandshake(client, make([]byte, xproto.ClientIDLength), c)
+	r := <-ch
+	if err == nil {
+		err = r.err
+	}
+	return cc, r.conn, err
+}
+
+func TestSecureConn(t *testing.T) {
+	client, server, err := handshakePair(t, testConfig("freedom"), testConfig("freedom"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 172, 16, 0, 10, 172, 16, 0, 1}
+	assert.Nil(t, client.WritePacket(xproto.Copy(packet)))
+	b, err := server.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+	assert.Nil(t, server.WritePacket(xproto.Copy(packet)))
+	b, err = client.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+
+	// injected frames are dropped
+	client.conn.WritePacket([]byte("garbage"))
+	assert.Nil(t, client.WritePacket(xproto.Copy(packet)))
+	b, err = server.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+}
+
+func TestSecureConn_ObfsKey(t *testing.T) {
+	const key = "correct horse battery staple"
+	cipher.SetKey(key)
+	defer cipher.SetKey("vtun@2022")
+	cfg := testConfig(key)
+	client, server, err := handshakePair(t, cfg, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, server.obfs)
+	// the counter prefix of the frames is mostly zero bytes, their obfuscation must not reveal the key
+	assert.Nil(t, client.WritePacket(make([]byte, 64)))
+	frame := <-client.conn.(*pipeConn).out
+	for i := 0; i+4 <= len(key); i++ {
+		assert.False(t, bytes.Contains(frame, []byte(key[i:i+4])), key[i:i+4])
+	}
+}
+
+func TestSecureConn_WrongKey(t *testing.T) {
+	_, _, err := handshakePair(t, testConfig("freedom"), testConfig("other"), nil)
+	assert.NotNil(t, err)
+}
+
+func TestSecureConn_User(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"name": "alice", "secret": "a", "enabled": true}, {"name": "bob", "secret": "b"}]`), 0600))
+	users, err := auth.LoadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userConfig := func(user, secret string) config.Config {
+		c := testConfig("freedom")
+		c.User = user
+		c.Secret = secret
+		return c
+	}
+	_, _, err = handshakePair(t, userConfig("alice", "a"), testConfig("freedom"), users)
+	assert.Nil(t, err)
+	// wrong secret
+	_, _, err = handshakePair(t, userConfig("alice", "b"), testConfig("freedom"), users)
+	assert.NotNil(t, err)
+	// disabled user
+	_, _, err = handshakePair(t, userConfig("bob", "b"), testConfig("freedom"), users)
+	assert.NotNil(t, err)
+	// the shared key is not accepted when the server has users
+	_, _, err = handshakePair(t, testConfig("freedom"), testConfig("freedom"), users)
+	assert.NotNil(t, err)
+	// users are not accepted without users file
+	_, _, err = handshakePair(t, userConfig("alice", "a"), testConfig("freedom"), nil)
+	assert.NotNil(t, err)
+}
+
+func TestSecureConn_Reject(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"name": "alice", "secret": "a", "enabled": true}, {"name": "bob", "secret": "b"}]`), 0600))
+	users, err := auth.LoadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ user, secret string }{{"carol", "c"}, {"bob", "b"}, {"alice", "b"}} {
+		cfg := testConfig("freedom")
+		cfg.User, cfg.Secret, cfg.Timeout = tt.user, tt.secret, 30
+		// the server keeps the connection open, the client fails on the reject frame, not on its timeout
+		c, s := newPipe()
+		go serverHandshake(testConfig("freedom"), s, users, testAssign)
+		start := time.Now()
+		_, _, err := clientHandshake(cfg, make([]byte, xproto.ClientIDLength), c)
+		assert.ErrorIs(t, err, errRejected, tt.user)
+		assert.Less(t, time.Since(start), time.Second, tt.user)
+		s.Close()
+	}
+}
+
+func TestHandshake_Assign(t *testing.T) {
+	c, s := newPipe()
+	id := []byte("0123456789abcdef")
+	go func() {
+		_, _, _, err := serverHandshake(testConfig("freedom"), s, nil, func(obj *xproto.ClientHandshakePacket, _ *auth.User) (*xproto.ServerHandshakePacket, error) {
+			assert.Equal(t, id, obj.ClientID)
+			assert.Equal(t, "172.16.0.10", obj.CIDRv4.String())
+			return &xproto.ServerHandshakePacket{
+				CIDRv4:   netip.MustParsePrefix("172.16.0.2/24"),
+				ServerIP: netip.MustParseAddr("172.16.0.1"),
+			}, nil
+		})
+		assert.Nil(t, err)
+	}()
+	_, reply, err := clientHandshake(testConfig("freedom"), id, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "172.16.0.2/24", reply.CIDRv4.String())
+	assert.Equal(t, "172.16.0.1", reply.ServerIP.String())
+	assert.False(t, reply.CIDRv6.IsValid())
+}
+
+func TestHandshake_Negotiate(t *testing.T) {
+	plain := testConfig("freedom")
+	plain.Compress = false
+	plain.Obfs = false
+	// the server follows the obfuscation of the client and only compresses if both sides enable it
+	client, server, err := handshakePair(t, testConfig("freedom"), plain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, server.obfs)
+	assert.False(t, client.compress || server.compress)
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 172, 16, 0, 10, 172, 16, 0, 1}
+	assert.Nil(t, client.WritePacket(xproto.Copy(packet)))
+	b, err := server.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+
+	// a compressing server accepts the clients without compression
+	client, server, err = handshakePair(t, plain, testConfig("freedom"), nil)
+	assert.Nil(t, err)
+	assert.False(t, server.obfs)
+	assert.False(t, client.compress || server.compress)
+	client, server, err = handshakePair(t, testConfig("freedom"), testConfig("freedom"), nil)
+	assert.Nil(t, err)
+	assert.True(t, client.compress && server.compress)
+
+	// the client learns why it is rejected
+	chacha := testConfig("freedom")
+	chacha.Cipher = "chacha20-poly1305"
+	aes := testConfig("freedom")
+	aes.Cipher = "aes-gcm"
+	_, _, err = handshakePair(t, chacha, aes, nil)
+	assert.ErrorContains(t, err, "no common cipher, the client offers chacha20-poly1305 and the server accepts aes-gcm")
+	chacha.Cipher = "chacha20-poly1305, aes-gcm"
+	client, server, err = handshakePair(t, chacha, testConfig("freedom"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, server.WritePacket(xproto.Copy(packet)))
+	b, err = client.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+}
+
+func TestSecureConn_Ping(t *testing.T) {
+	client, server, err := handshakePair(t, testConfig("freedom"), testConfig("freedom"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ping is answered while the server reads the next packet, the pong is handled while the client does
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 172, 16, 0, 10, 172, 16, 0, 1}
+	assert.Nil(t, client.Ping())
+	assert.Nil(t, client.WritePacket(xproto.Copy(packet)))
+	b, err := server.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+	assert.Nil(t, server.WritePacket(xproto.Copy(packet)))
+	b, err = client.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+	srtt, rttvar := client.RTT()
+	assert.Greater(t, srtt, time.Duration(0))
+	assert.Equal(t, srtt/2, rttvar)
+	srtt, _ = server.RTT()
+	assert.Zero(t, srtt)
+}
+
+func TestSecureConn_DeadPeer(t *testing.T) {
+	client, _, err := handshakePair(t, testConfig("freedom"), testConfig("freedom"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the server does not answer, the client closes the connection
+	go client.keepAlive(ctx, 10*time.Millisecond, 50*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ReadPacket()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dead peer is not detected")
+	}
+}
+
+func TestSecureConn_Batch(t *testing.T) {
+	clientConfig := testConfig("freedom")
+	// the third packet fills the batch
+	clientConfig.Batch, clientConfig.BatchDelay = 3*22, 1000
+	client, server, err := handshakePair(t, clientConfig, testConfig("freedom"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 172, 16, 0, 10, 172, 16, 0, 1}
+	for i := byte(0); i < 3; i++ {
+		packet[19] = i
+		assert.Nil(t, client.WritePacket(packet))
+	}
+	assert.Len(t, client.conn.(*pipeConn).out, 1)
+	for i := byte(0); i < 3; i++ {
+		b, err := server.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, i, b[19])
+	}
+	// a lone packet is flushed once the delay expired
+	packet[19] = 3
+	assert.Nil(t, client.WritePacket(packet))
+	b, err := server.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+	// the server does not batch
+	assert.Nil(t, server.WritePacket(packet))
+	b, err = client.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+}
+
+func TestSecureConn_Close(t *testing.T) {
+	clientConfig := testConfig("freedom")
+	clientConfig.Batch, clientConfig.BatchDelay = 4096, int(time.Hour/time.Microsecond)
+	client, server, err := handshakePair(t, clientConfig, testConfig("freedom"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the queued packet is flushed before the close frame
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 172, 16, 0, 10, 172, 16, 0, 1}
+	assert.Nil(t, client.WritePacket(packet))
+	assert.Nil(t, client.Close())
+	assert.Nil(t, client.Close())
+	assert.ErrorIs(t, client.WritePacket(packet), net.ErrClosed)
+	b, err := server.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, packet, b)
+	_, err = server.ReadPacket()
+	assert.ErrorIs(t, err, errPeerClosed)
+}
@@ -0,0 +1,468 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/net-byte/vtun/common/auth"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/counter"
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/net-byte/vtun/common/x/xdns"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/register"
+	"github.com/net-byte/vtun/transport"
+	"github.com/net-byte/vtun/transport/tun"
+	"github.com/net-byte/water"
+)
+
+// Server forwards packets between the tun interface and the clients of a transport
+type Server struct {
+	config    config.Config
+	transport transport.Transport
+	iFace     *water.Interface
+	sessions  *SessionTable
+	users     *auth.Users
+	// the tun prefixes of the server, the client addresses are assigned from them
+	ipv4 netip.Prefix
+	ipv6 netip.Prefix
+	// the routes, dns servers and search domains pushed to the clients
+	routes []netip.Prefix
+	dns    []netip.Addr
+	search []string
+}
+
+// maxPushedRoutes keeps the handshake reply in a frame
+const maxPushedRoutes = 1000
+
+// NewServer returns a server for the given transport
+func NewServer(t transport.Transport, iFace *water.Interface, config config.Config) *Server {
+	return &Server{config: config, transport: t, iFace: iFace, sessions: NewSessionTable()}
+}
+
+// StartServer runs the server of the transport on the tun interface until the context is done
+func StartServer(_ctx context.Context, iFace *water.Interface, t transport.Transport, config config.Config) error {
+	return NewServer(t, iFace, config).Serve(_ctx)
+}
+
+// Sessions returns the table of the connected clients
+func (s *Server) Sessions() *SessionTable {
+	return s.sessions
+}
+
+// Serve accepts the connections of the transport until the context is done, then it closes the listener
+// and the sessions, the clients are told so, and returns once the sessions are cleaned up.
+// It returns an error if the listener fails before.
+func (s *Server) Serve(_ctx context.Context) error {
+	var err error
+	if s.ipv4, err = netip.ParsePrefix(s.config.CIDR); err != nil || !s.ipv4.Addr().Is4() {
+		return fmt.Errorf("invalid cidr %q", s.config.CIDR)
+	}
+	if s.config.CIDRv6 != "" {
+		if s.ipv6, err = netip.ParsePrefix(s.config.CIDRv6); err != nil || !s.ipv6.Addr().Is6() {
+			return fmt.Errorf("invalid ipv6 cidr %q", s.config.CIDRv6)
+		}
+	}
+	if s.config.IPv6Mode != "ipv4" && s.config.IPv6Mode != "user" {
+		return fmt.Errorf("invalid ipv6 mode %q", s.config.IPv6Mode)
+	}
+	if s.routes, err = tun.ParseRoutes(s.config.PushRoutes); err != nil {
+		return fmt.Errorf("invalid push routes: %w", err)
+	}
+	if len(s.routes) > maxPushedRoutes {
+		return fmt.Errorf("%d push routes, at most %d are supported", len(s.routes), maxPushedRoutes)
+	}
+	if s.dns, err = xproto.ParseAddrs(s.config.DNS); err != nil {
+		return fmt.Errorf("invalid dns: %w", err)
+	}
+	if s.search, err = xproto.ParseDomains(s.config.DNSSearch); err != nil {
+		return fmt.Errorf("invalid dns search: %w", err)
+	}
+	pools := []netip.Prefix{s.ipv4}
+	if s.ipv6.IsValid() {
+		pools = append(pools, s.ipv6)
+	}
+	if s.config.LeaseFile != "" {
+		if err := register.Open(s.config.LeaseFile, pools...); err != nil {
+			return fmt.Errorf("lease store %s: %w", s.config.LeaseFile, err)
+		}
+		defer register.Close()
+	}
+	if s.config.UsersFile != "" {
+		users, err := auth.LoadUsers(s.config.UsersFile, pools...)
+		if err != nil {
+			return err
+		}
+		s.users = users
+		users.OnReload(s.reloadUsers)
+		s.reloadUsers(nil)
+	}
+	if s.config.DNSUpstreams != "" {
+		dns, err := s.startDNS()
+		if err != nil {
+			return fmt.Errorf("dns server: %w", err)
+		}
+		defer dns.Close()
+	}
+	ctx, cancel := context.WithCancel(_ctx)
+	defer cancel()
+	ln, err := s.transport.Listen(ctx, s.config)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("vtun %s server started on %v", s.transport.Name(), s.config.LocalAddr)
+	var wg sync.WaitGroup
+	// on return the sessions are closed and waited for before the lease store and the dns server are closed
+	defer wg.Wait()
+	defer cancel()
+	go s.keepLeases(ctx)
+	// server -> client
+	go s.toClient()
+	// client -> server
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if _ctx.Err() != nil {
+					log.Printf("vtun %s server stopping, closing the sessions", s.transport.Name())
+					return nil
+				}
+				return fmt.Errorf("vtun %s listener closed", s.transport.Name())
+			}
+			netutil.PrintErr(err, s.config.Verbose)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// startDNS starts the dns server on the tun addresses, it is pushed to the clients unless other dns servers are
+func (s *Server) startDNS() (*xdns.Server, error) {
+	upstreams, err := xdns.ParseUpstreams(s.config.DNSUpstreams)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []netip.Addr{s.ipv4.Addr()}
+	allowed := []netip.Prefix{s.ipv4.Masked()}
+	if s.ipv6.IsValid() {
+		addrs = append(addrs, s.ipv6.Addr())
+		allowed = append(allowed, s.ipv6.Masked())
+	}
+	dns := xdns.NewServer(s.config.DNSDomain, upstreams, s.lookupName, allowed)
+	if err = dns.Start(addrs); err != nil {
+		return nil, err
+	}
+	if len(s.dns) == 0 {
+		s.dns = addrs
+		if len(s.search) == 0 && s.config.DNSDomain != "" {
+			s.search = []string{strings.Trim(s.config.DNSDomain, ".")}
+		}
+	}
+	return dns, nil
+}
+
+// lookupName returns the addresses of the connected clients of the user name and the reserved ones of the name
+func (s *Server) lookupName(name string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, sess := range s.sessions.Sessions() {
+		if sess.User() == "" || !strings.EqualFold(sess.User(), name) {
+			continue
+		}
+		for _, addr := range []netip.Addr{sess.IPv4(), sess.IPv6()} {
+			if addr.IsValid() {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	for _, r := range register.Reservations() {
+		if addr, err := netip.ParseAddr(r.IP); err == nil && r.Name != "" && strings.EqualFold(r.Name, name) {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+// serveConn runs the handshake of a new connection and serves its session until the context is done
+func (s *Server) serveConn(_ctx context.Context, conn transport.Conn) {
+	stop := context.AfterFunc(_ctx, func() { conn.Close() })
+	sc, user, reply, err := serverHandshake(s.config, conn, s.users, s.assign)
+	stop()
+	if err != nil {
+		netutil.PrintErrF(s.config.Verbose, "handshake with %v failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	ctx, cancel := context.WithCancel(_ctx)
+	defer cancel()
+	// the session is closed with a close frame when the server stops
+	context.AfterFunc(ctx, func() { sc.Close() })
+	interval, timeout := keepAliveTimes(s.config)
+	go sc.keepAlive(ctx, interval, timeout)
+	if user == nil {
+		sess := NewSession(sc, s.transport.Name(), "")
+		sess.id = hex.EncodeToString(reply.SessionID)
+		s.toServer(sess, reply.CIDRv4.Addr(), reply.CIDRv6.Addr())
+		return
+	}
+	log.Printf("user %s connected from %v via %s", user.Name, conn.RemoteAddr(), s.transport.Name())
+	sess := NewSession(sc, s.transport.Name(), user.Name)
+	sess.id = hex.EncodeToString(reply.SessionID)
+	sess.SetSubnets(reply.Subnets)
+	s.toServer(sess, reply.CIDRv4.Addr(), reply.CIDRv6.Addr())
+	log.Printf("user %s disconnected from %v", user.Name, conn.RemoteAddr())
+}
+
+// reloadUsers reserves the fixed addresses of the users, then it closes the sessions of the revoked users
+// and the sessions holding the fixed address of another user
+func (s *Server) reloadUsers(revoked []string) {
+	fixed := s.users.FixedAddrs()
+	ips := make([]string, 0, len(fixed))
+	for addr := range fixed {
+		ips = append(ips, addr.String())
+	}
+	register.SetFixedIPs(ips)
+	for _, sess := range s.sessions.Sessions() {
+		reason := ""
+		if sess.User() != "" && slices.Contains(revoked, sess.User()) {
+			reason = fmt.Sprintf("user %s is revoked or changed", sess.User())
+		}
+		for _, addr := range []netip.Addr{sess.IPv4(), sess.IPv6()} {
+			if owner, ok := fixed[addr]; ok && owner != sess.User() {
+				reason = fmt.Sprintf("%v is fixed to user %s", addr, owner)
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		log.Printf("closing the session of %v, %s", sess.RemoteAddr(), reason)
+		// the session is removed at once, sending its close frame may take a while
+		s.sessions.Remove(sess)
+		go sess.Close()
+	}
+}
+
+// assign returns the addresses of a client, the fixed addresses of the user are used first,
+// then the address leased to the client or the one it prefers if it is free.
+// The ipv6 is derived from the ipv4 or from the user, so a client keeps it across reconnections.
+func (s *Server) assign(obj *xproto.ClientHandshakePacket, user *auth.User) (*xproto.ServerHandshakePacket, error) {
+	owner := hex.EncodeToString(obj.ClientID)
+	var ipv4, ipv6 netip.Addr
+	if user != nil {
+		owner = user.Name + "/" + owner
+		ipv4, ipv6 = user.Addrs()
+	}
+	if ipv4.IsValid() {
+		register.KeepAliveClientIP(ipv4.String())
+	} else {
+		ip, _ := register.LeaseClientIP(s.config.CIDR, obj.CIDRv4.String(), owner)
+		if ip == "" {
+			return nil, fmt.Errorf("no free address in %s", s.config.CIDR)
+		}
+		ipv4 = netip.MustParseAddr(ip)
+	}
+	reply := &xproto.ServerHandshakePacket{
+		CIDRv4:    netip.PrefixFrom(ipv4, s.ipv4.Bits()),
+		ServerIP:  s.ipv4.Addr(),
+		MTU:       s.config.MTU,
+		Routes:    s.routes,
+		DNS:       s.dns,
+		Search:    s.search,
+		SessionID: make([]byte, xproto.SessionIDLength),
+	}
+	if _, err := rand.Read(reply.SessionID); err != nil {
+		return nil, err
+	}
+	if s.ipv6.IsValid() {
+		if ipv6.IsValid() {
+			register.KeepAliveClientIP(ipv6.String())
+		} else {
+			var ip string
+			if s.config.IPv6Mode == "user" {
+				name := owner
+				if user != nil {
+					name = user.Name
+				}
+				ip, _ = register.LeaseClientIPv6ByName(s.config.CIDRv6, name, ipv4.String(), owner)
+			} else {
+				ip, _ = register.LeaseClientIPv6(s.config.CIDRv6, ipv4.String(), owner)
+			}
+			if ip == "" {
+				return nil, fmt.Errorf("no free address in %s", s.config.CIDRv6)
+			}
+			ipv6 = netip.MustParseAddr(ip)
+		}
+		reply.CIDRv6 = netip.PrefixFrom(ipv6, s.ipv6.Bits())
+		reply.ServerIPv6 = s.ipv6.Addr()
+	}
+	if len(obj.Subnets) > 0 {
+		var allowed []netip.Prefix
+		if user != nil {
+			allowed = user.Prefixes()
+		}
+		var rejected []netip.Prefix
+		reply.Subnets, rejected = acceptSubnets(obj.Subnets, allowed)
+		if len(rejected) > 0 {
+			log.Printf("rejected subnets %v of %s, they are not allowed", rejected, owner)
+		}
+	}
+	return reply, nil
+}
+
+// acceptSubnets splits the subnets advertised by a client into the ones inside the allowed subnets and the others
+func acceptSubnets(advertised, allowed []netip.Prefix) (accepted, rejected []netip.Prefix) {
+	for _, subnet := range advertised {
+		ok := false
+		for _, p := range allowed {
+			if p.Bits() <= subnet.Bits() && p.Contains(subnet.Addr()) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			accepted = append(accepted, subnet)
+		} else {
+			rejected = append(rejected, subnet)
+		}
+	}
+	return accepted, rejected
+}
+
+// keepLeases refreshes the leases of the connected clients until the context is done
+func (s *Server) keepLeases(_ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-_ctx.Done():
+			return
+		case <-ticker.C:
+			// the revoked users are disconnected even if no client connects
+			if s.users != nil {
+				s.users.Reload()
+			}
+			for _, sess := range s.sessions.Sessions() {
+				for _, ip := range []netip.Addr{sess.IPv4(), sess.IPv6()} {
+					if ip.IsValid() {
+						register.KeepAliveClientIP(ip.String())
+					}
+				}
+			}
+		}
+	}
+}
+
+// toClient sends packets from tun to the clients
+func (s *Server) toClient() {
+	packet := make([]byte, s.config.BufferSize)
+	for {
+		n, err := s.iFace.Read(packet)
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			if strings.Contains(err.Error(), "file already closed") {
+				break
+			}
+			continue
+		}
+		b := packet[:n]
+		if dst := netutil.GetDstAddr(b); dst.IsValid() {
+			if sess, ok := s.sessions.Lookup(dst); ok {
+				if err := sess.WritePacket(b); err != nil {
+					netutil.PrintErr(err, s.config.Verbose)
+					s.closeSession(sess)
+					continue
+				}
+				counter.IncrWrittenBytes(n)
+			}
+		}
+	}
+}
+
+// toServer sends packets from a client to tun, the valid assigned addresses are bound to the session
+func (s *Server) toServer(sess *Session, ipv4, ipv6 netip.Addr) {
+	s.sessions.Add(sess)
+	defer s.deleteSubnetRoutes(sess)
+	defer s.closeSession(sess)
+	for _, addr := range []netip.Addr{ipv4, ipv6} {
+		if !addr.IsValid() {
+			continue
+		}
+		if prev := s.sessions.Bind(sess, addr); prev != nil {
+			netutil.PrintErrF(s.config.Verbose, "%v is taken over by %v from %v\n", addr, sess.RemoteAddr(), prev.RemoteAddr())
+		}
+	}
+	for _, subnet := range sess.Subnets() {
+		prev := s.sessions.Route(sess, subnet)
+		if prev != nil {
+			netutil.PrintErrF(s.config.Verbose, "%v is taken over by %v from %v\n", subnet, sess.RemoteAddr(), prev.RemoteAddr())
+		} else if s.config.SubnetRoutes {
+			if err := tun.AddSubnetRoute(s.config, s.iFace, subnet); err != nil {
+				log.Printf("failed to route %v: %v", subnet, err)
+			}
+		}
+	}
+	for {
+		b, err := sess.ReadPacket()
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			break
+		}
+		// the client may only send from its addresses and its subnets
+		if src := netutil.GetSrcAddr(b); !sess.CheckSource(src) {
+			netutil.PrintErrF(s.config.Verbose, "dropped packet from %v with spoofed source %v\n", sess.RemoteAddr(), src)
+			continue
+		}
+		dst := netutil.GetDstAddr(b)
+		// the packet is sent to another client
+		if peer, ok := s.sessions.Lookup(dst); ok {
+			n := len(b)
+			if err := peer.WritePacket(b); err != nil {
+				netutil.PrintErr(err, s.config.Verbose)
+				s.closeSession(peer)
+				continue
+			}
+			counter.IncrWrittenBytes(n)
+			continue
+		}
+		n, err := s.iFace.Write(b)
+		if err != nil {
+			netutil.PrintErr(err, s.config.Verbose)
+			break
+		}
+		counter.IncrReadBytes(n)
+	}
+}
+
+// deleteSubnetRoutes deletes the kernel routes of the subnets of the closed session which no other session took over
+func (s *Server) deleteSubnetRoutes(sess *Session) {
+	if !s.config.SubnetRoutes {
+		return
+	}
+	for _, subnet := range sess.Subnets() {
+		if _, ok := s.sessions.LookupRoute(subnet); !ok {
+			if err := tun.DeleteSubnetRoute(s.config, s.iFace, subnet); err != nil {
+				log.Printf("failed to delete route %v: %v", subnet, err)
+			}
+		}
+	}
+}
+
+// closeSession removes the session from the table and closes its connection
+func (s *Server) closeSession(sess *Session) {
+	s.sessions.Remove(sess)
+	sess.Close()
+}
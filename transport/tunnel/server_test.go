@@ -0,0 +1,176 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/net-byte/vtun/common/auth"
+	"github.com/net-byte/vtun/common/config"
+	"github.com/net-byte/vtun/common/x/xproto"
+	"github.com/net-byte/vtun/register"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Assign(t *testing.T) {
+	s := NewServer(nil, nil, config.Config{CIDR: "172.30.0.1/24", CIDRv6: "fced:30::1/64", MTU: 1400})
+	s.ipv4 = netip.MustParsePrefix(s.config.CIDR)
+	s.ipv6 = netip.MustParsePrefix(s.config.CIDRv6)
+	s.routes = []netip.Prefix{netip.MustParsePrefix("10.30.0.0/16")}
+	hello := func(id string, ip string) *xproto.ClientHandshakePacket {
+		return &xproto.ClientHandshakePacket{CIDRv4: net.ParseIP(ip), CIDRv6: net.IPv6zero, ClientID: []byte(id)}
+	}
+
+	a, err := s.assign(hello("a", "172.30.0.10"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.30.0.10/24", a.CIDRv4.String())
+	assert.Equal(t, "172.30.0.1", a.ServerIP.String())
+	assert.Equal(t, "fced:30::1", a.ServerIPv6.String())
+	assert.Equal(t, "fced:30::ac1e:a/64", a.CIDRv6.String())
+	assert.Equal(t, 1400, a.MTU)
+	assert.Equal(t, s.routes, a.Routes)
+	assert.Len(t, a.SessionID, xproto.SessionIDLength)
+
+	// another client with the same preferred address gets a free one
+	b, err := s.assign(hello("b", "172.30.0.10"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.30.0.2/24", b.CIDRv4.String())
+	assert.NotEqual(t, a.SessionID, b.SessionID)
+
+	// the client keeps its address on a reconnection
+	a, err = s.assign(hello("a", "172.30.0.99"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.30.0.10/24", a.CIDRv4.String())
+	assert.Equal(t, "fced:30::ac1e:a/64", a.CIDRv6.String())
+
+	// the fixed addresses of the user are used first
+	user := &auth.User{Name: "alice", IP: "172.30.0.50", IPv6: "fced:30::50"}
+	c, err := s.assign(hello("c", "172.30.0.10"), user)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.30.0.50/24", c.CIDRv4.String())
+	assert.Equal(t, "fced:30::50/64", c.CIDRv6.String())
+
+	// only the allowed subnets are routed
+	user.Subnets = []string{"192.168.0.0/16"}
+	obj := hello("c", "")
+	obj.Subnets = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.0.0/8")}
+	c, err = s.assign(obj, user)
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}, c.Subnets)
+	c, err = s.assign(obj, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, c.Subnets)
+
+	// the ipv6 derived from the user is the same whatever the ipv4 is
+	s.config.IPv6Mode = "user"
+	bob := &auth.User{Name: "bob"}
+	d, err := s.assign(hello("d", ""), bob)
+	assert.Nil(t, err)
+	register.DeleteClientIP(d.CIDRv4.Addr().String())
+	e, err := s.assign(hello("e", ""), bob)
+	assert.Nil(t, err)
+	assert.Equal(t, d.CIDRv6, e.CIDRv6)
+}
+
+func TestServer_AssignRestart(t *testing.T) {
+	s := NewServer(nil, nil, config.Config{CIDR: "172.31.0.1/24", CIDRv6: "fced:31::1/64"})
+	s.ipv4 = netip.MustParsePrefix(s.config.CIDR)
+	s.ipv6 = netip.MustParsePrefix(s.config.CIDRv6)
+	stateFile := filepath.Join(t.TempDir(), "vtun.state.json")
+	hello := func(c *Client) *xproto.ClientHandshakePacket {
+		return &xproto.ClientHandshakePacket{CIDRv4: net.IPv4zero, CIDRv6: net.IPv6zero, ClientID: c.id}
+	}
+
+	// another client takes the first address, so the restarted one only keeps its address by its id
+	a, err := s.assign(hello(NewClient(nil, config.Config{StateFile: stateFile})), nil)
+	assert.Nil(t, err)
+	other, err := s.assign(hello(NewClient(nil, config.Config{})), nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, a.CIDRv4, other.CIDRv4)
+
+	// the restarted client reads its id from the state directory and keeps its addresses
+	restarted := NewClient(nil, config.Config{StateFile: stateFile})
+	b, err := s.assign(hello(restarted), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, a.CIDRv4, b.CIDRv4)
+	assert.Equal(t, a.CIDRv6, b.CIDRv6)
+
+	// an invalid id is replaced
+	assert.Nil(t, os.WriteFile(stateFile+".id", []byte("invalid"), 0600))
+	c := NewClient(nil, config.Config{StateFile: stateFile})
+	assert.Len(t, c.id, xproto.ClientIDLength)
+	assert.NotEqual(t, restarted.id, c.id)
+	assert.Equal(t, c.id, NewClient(nil, config.Config{StateFile: stateFile}).id)
+}
+
+func TestServer_LookupName(t *testing.T) {
+	s := NewServer(nil, nil, config.Config{CIDR: "172.30.0.1/24"})
+	alice := NewSession(&fakeConn{}, "udp", "alice")
+	anonymous := NewSession(&fakeConn{}, "udp", "")
+	s.sessions.Add(alice)
+	s.sessions.Add(anonymous)
+	s.sessions.Bind(alice, netip.MustParseAddr("172.30.0.50"))
+	s.sessions.Bind(alice, netip.MustParseAddr("fced:30::50"))
+	s.sessions.Bind(anonymous, netip.MustParseAddr("172.30.0.51"))
+
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("172.30.0.50"), netip.MustParseAddr("fced:30::50")}, s.lookupName("Alice"))
+	assert.Empty(t, s.lookupName("bob"))
+	assert.Empty(t, s.lookupName(""))
+}
+
+func TestServer_FixedAddrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	write := func(data string, at time.Time) {
+		assert.Nil(t, os.WriteFile(path, []byte(data), 0600))
+		assert.Nil(t, os.Chtimes(path, at, at))
+	}
+	now := time.Now()
+	write(`[{"name": "alice", "secret": "a", "enabled": true, "ip": "172.31.0.10", "ipv6": "fced:31::ac1f:a"}]`, now)
+	s := NewServer(nil, nil, config.Config{CIDR: "172.31.0.1/24", CIDRv6: "fced:31::1/64"})
+	s.ipv4 = netip.MustParsePrefix(s.config.CIDR)
+	s.ipv6 = netip.MustParsePrefix(s.config.CIDRv6)
+	users, err := auth.LoadUsers(path, s.ipv4, s.ipv6)
+	assert.Nil(t, err)
+	s.users = users
+	users.OnReload(s.reloadUsers)
+	s.reloadUsers(nil)
+	defer register.SetFixedIPs(nil)
+	hello := func(id string, ip string) *xproto.ClientHandshakePacket {
+		return &xproto.ClientHandshakePacket{CIDRv4: net.ParseIP(ip), CIDRv6: net.IPv6zero, ClientID: []byte(id)}
+	}
+
+	// a dynamic client which prefers the fixed address of alice gets another one, the derived ipv6 too
+	a, err := s.assign(hello("a", "172.31.0.10"), nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "172.31.0.10/24", a.CIDRv4.String())
+	assert.NotEqual(t, "fced:31::ac1f:a/64", a.CIDRv6.String())
+	alice, err := users.Lookup("alice")
+	assert.Nil(t, err)
+	c, err := s.assign(hello("c", ""), alice)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.31.0.10/24", c.CIDRv4.String())
+
+	connA, connAlice := &fakeConn{}, &fakeConn{}
+	sessA := NewSession(connA, "udp", "")
+	sessAlice := NewSession(connAlice, "udp", "alice")
+	for sess, addr := range map[*Session]netip.Addr{sessA: a.CIDRv4.Addr(), sessAlice: c.CIDRv4.Addr()} {
+		s.sessions.Add(sess)
+		s.sessions.Bind(sess, addr)
+	}
+
+	// the address of the dynamic client is fixed to bob, then alice is disabled
+	write(`[{"name": "alice", "secret": "a", "enabled": true, "ip": "172.31.0.10", "ipv6": "fced:31::ac1f:a"},
+		{"name": "bob", "secret": "b", "enabled": true, "ip": "`+a.CIDRv4.Addr().String()+`"}]`, now.Add(time.Second))
+	users.Reload()
+	assert.Eventually(t, func() bool { return sessA.Closed() }, time.Second, 10*time.Millisecond)
+	assert.False(t, sessAlice.Closed())
+	_, ok := s.sessions.Lookup(a.CIDRv4.Addr())
+	assert.False(t, ok)
+	write(`[{"name": "alice", "secret": "a", "ip": "172.31.0.10", "ipv6": "fced:31::ac1f:a"}]`, now.Add(2*time.Second))
+	users.Reload()
+	assert.Eventually(t, func() bool { return sessAlice.Closed() }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, s.sessions.Len())
+}
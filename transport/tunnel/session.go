@@ -0,0 +1,351 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/vtun/common/x/xroute"
+	"github.com/net-byte/vtun/transport"
+)
+
+// Session is the state of a client connected to the server
+type Session struct {
+	// id is the session id sent to the client, in hex
+	id         string
+	conn       transport.Conn
+	wmu        sync.Mutex
+	transport  string
+	user       string
+	remoteAddr net.Addr
+	created    time.Time
+
+	mu   sync.RWMutex
+	ipv4 netip.Addr
+	ipv6 netip.Addr
+	// subnets are routed behind the client, their addresses are accepted as source
+	subnets []netip.Prefix
+
+	lastSeen  atomic.Int64
+	rxBytes   atomic.Uint64
+	txBytes   atomic.Uint64
+	rxPackets atomic.Uint64
+	txPackets atomic.Uint64
+	spoofed   atomic.Uint64
+	closed    atomic.Bool
+	closeOnce sync.Once
+}
+
+// SessionStats is a snapshot of the counters of a session
+type SessionStats struct {
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	// Spoofed is the number of packets dropped because of their source address
+	Spoofed uint64
+}
+
+// NewSession returns a session of the user for the connection accepted by the named transport,
+// the user is empty when the server authenticates with the shared key.
+func NewSession(conn transport.Conn, transport string, user string) *Session {
+	now := time.Now()
+	s := &Session{
+		conn:       conn,
+		transport:  transport,
+		user:       user,
+		remoteAddr: conn.RemoteAddr(),
+		created:    now,
+	}
+	s.lastSeen.Store(now.UnixNano())
+	return s
+}
+
+// WritePacket sends a packet to the client, calls are serialized
+func (s *Session) WritePacket(b []byte) error {
+	n := len(b)
+	s.wmu.Lock()
+	err := s.conn.WritePacket(b)
+	s.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.txBytes.Add(uint64(n))
+	s.txPackets.Add(1)
+	return nil
+}
+
+// ReadPacket reads a packet from the client and refreshes the last seen time
+func (s *Session) ReadPacket() ([]byte, error) {
+	b, err := s.conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	s.lastSeen.Store(time.Now().UnixNano())
+	s.rxBytes.Add(uint64(len(b)))
+	s.rxPackets.Add(1)
+	return b, nil
+}
+
+// Close closes the connection of the session, it is safe to call Close more than once
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.closed.Store(true)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// Closed reports whether the session is closed
+func (s *Session) Closed() bool {
+	return s.closed.Load()
+}
+
+// ID returns the session id sent to the client in hex, it is empty if the session was not created by a handshake
+func (s *Session) ID() string {
+	return s.id
+}
+
+// RTT returns the smoothed round trip time to the client, it is 0 until measured
+func (s *Session) RTT() time.Duration {
+	if sc, ok := s.conn.(*secureConn); ok {
+		srtt, _ := sc.RTT()
+		return srtt
+	}
+	return 0
+}
+
+// Transport returns the name of the transport of the session
+func (s *Session) Transport() string {
+	return s.transport
+}
+
+// User returns the name of the authenticated user of the session
+func (s *Session) User() string {
+	return s.user
+}
+
+// RemoteAddr returns the address of the client
+func (s *Session) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// Created returns the time the session was established
+func (s *Session) Created() time.Time {
+	return s.created
+}
+
+// LastSeen returns the time the last packet was received from the client
+func (s *Session) LastSeen() time.Time {
+	return time.Unix(0, s.lastSeen.Load())
+}
+
+// IPv4 returns the IPv4 address of the client, it is invalid if not known yet
+func (s *Session) IPv4() netip.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ipv4
+}
+
+// IPv6 returns the IPv6 address of the client, it is invalid if not known yet
+func (s *Session) IPv6() netip.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ipv6
+}
+
+// Stats returns the counters of the session
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		RxBytes:   s.rxBytes.Load(),
+		TxBytes:   s.txBytes.Load(),
+		RxPackets: s.rxPackets.Load(),
+		TxPackets: s.txPackets.Load(),
+		Spoofed:   s.spoofed.Load(),
+	}
+}
+
+// SetSubnets sets the subnets routed behind the client
+func (s *Session) SetSubnets(subnets []netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subnets = subnets
+}
+
+// Subnets returns the subnets routed behind the client
+func (s *Session) Subnets() []netip.Prefix {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.subnets
+}
+
+// CheckSource reports whether the client may send packets from addr, the packets from other addresses are counted as spoofed
+func (s *Session) CheckSource(addr netip.Addr) bool {
+	s.mu.RLock()
+	ok := addr.IsValid() && (addr == s.ipv4 || addr == s.ipv6)
+	for _, p := range s.subnets {
+		if ok {
+			break
+		}
+		ok = p.Contains(addr)
+	}
+	s.mu.RUnlock()
+	if !ok {
+		s.spoofed.Add(1)
+	}
+	return ok
+}
+
+// setAddr records the address of the client and returns the one it replaced
+func (s *Session) setAddr(addr netip.Addr) netip.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var old netip.Addr
+	if addr.Is4() {
+		old, s.ipv4 = s.ipv4, addr
+	} else {
+		old, s.ipv6 = s.ipv6, addr
+	}
+	return old
+}
+
+// clearAddr forgets the address of the client if it is still the recorded one
+func (s *Session) clearAddr(addr netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ipv4 == addr {
+		s.ipv4 = netip.Addr{}
+	}
+	if s.ipv6 == addr {
+		s.ipv6 = netip.Addr{}
+	}
+}
+
+// SessionTable routes the client addresses and the subnets behind the clients to their sessions
+type SessionTable struct {
+	mu     sync.RWMutex
+	routes xroute.Table[*Session]
+	// sessions holds the subnets routed to each session
+	sessions map[*Session][]netip.Prefix
+}
+
+// NewSessionTable returns an empty session table
+func NewSessionTable() *SessionTable {
+	return &SessionTable{
+		sessions: make(map[*Session][]netip.Prefix),
+	}
+}
+
+// Add adds a session without address to the table
+func (t *SessionTable) Add(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[s] = nil
+}
+
+// Bind routes the address to the session, a previous session of the address loses it.
+// The previous session is returned, it is nil if the address was free or already bound to s.
+func (t *SessionTable) Bind(s *Session, addr netip.Addr) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.sessions[s]; !ok {
+		return nil
+	}
+	host := netip.PrefixFrom(addr, addr.BitLen())
+	prev, _ := t.routes.Get(host)
+	if prev == s {
+		return nil
+	}
+	if prev != nil {
+		prev.clearAddr(addr)
+	}
+	t.routes.Insert(host, s)
+	if old := s.setAddr(addr); old.IsValid() && old != addr {
+		t.deleteRoute(s, netip.PrefixFrom(old, old.BitLen()))
+	}
+	return prev
+}
+
+// Route routes the subnet to the session, a previous session of the subnet loses it.
+// The previous session is returned, it is nil if the subnet was free or already routed to s.
+func (t *SessionTable) Route(s *Session, subnet netip.Prefix) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.sessions[s]; !ok {
+		return nil
+	}
+	subnet = subnet.Masked()
+	prev, _ := t.routes.Get(subnet)
+	if prev == s {
+		return nil
+	}
+	if prev != nil {
+		routes := t.sessions[prev]
+		for i, p := range routes {
+			if p == subnet {
+				t.sessions[prev] = append(routes[:i:i], routes[i+1:]...)
+				break
+			}
+		}
+	}
+	t.routes.Insert(subnet, s)
+	t.sessions[s] = append(t.sessions[s], subnet)
+	return prev
+}
+
+// LookupRoute returns the session the prefix is routed to
+func (t *SessionTable) LookupRoute(prefix netip.Prefix) (*Session, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routes.Get(prefix)
+}
+
+// deleteRoute deletes the route of the prefix if it is still the one of the session
+func (t *SessionTable) deleteRoute(s *Session, prefix netip.Prefix) {
+	if v, ok := t.routes.Get(prefix); ok && v == s {
+		t.routes.Delete(prefix)
+	}
+}
+
+// Lookup returns the session of the longest route which contains the address
+func (t *SessionTable) Lookup(addr netip.Addr) (*Session, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routes.Lookup(addr)
+}
+
+// Remove deletes the session and its routes from the table
+func (t *SessionTable) Remove(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, subnet := range t.sessions[s] {
+		t.deleteRoute(s, subnet)
+	}
+	delete(t.sessions, s)
+	for _, addr := range []netip.Addr{s.IPv4(), s.IPv6()} {
+		if addr.IsValid() {
+			t.deleteRoute(s, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+}
+
+// Sessions returns the sessions in the table
+func (t *SessionTable) Sessions() []*Session {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	sessions := make([]*Session, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Len returns the number of sessions in the table
+func (t *SessionTable) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.sessions)
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/net-byte/vtun/common/netutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeConn struct {
+	closed bool
+}
+
+func (c *fakeConn) ReadPacket() ([]byte, error) { return nil, net.ErrClosed }
+func (c *fakeConn) WritePacket(b []byte) error  { return nil }
+func (c *fakeConn) RemoteAddr() net.Addr        { return &net.UDPAddr{} }
+func (c *fakeConn) Close() error                { c.closed = true; return nil }
+
+func TestSessionTable(t *testing.T) {
+	table := NewSessionTable()
+	a := NewSession(&fakeConn{}, "udp", "")
+	b := NewSession(&fakeConn{}, "udp", "")
+	table.Add(a)
+	table.Add(b)
+	ip := netip.MustParseAddr("172.16.0.10")
+	ip6 := netip.MustParseAddr("fced:9999::10")
+
+	assert.Nil(t, table.Bind(a, ip))
+	assert.Nil(t, table.Bind(a, ip6))
+	s, ok := table.Lookup(ip)
+	assert.True(t, ok)
+	assert.Equal(t, a, s)
+	assert.Equal(t, ip, a.IPv4())
+	assert.Equal(t, ip6, a.IPv6())
+
+	// a reconnecting client takes over its address
+	assert.Equal(t, a, table.Bind(b, ip))
+	s, _ = table.Lookup(ip)
+	assert.Equal(t, b, s)
+	assert.False(t, a.IPv4().IsValid())
+
+	// removing the stale session keeps the address of the new one
+	table.Remove(a)
+	s, ok = table.Lookup(ip)
+	assert.True(t, ok)
+	assert.Equal(t, b, s)
+	_, ok = table.Lookup(ip6)
+	assert.False(t, ok)
+
+	table.Remove(b)
+	_, ok = table.Lookup(ip)
+	assert.False(t, ok)
+	assert.Equal(t, 0, table.Len())
+
+	// a removed session can not bind addresses
+	assert.Nil(t, table.Bind(b, ip))
+	_, ok = table.Lookup(ip)
+	assert.False(t, ok)
+}
+
+func TestSession_CheckSource(t *testing.T) {
+	table := NewSessionTable()
+	a := NewSession(&fakeConn{}, "udp", "alice")
+	table.Add(a)
+	table.Bind(a, netip.MustParseAddr("172.16.0.10"))
+	table.Bind(a, netip.MustParseAddr("fced:9999::10"))
+
+	assert.True(t, a.CheckSource(netip.MustParseAddr("172.16.0.10")))
+	assert.True(t, a.CheckSource(netip.MustParseAddr("fced:9999::10")))
+	// another client address
+	assert.False(t, a.CheckSource(netip.MustParseAddr("172.16.0.11")))
+	assert.False(t, a.CheckSource(netip.Addr{}))
+	assert.False(t, a.CheckSource(netip.MustParseAddr("192.168.1.20")))
+	assert.Equal(t, uint64(3), a.Stats().Spoofed)
+
+	// the routed subnets are accepted
+	a.SetSubnets([]netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")})
+	assert.True(t, a.CheckSource(netip.MustParseAddr("192.168.1.20")))
+	assert.False(t, a.CheckSource(netip.MustParseAddr("192.168.2.20")))
+}
+
+func TestSessionTable_Route(t *testing.T) {
+	table := NewSessionTable()
+	a := NewSession(&fakeConn{}, "udp", "alice")
+	b := NewSession(&fakeConn{}, "udp", "bob")
+	table.Add(a)
+	table.Add(b)
+	table.Bind(a, netip.MustParseAddr("172.16.0.10"))
+	table.Bind(b, netip.MustParseAddr("172.16.0.11"))
+	assert.Nil(t, table.Route(a, netip.MustParsePrefix("192.168.0.0/16")))
+	assert.Nil(t, table.Route(b, netip.MustParsePrefix("192.168.1.1/24")))
+
+	// the longest route wins
+	s, ok := table.Lookup(netip.MustParseAddr("192.168.1.20"))
+	assert.True(t, ok)
+	assert.Equal(t, b, s)
+	s, _ = table.Lookup(netip.MustParseAddr("192.168.2.20"))
+	assert.Equal(t, a, s)
+	s, _ = table.Lookup(netip.MustParseAddr("172.16.0.11"))
+	assert.Equal(t, b, s)
+
+	// the routes of a removed session are deleted
+	table.Remove(b)
+	s, _ = table.Lookup(netip.MustParseAddr("192.168.1.20"))
+	assert.Equal(t, a, s)
+	_, ok = table.Lookup(netip.MustParseAddr("172.16.0.11"))
+	assert.False(t, ok)
+
+	// a subnet taken over is not deleted with the previous session
+	c := NewSession(&fakeConn{}, "udp", "carol")
+	table.Add(c)
+	assert.Equal(t, a, table.Route(c, netip.MustParsePrefix("192.168.0.0/16")))
+	table.Remove(a)
+	s, _ = table.Lookup(netip.MustParseAddr("192.168.2.20"))
+	assert.Equal(t, c, s)
+}
+
+func BenchmarkSessionTable_Lookup(b *testing.B) {
+	table := NewSessionTable()
+	for i := 0; i < 250; i++ {
+		s := NewSession(&fakeConn{}, "udp", "")
+		table.Add(s)
+		table.Bind(s, netip.AddrFrom4([4]byte{172, 16, 0, byte(i + 2)}))
+	}
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 8, 8, 8, 8, 172, 16, 0, 100}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(netutil.GetDstAddr(packet))
+	}
+}